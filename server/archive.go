@@ -0,0 +1,163 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+const archiveManifestName = "manifest.json"
+
+var errInvalidArchive = errors.New("invalid model archive")
+
+// SaveTar writes the model's manifest and every blob it references to w as a
+// tar archive. The manifest comes first, followed by the blobs ordered by
+// digest, so saving the same model twice produces identical archives.
+func (mp ModelPath) SaveTar(w io.Writer) error {
+	return mp.SaveDeltaTar(w, nil)
+}
+
+// SaveDeltaTar writes an archive like SaveTar but leaves out the blobs whose
+// digests are in present, e.g. those another machine already has, so only the
+// missing blobs are transferred. The target can load the archive with LoadTar
+// as long as it has the blobs which were left out.
+func (mp ModelPath) SaveDeltaTar(w io.Writer, present []string) error {
+	skip := make(map[string]bool, len(present))
+	for _, digest := range present {
+		skip[canonicalDigest(digest)] = true
+	}
+
+	manifest, err := mp.readManifest()
+	if err != nil {
+		return err
+	}
+
+	var m ManifestV2
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		return err
+	}
+
+	var digests []string
+	sizes := make(map[string]int64)
+	for _, layer := range append(m.Layers, m.Config) {
+		if layer != nil {
+			digests = append(digests, layer.Digest)
+			sizes[layer.Digest] = layer.Size
+		}
+	}
+
+	slices.Sort(digests)
+	digests = slices.Compact(digests)
+
+	tw := tar.NewWriter(w)
+	if err := writeTarFile(tw, archiveManifestName, int64(len(manifest)), bytes.NewReader(manifest)); err != nil {
+		return err
+	}
+
+	for _, digest := range digests {
+		if skip[canonicalDigest(digest)] {
+			continue
+		}
+
+		if err := writeTarBlob(tw, digest, sizes[digest]); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// LoadTar imports an archive written by SaveTar, storing its manifest under
+// as. Every blob is verified against its digest while it is written, and the
+// manifest is only written once all of the blobs it references are present.
+func LoadTar(r io.Reader, as ModelPath) error {
+	if err := as.Validate(); err != nil {
+		return err
+	}
+
+	var manifest []byte
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		switch dir, name := path.Split(hdr.Name); {
+		case hdr.Name == archiveManifestName:
+			if manifest, err = io.ReadAll(tr); err != nil {
+				return err
+			}
+		case dir == "blobs/":
+			digest := strings.Replace(name, "-", ":", 1)
+			if !blobDigestRegEx.MatchString(digest) {
+				return fmt.Errorf("%w: unexpected blob %q", errInvalidArchive, hdr.Name)
+			}
+
+			if _, err := activeStore().WriteBlob(digest, tr); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: unexpected entry %q", errInvalidArchive, hdr.Name)
+		}
+	}
+
+	if manifest == nil {
+		return fmt.Errorf("%w: missing %s", errInvalidArchive, archiveManifestName)
+	}
+
+	var m ManifestV2
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidArchive, err)
+	}
+
+	for _, layer := range append(m.Layers, m.Config) {
+		if layer == nil {
+			continue
+		}
+
+		if ok, err := activeStore().HasBlob(layer.Digest); err != nil {
+			return fmt.Errorf("%w: blob %s: %w", errInvalidArchive, layer.Digest, err)
+		} else if !ok {
+			return fmt.Errorf("%w: blob %s: %w", errInvalidArchive, layer.Digest, os.ErrNotExist)
+		}
+	}
+
+	return as.writeManifest(manifest)
+}
+
+func writeTarBlob(tw *tar.Writer, digest string, size int64) error {
+	r, err := activeStore().OpenBlob(digest)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return writeTarFile(tw, path.Join("blobs", strings.Replace(digest, ":", "-", 1)), size, r)
+}
+
+func writeTarFile(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0o644,
+		ModTime:  time.Unix(0, 0),
+		Format:   tar.FormatPAX,
+	}); err != nil {
+		return err
+	}
+
+	_, err := io.Copy(tw, r)
+	return err
+}
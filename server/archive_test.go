@@ -0,0 +1,153 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSaveLoadTar(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	writeTestModel(t, "llama3:8b", "config", "weights", "template")
+
+	src := ParseModelPath("llama3:8b")
+	_, want, err := GetManifest(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := src.SaveTar(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	var again bytes.Buffer
+	if err := src.SaveTar(&again); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b.Bytes(), again.Bytes()) {
+		t.Error("expected archives of the same model to be identical")
+	}
+
+	// load into an empty store
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	dst := ParseModelPath("imported/llama3:8b")
+	if err := LoadTar(bytes.NewReader(b.Bytes()), dst); err != nil {
+		t.Fatal(err)
+	}
+
+	_, got, err := GetManifest(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != want {
+		t.Errorf("got manifest digest %s, want %s", got, want)
+	}
+
+	if broken, err := FindBrokenModels(); err != nil {
+		t.Fatal(err)
+	} else if len(broken) > 0 {
+		t.Errorf("expected loaded model to be complete, got broken %v", broken)
+	}
+}
+
+func TestSaveDeltaTar(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	digests := writeTestModel(t, "llama3:8b", "config", "weights", "template")
+
+	src := ParseModelPath("llama3:8b")
+	var b bytes.Buffer
+	// the target already has the weights, named with the other separator
+	if err := src.SaveDeltaTar(&b, []string{strings.Replace(digests[1], ":", "-", 1)}); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(b.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		names = append(names, hdr.Name)
+	}
+
+	want := []string{archiveManifestName}
+	for _, digest := range []string{digests[0], digests[2]} {
+		want = append(want, "blobs/"+strings.Replace(digest, ":", "-", 1))
+	}
+
+	slices.Sort(want[1:])
+	if !slices.Equal(names, want) {
+		t.Errorf("got entries %v, want %v", names, want)
+	}
+
+	// a target without the left out blob can't load the archive
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	if err := LoadTar(bytes.NewReader(b.Bytes()), src); !errors.Is(err, errInvalidArchive) {
+		t.Fatalf("expected errInvalidArchive, got %v", err)
+	}
+
+	if _, err := WriteBlob(digests[1], strings.NewReader("weights")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := LoadTar(bytes.NewReader(b.Bytes()), src); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadTarInvalid(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	archive := func(t *testing.T, files map[string]string) *bytes.Buffer {
+		t.Helper()
+
+		var b bytes.Buffer
+		tw := tar.NewWriter(&b)
+		for name, content := range files {
+			if err := writeTarFile(tw, name, int64(len(content)), bytes.NewReader([]byte(content))); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		return &b
+	}
+
+	const digest = "sha256-456402914e838a953e0cf80caa6adbe75383d9e63584a964f504a7bbb8f7aad9"
+
+	cases := []struct {
+		name  string
+		files map[string]string
+		err   error
+	}{
+		{"missing manifest", map[string]string{}, errInvalidArchive},
+		{"path traversal", map[string]string{"../manifest.json": "{}"}, errInvalidArchive},
+		{"corrupt blob", map[string]string{"blobs/" + digest: "corrupt"}, errDigestMismatch},
+		{"missing blob", map[string]string{archiveManifestName: `{"config":{"digest":"` + digest + `"}}`}, errInvalidArchive},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := LoadTar(archive(t, tt.files), ParseModelPath("llama3")); !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !windows
+
+package server
+
+import (
+	"os"
+	"time"
+)
+
+func accessTime(fi os.FileInfo) time.Time {
+	return fi.ModTime()
+}
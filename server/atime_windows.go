@@ -0,0 +1,15 @@
+package server
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+func accessTime(fi os.FileInfo) time.Time {
+	if attr, ok := fi.Sys().(*syscall.Win32FileAttributeData); ok {
+		return time.Unix(0, attr.LastAccessTime.Nanoseconds())
+	}
+
+	return fi.ModTime()
+}
@@ -50,6 +50,23 @@ func (r registryChallenge) URL() (*url.URL, error) {
 	return redirectURL, nil
 }
 
+const (
+	defaultRegistryRealm   = "https://ollama.com/token"
+	defaultRegistryService = "ollama.com"
+)
+
+// DefaultAuthParams returns the token realm and service of the default
+// registry, saving the round trip otherwise needed to discover them from its
+// WWW-Authenticate challenge. ok is false for other registries, whose
+// parameters must be discovered.
+func (mp ModelPath) DefaultAuthParams() (realm, service string, ok bool) {
+	if mp.canonicalRegistry() != DefaultRegistry {
+		return "", "", false
+	}
+
+	return defaultRegistryRealm, defaultRegistryService, true
+}
+
 func getAuthorizationToken(ctx context.Context, challenge registryChallenge) (string, error) {
 	redirectURL, err := challenge.URL()
 	if err != nil {
@@ -0,0 +1,337 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/ollama/ollama/server/envconfig"
+)
+
+// listBlobs returns the digests of all blobs in the blobs directory and its
+// shard directories, skipping files which aren't named after a valid digest
+// (e.g. partial downloads).
+func listBlobs() ([]string, error) {
+	p, err := GetBlobsPath("")
+	if err != nil {
+		return nil, err
+	}
+
+	return listBlobsIn(p, true)
+}
+
+func listBlobsIn(dir string, shards bool) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var digests []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			if shards && isBlobShard(entry.Name()) {
+				sharded, err := listBlobsIn(filepath.Join(dir, entry.Name()), false)
+				if err != nil {
+					return nil, err
+				}
+
+				digests = append(digests, sharded...)
+			}
+
+			continue
+		}
+
+		digest := strings.Replace(entry.Name(), "-", ":", 1)
+		if blobDigestRegEx.MatchString(digest) {
+			digests = append(digests, digest)
+		}
+	}
+
+	return digests, nil
+}
+
+// VerifyAllBlobs hashes every blob in the store and reports the result for each
+// digest; a nil error means the blob is intact. At most concurrency blobs are
+// hashed at once, defaulting to GOMAXPROCS when concurrency <= 0. The returned
+// error is only non-nil if the store can't be read or ctx is cancelled.
+func VerifyAllBlobs(ctx context.Context, concurrency int) (results map[string]error, err error) {
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+
+	digests, err := listBlobs()
+	if err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	results = make(map[string]error, len(digests))
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+	for _, digest := range digests {
+		g.Go(func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			err := verifyBlob(digest)
+
+			mu.Lock()
+			defer mu.Unlock()
+			results[digest] = err
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// VerifyDeep checks that the model's manifest can be read and that every blob
+// it references is present and matches its digest. All problems are returned
+// together as a single joined error. ctx is checked before each blob is
+// hashed.
+func (mp ModelPath) VerifyDeep(ctx context.Context) error {
+	digests, err := mp.ReferencedBlobs()
+	if err != nil {
+		return err
+	}
+
+	slices.Sort(digests)
+	digests = slices.Compact(digests)
+
+	var errs []error
+	for _, digest := range digests {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := verifyBlob(digest); err != nil {
+			errs = append(errs, fmt.Errorf("blob %s: %w", digest, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// QuarantineBlob moves a blob out of the active store into the
+// blobs/quarantine directory, keeping its file name, so it can be inspected
+// instead of deleted. It returns the new location of the blob.
+func QuarantineBlob(digest string) (quarantinePath string, err error) {
+	blob, err := GetBlobsPath(digest)
+	if err != nil {
+		return "", err
+	}
+
+	blobs, err := GetBlobsPath("")
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(blobs, "quarantine")
+	if err := mkdirAll(dir); err != nil {
+		return "", err
+	}
+
+	quarantinePath = filepath.Join(dir, filepath.Base(blob))
+	if err := os.Rename(blob, quarantinePath); err != nil {
+		return "", err
+	}
+
+	return quarantinePath, nil
+}
+
+// ReshardBlobs moves every blob in the flat layout into its shard directory,
+// verifying each blob's digest first. Blobs which fail verification are left
+// in place and reported in the returned error. A blob found in both layouts,
+// e.g. written by servers with different settings, keeps its sharded copy if
+// that verifies and is otherwise replaced by the verified flat copy.
+func ReshardBlobs() (moved int, err error) {
+	dir, err := GetBlobsPath("")
+	if err != nil {
+		return 0, err
+	}
+
+	digests, err := listBlobsIn(dir, false)
+	if err != nil {
+		return 0, err
+	}
+
+	var errs []error
+	for _, digest := range digests {
+		name := strings.Replace(digest, ":", "-", 1)
+		flat := filepath.Join(dir, name)
+		sharded := filepath.Join(dir, blobShard(name), name)
+
+		if _, err := os.Stat(sharded); err == nil && verifyBlobFile(sharded, digest) == nil {
+			if err := os.Remove(flat); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+
+		if err := verifyBlobFile(flat, digest); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if err := mkdirAll(filepath.Dir(sharded)); err != nil {
+			return moved, err
+		}
+
+		if err := os.Rename(flat, sharded); err != nil {
+			return moved, err
+		}
+
+		moved++
+	}
+
+	return moved, errors.Join(errs...)
+}
+
+// ErrBlobNotFound is returned when a blob is missing from the store. It wraps
+// os.ErrNotExist.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// CopyBlobTo streams the blob with the given digest to w and returns the
+// number of bytes written.
+func CopyBlobTo(digest string, w io.Writer) (int64, error) {
+	f, err := activeStore().OpenBlob(digest)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("%w: %s: %w", ErrBlobNotFound, digest, err)
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return io.Copy(w, f)
+}
+
+// DedupeBlobs replaces blobs stored in both the flat and the sharded layout,
+// e.g. after an interrupted copy, with hardlinks to a single file, and returns
+// the number of bytes reclaimed. Both copies are verified before linking;
+// copies which fail verification are left alone and reported in the returned
+// error.
+func DedupeBlobs() (saved int64, err error) {
+	dir, err := GetBlobsPath("")
+	if err != nil {
+		return 0, err
+	}
+
+	digests, err := listBlobsIn(dir, false)
+	if err != nil {
+		return 0, err
+	}
+
+	var errs []error
+	for _, digest := range digests {
+		name := strings.Replace(digest, ":", "-", 1)
+		canonical, duplicate := filepath.Join(dir, name), filepath.Join(dir, blobShard(name), name)
+		if envconfig.BlobSharding {
+			canonical, duplicate = duplicate, canonical
+		}
+
+		fi, err := os.Stat(duplicate)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if canonicalInfo, err := os.Stat(canonical); err != nil {
+			errs = append(errs, err)
+			continue
+		} else if os.SameFile(fi, canonicalInfo) {
+			// already linked
+			continue
+		}
+
+		if err := errors.Join(verifyBlobFile(canonical, digest), verifyBlobFile(duplicate, digest)); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if err := linkOver(canonical, duplicate); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		saved += fi.Size()
+	}
+
+	return saved, errors.Join(errs...)
+}
+
+// linkOver atomically replaces name with a hardlink to target.
+func linkOver(target, name string) error {
+	temp := filepath.Join(filepath.Dir(name), "."+filepath.Base(name)+"-link")
+	if err := os.Link(target, temp); err != nil {
+		return err
+	}
+
+	if err := os.Rename(temp, name); err != nil {
+		os.Remove(temp)
+		return err
+	}
+
+	return nil
+}
+
+// copyBlobFile copies the blob with the given digest from src to dst,
+// verifying its digest on the way, and renames it into place so dst is never
+// left partially written. An intact blob already at dst is kept.
+func copyBlobFile(src, dst, digest string) error {
+	if verifyBlobFile(dst, digest) == nil {
+		return nil
+	}
+
+	if err := mkdirAll(filepath.Dir(dst)); err != nil {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	temp, err := createTemp(filepath.Dir(dst), "sha256-")
+	if err != nil {
+		return err
+	}
+	defer temp.Close()
+	defer os.Remove(temp.Name())
+
+	w := NewDigestWriter(temp)
+	if _, err := io.Copy(w, in); err != nil {
+		return err
+	}
+
+	if got := w.Digest(); !DigestsEqual(digest, got) {
+		return fmt.Errorf("%w: want %s, got %s", errDigestMismatch, digest, got)
+	}
+
+	if err := chmodFile(temp); err != nil {
+		return err
+	}
+
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), dst)
+}
@@ -0,0 +1,532 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ollama/ollama/server/envconfig"
+)
+
+func TestVerifyAllBlobs(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var digests []string
+	for i := range 10 {
+		data := fmt.Sprintf("blob %d", i)
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(data)))
+		if _, err := WriteBlob(digest, strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		digests = append(digests, digest)
+	}
+
+	corrupt, err := GetBlobsPath(digests[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(corrupt, []byte("corrupt"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, concurrency := range []int{0, 1, 4} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			results, err := VerifyAllBlobs(context.Background(), concurrency)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(results) != len(digests) {
+				t.Fatalf("got %d results, want %d", len(results), len(digests))
+			}
+
+			for i, digest := range digests {
+				err, ok := results[digest]
+				switch {
+				case !ok:
+					t.Errorf("missing result for %s", digest)
+				case i == 3 && !errors.Is(err, errDigestMismatch):
+					t.Errorf("expected errDigestMismatch for %s, got %v", digest, err)
+				case i != 3 && err != nil:
+					t.Errorf("unexpected error for %s: %v", digest, err)
+				}
+			}
+		})
+	}
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if _, err := VerifyAllBlobs(ctx, 1); !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	})
+}
+
+func BenchmarkVerifyAllBlobs(b *testing.B) {
+	b.Setenv("OLLAMA_MODELS", b.TempDir())
+
+	data := strings.Repeat("x", 1<<20)
+	for i := range 32 {
+		data := fmt.Sprintf("%d%s", i, data)
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(data)))
+		if _, err := WriteBlob(digest, strings.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, concurrency := range []int{1, 4, 0} {
+		b.Run(fmt.Sprintf("concurrency %d", concurrency), func(b *testing.B) {
+			for range b.N {
+				if _, err := VerifyAllBlobs(context.Background(), concurrency); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyDeep(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	digests := writeTestModel(t, "llama3", "config", "good weights", "corrupt weights", "missing weights")
+
+	mp := ParseModelPath("llama3")
+	if err := mp.VerifyDeep(context.Background()); err != nil {
+		t.Fatalf("expected an intact model to verify, got %v", err)
+	}
+
+	corrupt, err := GetBlobsPath(digests[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(corrupt, []byte("corrupt"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	missing, err := GetBlobsPath(digests[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(missing); err != nil {
+		t.Fatal(err)
+	}
+
+	err = mp.VerifyDeep(context.Background())
+	if !errors.Is(err, errDigestMismatch) || !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected errDigestMismatch and os.ErrNotExist, got %v", err)
+	}
+
+	for i, digest := range digests {
+		if mentioned := strings.Contains(err.Error(), digest); mentioned != (i >= 2) {
+			t.Errorf("%s: mentioned in error = %t", digest, mentioned)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := mp.VerifyDeep(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	if err := ParseModelPath("missing").VerifyDeep(context.Background()); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist for a missing model, got %v", err)
+	}
+}
+
+func TestQuarantineBlob(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	data := "corrupt blob"
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(data)))
+	if _, err := WriteBlob(digest, strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	blob, err := GetBlobsPath(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := QuarantineBlob(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := filepath.Join(filepath.Dir(blob), "quarantine", filepath.Base(blob)); p != want {
+		t.Errorf("got %s, want %s", p, want)
+	}
+
+	if b, err := os.ReadFile(p); err != nil {
+		t.Fatal(err)
+	} else if string(b) != data {
+		t.Errorf("got %q, want %q", b, data)
+	}
+
+	if _, err := os.Stat(blob); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected blob to be removed from the store, got %v", err)
+	}
+
+	if digests, err := listBlobs(); err != nil {
+		t.Fatal(err)
+	} else if len(digests) != 0 {
+		t.Errorf("expected no blobs in the store, got %v", digests)
+	}
+
+	if _, err := QuarantineBlob(digest); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist for missing blob, got %v", err)
+	}
+}
+
+func TestGetBlobsPathSharding(t *testing.T) {
+	const name = "sha256-456402914e838a953e0cf80caa6adbe75383d9e63584a964f504a7bbb8f7aad9"
+	digest := strings.Replace(name, "-", ":", 1)
+
+	setSharding := func(t *testing.T, enabled bool) {
+		t.Helper()
+		t.Cleanup(envconfig.LoadConfig)
+		t.Setenv("OLLAMA_BLOB_SHARDING", strconv.FormatBool(enabled))
+		envconfig.LoadConfig()
+	}
+
+	write := func(t *testing.T, p string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(p, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, sharding := range []bool{false, true} {
+		t.Run(fmt.Sprintf("sharding %t", sharding), func(t *testing.T) {
+			setSharding(t, sharding)
+
+			t.Run("flat blob", func(t *testing.T) {
+				dir := t.TempDir()
+				t.Setenv("OLLAMA_MODELS", dir)
+
+				flat := filepath.Join(dir, "blobs", name)
+				write(t, flat)
+
+				if got, err := GetBlobsPath(digest); err != nil {
+					t.Fatal(err)
+				} else if got != flat {
+					t.Errorf("got %s, want %s", got, flat)
+				}
+			})
+
+			t.Run("sharded blob", func(t *testing.T) {
+				dir := t.TempDir()
+				t.Setenv("OLLAMA_MODELS", dir)
+
+				sharded := filepath.Join(dir, "blobs", "45", name)
+				write(t, sharded)
+
+				if got, err := GetBlobsPath(digest); err != nil {
+					t.Fatal(err)
+				} else if got != sharded {
+					t.Errorf("got %s, want %s", got, sharded)
+				}
+			})
+
+			t.Run("new blob", func(t *testing.T) {
+				dir := t.TempDir()
+				t.Setenv("OLLAMA_MODELS", dir)
+
+				data := "sharded blob"
+				digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(data)))
+				want := filepath.Join(dir, "blobs", strings.Replace(digest, ":", "-", 1))
+				if sharding {
+					want = filepath.Join(dir, "blobs", digest[7:9], strings.Replace(digest, ":", "-", 1))
+				}
+
+				if _, err := WriteBlob(digest, strings.NewReader(data)); err != nil {
+					t.Fatal(err)
+				}
+
+				if _, err := os.Stat(want); err != nil {
+					t.Fatalf("expected blob at %s: %v", want, err)
+				}
+
+				if digests, err := listBlobs(); err != nil {
+					t.Fatal(err)
+				} else if len(digests) != 1 || digests[0] != digest {
+					t.Errorf("listBlobs = %v, want [%s]", digests, digest)
+				}
+
+				if err := verifyBlob(digest); err != nil {
+					t.Error(err)
+				}
+			})
+		})
+	}
+}
+
+func TestReshardBlobs(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", dir)
+
+	digests := writeTestModel(t, "llama3", "config", "weights", "template")
+
+	// simulate an interrupted run which already moved the first blob but
+	// didn't get to remove its flat copy
+	first := strings.Replace(digests[0], ":", "-", 1)
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", first[7:9]), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "blobs", first))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "blobs", first[7:9], first), b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// and a corrupt sharded copy of the second, which the intact flat blob
+	// must replace rather than be removed in favor of
+	second := strings.Replace(digests[1], ":", "-", 1)
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", second[7:9]), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "blobs", second[7:9], second), []byte("truncated"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	corrupt := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("corrupt")))
+	corruptPath := filepath.Join(dir, "blobs", strings.Replace(corrupt, ":", "-", 1))
+	if err := os.WriteFile(corruptPath, []byte("not what the digest says"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := ReshardBlobs()
+	if !errors.Is(err, errDigestMismatch) {
+		t.Fatalf("expected errDigestMismatch for the corrupt blob, got %v", err)
+	}
+
+	if moved != 2 {
+		t.Errorf("moved %d blobs, want 2", moved)
+	}
+
+	if errs := err.(interface{ Unwrap() []error }).Unwrap(); len(errs) != 1 {
+		t.Errorf("expected only the corrupt blob to fail, got %v", err)
+	}
+
+	for _, digest := range digests {
+		name := strings.Replace(digest, ":", "-", 1)
+		if _, err := os.Stat(filepath.Join(dir, "blobs", name[7:9], name)); err != nil {
+			t.Errorf("expected sharded blob: %v", err)
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, "blobs", name)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected flat blob to be removed, got %v", err)
+		}
+
+		if err := verifyBlob(digest); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err := os.Stat(corruptPath); err != nil {
+		t.Errorf("expected corrupt blob to be left in place: %v", err)
+	}
+
+	if broken, err := FindBrokenModels(); err != nil {
+		t.Fatal(err)
+	} else if len(broken) > 0 {
+		t.Errorf("expected model to resolve after resharding, got broken %v", broken)
+	}
+
+	if err := os.Remove(corruptPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if moved, err := ReshardBlobs(); err != nil {
+		t.Fatal(err)
+	} else if moved != 0 {
+		t.Errorf("moved %d blobs on second run, want 0", moved)
+	}
+}
+
+func TestBlobCacheDirs(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	cache := t.TempDir()
+	t.Cleanup(envconfig.LoadConfig)
+	t.Setenv("OLLAMA_BLOB_CACHE_DIRS", strings.Join([]string{filepath.Join(t.TempDir(), "missing"), cache}, string(filepath.ListSeparator)))
+	envconfig.LoadConfig()
+
+	data := "cached config"
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(data)))
+	cached := filepath.Join(cache, strings.Replace(digest, ":", "-", 1))
+	if err := os.WriteFile(cached, []byte(data), 0o444); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("read from cache", func(t *testing.T) {
+		p, err := readBlobPath(digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if p != cached {
+			t.Errorf("got %s, want %s", p, cached)
+		}
+
+		if err := verifyBlob(digest); err != nil {
+			t.Errorf("verifyBlob: %v", err)
+		}
+	})
+
+	t.Run("write to store", func(t *testing.T) {
+		data := "new blob"
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(data)))
+		if _, err := WriteBlob(digest, strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+
+		p, err := readBlobPath(digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want, err := GetBlobsPath(digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if p != want {
+			t.Errorf("got %s, want %s", p, want)
+		}
+
+		if _, err := os.Stat(filepath.Join(cache, filepath.Base(want))); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected blob not to be written to the cache, got %v", err)
+		}
+	})
+}
+
+func TestCopyBlobTo(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	data := "blob contents"
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(data)))
+	if _, err := WriteBlob(digest, strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	n, err := CopyBlobTo(digest, &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != int64(len(data)) || b.String() != data {
+		t.Errorf("got %d bytes %q, want %q", n, b.String(), data)
+	}
+
+	missing := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("missing")))
+	if _, err := CopyBlobTo(missing, &b); !errors.Is(err, ErrBlobNotFound) || !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected ErrBlobNotFound, got %v", err)
+	}
+
+	if _, err := CopyBlobTo("sha256:1234", &b); !errors.Is(err, ErrInvalidDigestFormat) {
+		t.Errorf("expected ErrInvalidDigestFormat, got %v", err)
+	}
+}
+
+func TestDedupeBlobs(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	write := func(data string) (digest, flat, sharded string) {
+		digest = fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(data)))
+		if _, err := WriteBlob(digest, strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+
+		flat, err := GetBlobsPath(digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		name := filepath.Base(flat)
+		sharded = filepath.Join(filepath.Dir(flat), blobShard(name), name)
+		return digest, flat, sharded
+	}
+
+	_, flat, sharded := write("duplicated blob")
+	if err := os.MkdirAll(filepath.Dir(sharded), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(sharded, []byte("duplicated blob"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a corrupt duplicate must not replace the good copy
+	_, corruptFlat, corruptSharded := write("corrupted blob")
+	if err := os.MkdirAll(filepath.Dir(corruptSharded), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(corruptSharded, []byte("corrupt"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	write("unique blob")
+
+	saved, err := DedupeBlobs()
+	if !errors.Is(err, errDigestMismatch) {
+		t.Errorf("expected errDigestMismatch for the corrupt copy, got %v", err)
+	}
+
+	if saved != int64(len("duplicated blob")) {
+		t.Errorf("saved %d bytes, want %d", saved, len("duplicated blob"))
+	}
+
+	same := func(a, b string) bool {
+		t.Helper()
+		ai, err := os.Stat(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bi, err := os.Stat(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return os.SameFile(ai, bi)
+	}
+
+	if !same(flat, sharded) {
+		t.Error("expected duplicate to be hardlinked")
+	}
+
+	if same(corruptFlat, corruptSharded) {
+		t.Error("expected corrupt duplicate to be left alone")
+	}
+
+	// running again finds nothing more to reclaim
+	if err := os.Remove(corruptSharded); err != nil {
+		t.Fatal(err)
+	}
+
+	if saved, err := DedupeBlobs(); err != nil || saved != 0 {
+		t.Errorf("second run: saved %d, err %v", saved, err)
+	}
+}
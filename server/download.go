@@ -145,7 +145,7 @@ func (b *blobDownload) run(ctx context.Context, requestURL *url.URL, opts *regis
 	defer blobDownloadManager.Delete(b.Digest)
 	ctx, b.CancelFunc = context.WithCancel(ctx)
 
-	file, err := os.OpenFile(b.Name+"-partial", os.O_CREATE|os.O_RDWR, 0o644)
+	file, err := os.OpenFile(b.Name+"-partial", os.O_CREATE|os.O_RDWR, defaultFileMode)
 	if err != nil {
 		return err
 	}
@@ -191,6 +191,10 @@ func (b *blobDownload) run(ctx context.Context, requestURL *url.URL, opts *regis
 		return err
 	}
 
+	if err := chmodFile(file); err != nil {
+		return err
+	}
+
 	// explicitly close the file so we can rename it
 	if err := file.Close(); err != nil {
 		return err
@@ -341,7 +345,7 @@ type downloadOpts struct {
 
 // downloadBlob downloads a blob from the registry and stores it in the blobs directory
 func downloadBlob(ctx context.Context, opts downloadOpts) error {
-	fp, err := GetBlobsPath(opts.digest)
+	fp, err := readBlobPath(opts.digest)
 	if err != nil {
 		return err
 	}
@@ -365,8 +369,12 @@ func downloadBlob(ctx context.Context, opts downloadOpts) error {
 	data, ok := blobDownloadManager.LoadOrStore(opts.digest, &blobDownload{Name: fp, Digest: opts.digest})
 	download := data.(*blobDownload)
 	if !ok {
-		requestURL := opts.mp.BaseURL()
-		requestURL = requestURL.JoinPath("v2", opts.mp.GetNamespaceRepository(), "blobs", opts.digest)
+		requestURL, err := opts.mp.BlobURL(opts.digest)
+		if err != nil {
+			blobDownloadManager.Delete(opts.digest)
+			return err
+		}
+
 		if err := download.Prepare(ctx, requestURL, opts.regOpts); err != nil {
 			blobDownloadManager.Delete(opts.digest)
 			return err
@@ -13,8 +13,18 @@ import (
 var (
 	// Set via OLLAMA_ORIGINS in the environment
 	AllowOrigins []string
+	// Set via OLLAMA_BLOB_CACHE_DIRS in the environment
+	BlobCacheDirs []string
+	// Set via OLLAMA_BLOB_SHARDING in the environment
+	BlobSharding bool
 	// Set via OLLAMA_DEBUG in the environment
 	Debug bool
+	// Set via OLLAMA_DEFAULT_NAMESPACES in the environment
+	DefaultNamespaces map[string]string
+	// Set via OLLAMA_DIR_MODE in the environment, zero if unset
+	DirMode os.FileMode
+	// Set via OLLAMA_FILE_MODE in the environment, zero if unset
+	FileMode os.FileMode
 	// Set via OLLAMA_LLM_LIBRARY in the environment
 	LLMLibrary string
 	// Set via OLLAMA_MAX_LOADED_MODELS in the environment
@@ -27,24 +37,35 @@ var (
 	NoPrune bool
 	// Set via OLLAMA_NUM_PARALLEL in the environment
 	NumParallel int
+	// Set via OLLAMA_REQUIRE_TLS in the environment
+	RequireTLS bool
 	// Set via OLLAMA_RUNNERS_DIR in the environment
 	RunnersDir string
+	// Set via OLLAMA_TMP_DIR in the environment
+	StoreTmpDir string
 	// Set via OLLAMA_TMPDIR in the environment
 	TmpDir string
 )
 
 func AsMap() map[string]string {
 	return map[string]string{
-		"OLLAMA_ORIGINS":           fmt.Sprintf("%v", AllowOrigins),
-		"OLLAMA_DEBUG":             fmt.Sprintf("%v", Debug),
-		"OLLAMA_LLM_LIBRARY":       fmt.Sprintf("%v", LLMLibrary),
-		"OLLAMA_MAX_LOADED_MODELS": fmt.Sprintf("%v", MaxRunners),
-		"OLLAMA_MAX_QUEUE":         fmt.Sprintf("%v", MaxQueuedRequests),
-		"OLLAMA_MAX_VRAM":          fmt.Sprintf("%v", MaxVRAM),
-		"OLLAMA_NOPRUNE":           fmt.Sprintf("%v", NoPrune),
-		"OLLAMA_NUM_PARALLEL":      fmt.Sprintf("%v", NumParallel),
-		"OLLAMA_RUNNERS_DIR":       fmt.Sprintf("%v", RunnersDir),
-		"OLLAMA_TMPDIR":            fmt.Sprintf("%v", TmpDir),
+		"OLLAMA_ORIGINS":            fmt.Sprintf("%v", AllowOrigins),
+		"OLLAMA_BLOB_CACHE_DIRS":    fmt.Sprintf("%v", BlobCacheDirs),
+		"OLLAMA_BLOB_SHARDING":      fmt.Sprintf("%v", BlobSharding),
+		"OLLAMA_DEBUG":              fmt.Sprintf("%v", Debug),
+		"OLLAMA_DEFAULT_NAMESPACES": fmt.Sprintf("%v", DefaultNamespaces),
+		"OLLAMA_DIR_MODE":           fmt.Sprintf("%#o", DirMode),
+		"OLLAMA_FILE_MODE":          fmt.Sprintf("%#o", FileMode),
+		"OLLAMA_LLM_LIBRARY":        fmt.Sprintf("%v", LLMLibrary),
+		"OLLAMA_MAX_LOADED_MODELS":  fmt.Sprintf("%v", MaxRunners),
+		"OLLAMA_MAX_QUEUE":          fmt.Sprintf("%v", MaxQueuedRequests),
+		"OLLAMA_MAX_VRAM":           fmt.Sprintf("%v", MaxVRAM),
+		"OLLAMA_NOPRUNE":            fmt.Sprintf("%v", NoPrune),
+		"OLLAMA_NUM_PARALLEL":       fmt.Sprintf("%v", NumParallel),
+		"OLLAMA_REQUIRE_TLS":        fmt.Sprintf("%v", RequireTLS),
+		"OLLAMA_RUNNERS_DIR":        fmt.Sprintf("%v", RunnersDir),
+		"OLLAMA_TMPDIR":             fmt.Sprintf("%v", TmpDir),
+		"OLLAMA_TMP_DIR":            fmt.Sprintf("%v", StoreTmpDir),
 	}
 }
 
@@ -116,6 +137,10 @@ func LoadConfig() {
 
 	TmpDir = clean("OLLAMA_TMPDIR")
 
+	// unlike OLLAMA_TMPDIR, which holds the extracted runners, this is where
+	// blobs and manifests are written before being renamed into the store
+	StoreTmpDir = clean("OLLAMA_TMP_DIR")
+
 	userLimit := clean("OLLAMA_MAX_VRAM")
 	if userLimit != "" {
 		avail, err := strconv.ParseUint(userLimit, 10, 64)
@@ -141,6 +166,59 @@ func LoadConfig() {
 		NoPrune = true
 	}
 
+	DirMode = loadMode("OLLAMA_DIR_MODE")
+	FileMode = loadMode("OLLAMA_FILE_MODE")
+
+	BlobCacheDirs = nil
+	for _, dir := range filepath.SplitList(clean("OLLAMA_BLOB_CACHE_DIRS")) {
+		if dir != "" {
+			BlobCacheDirs = append(BlobCacheDirs, dir)
+		}
+	}
+
+	BlobSharding = false
+	if sharding := clean("OLLAMA_BLOB_SHARDING"); sharding != "" {
+		s, err := strconv.ParseBool(sharding)
+		if err == nil {
+			BlobSharding = s
+		} else {
+			BlobSharding = true
+		}
+	}
+
+	// registry=namespace pairs, e.g. registry.ollama.ai=library,corp.example.com=team-a,
+	// giving the namespace of names on a registry which don't spell one out
+	DefaultNamespaces = nil
+	for _, pair := range strings.Split(clean("OLLAMA_DEFAULT_NAMESPACES"), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		registry, namespace, found := strings.Cut(pair, "=")
+		registry, namespace = strings.TrimSpace(registry), strings.TrimSpace(namespace)
+		if !found || registry == "" || namespace == "" {
+			slog.Error("invalid setting, ignoring", "OLLAMA_DEFAULT_NAMESPACES", pair)
+			continue
+		}
+
+		if DefaultNamespaces == nil {
+			DefaultNamespaces = make(map[string]string)
+		}
+
+		DefaultNamespaces[strings.ToLower(registry)] = namespace
+	}
+
+	RequireTLS = false
+	if requireTLS := clean("OLLAMA_REQUIRE_TLS"); requireTLS != "" {
+		r, err := strconv.ParseBool(requireTLS)
+		if err == nil {
+			RequireTLS = r
+		} else {
+			RequireTLS = true
+		}
+	}
+
 	if origins := clean("OLLAMA_ORIGINS"); origins != "" {
 		AllowOrigins = strings.Split(origins, ",")
 	}
@@ -172,3 +250,20 @@ func LoadConfig() {
 		}
 	}
 }
+
+// loadMode parses the octal permission bits in the environment variable key,
+// returning 0 if it is unset or invalid.
+func loadMode(key string) os.FileMode {
+	s := clean(key)
+	if s == "" {
+		return 0
+	}
+
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode == 0 || os.FileMode(mode)&^os.ModePerm != 0 {
+		slog.Error("invalid setting, ignoring", key, s, "error", err)
+		return 0
+	}
+
+	return os.FileMode(mode)
+}
@@ -20,6 +20,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 
 	"golang.org/x/exp/slices"
 
@@ -156,7 +157,7 @@ type ConfigV2 struct {
 
 // ParseConfigFromFile Parse configuration from a file by specifying it digest.
 func ParseConfigFromFile(digest string) (cfg ConfigV2, _ error) {
-	filename, err := GetBlobsPath(digest)
+	filename, err := readBlobPath(digest)
 	if err != nil {
 		return cfg, fmt.Errorf("path: %w", err)
 	}
@@ -178,22 +179,13 @@ type RootFS struct {
 }
 
 func GetManifest(mp ModelPath) (*ManifestV2, string, error) {
-	fp, err := mp.GetManifestPath()
+	bts, err := mp.readManifest()
 	if err != nil {
 		return nil, "", err
 	}
 
-	if _, err = os.Stat(fp); err != nil {
-		return nil, "", err
-	}
-
 	var manifest *ManifestV2
 
-	bts, err := os.ReadFile(fp)
-	if err != nil {
-		return nil, "", fmt.Errorf("couldn't open file '%s'", fp)
-	}
-
 	shaSum := sha256.Sum256(bts)
 	shaStr := hex.EncodeToString(shaSum[:])
 
@@ -225,7 +217,7 @@ func GetModel(name string) (*Model, error) {
 	}
 
 	for _, layer := range manifest.Layers {
-		filename, err := GetBlobsPath(layer.Digest)
+		filename, err := readBlobPath(layer.Digest)
 		if err != nil {
 			return nil, err
 		}
@@ -593,83 +585,113 @@ func CopyModel(src, dst model.Name) error {
 		return nil
 	}
 
-	manifests, err := GetManifestPath()
+	// the source may be in any of the models directories; the copy is
+	// written to the first
+	manifest, err := ParseModelPath(src.String()).readManifest()
 	if err != nil {
 		return err
 	}
 
-	dstpath := filepath.Join(manifests, dst.Filepath())
-	if err := os.MkdirAll(filepath.Dir(dstpath), 0o755); err != nil {
-		return err
-	}
+	return ParseModelPath(dst.String()).writeManifest(manifest)
+}
 
-	srcpath := filepath.Join(manifests, src.Filepath())
-	srcfile, err := os.Open(srcpath)
-	if err != nil {
+func deleteUnusedLayers(skipModelPath *ModelPath, deleteMap map[string]struct{}) error {
+	if _, err := GetManifestPath(); err != nil {
 		return err
 	}
-	defer srcfile.Close()
 
-	dstfile, err := os.Create(dstpath)
+	// blobs may be used by manifests in any of the models directories
+	manifestsPaths, err := manifestsDirs()
 	if err != nil {
 		return err
 	}
-	defer dstfile.Close()
-
-	_, err = io.Copy(dstfile, srcfile)
-	return err
-}
 
-func deleteUnusedLayers(skipModelPath *ModelPath, deleteMap map[string]struct{}) error {
-	fp, err := GetManifestPath()
-	if err != nil {
-		return err
+	// the manifest being deleted, in whichever models directory it is read from
+	var skip string
+	if skipModelPath != nil {
+		if skip, err = skipModelPath.manifestReadPath(); err != nil {
+			return err
+		}
 	}
 
+	var fp string
 	walkFunc := func(path string, info os.FileInfo, _ error) error {
-		if info.IsDir() {
+		if info == nil {
+			// e.g. a models directory without manifests
 			return nil
 		}
 
-		dir, file := filepath.Split(path)
-		dir = strings.Trim(strings.TrimPrefix(dir, fp), string(os.PathSeparator))
-		tag := strings.Join([]string{dir, file}, ":")
-		fmp := ParseModelPath(tag)
-
-		// skip the manifest we're trying to delete
-		if skipModelPath != nil && skipModelPath.GetFullTagname() == fmp.GetFullTagname() {
+		if info.IsDir() || (skip != "" && sameFile(path, skip)) {
 			return nil
 		}
 
-		// save (i.e. delete from the deleteMap) any files used in other manifests
-		manifest, _, err := GetManifest(fmp)
+		rel, err := filepath.Rel(fp, path)
 		if err != nil {
-			// nolint: nilerr
+			return err
+		}
+
+		// save (i.e. delete from the deleteMap) any files used in other manifests
+		var manifest *ManifestV2
+		if fmp, ok := modelPathFromManifestPath(rel); ok {
+			if manifest, _, err = GetManifest(fmp); err != nil {
+				// nolint: nilerr
+				return nil
+			}
+		} else if isDigestManifestName(info.Name()) {
+			// digest-named copies, e.g. of models pulled by digest, aren't
+			// tags but still need their blobs
+			b, err := os.ReadFile(path)
+			if err != nil || json.Unmarshal(b, &manifest) != nil {
+				// nolint: nilerr
+				return nil
+			}
+		}
+
+		if manifest == nil {
 			return nil
 		}
 
 		for _, layer := range manifest.Layers {
-			delete(deleteMap, layer.Digest)
+			if layer != nil {
+				delete(deleteMap, layer.Digest)
+			}
+		}
+
+		if manifest.Config != nil {
+			delete(deleteMap, manifest.Config.Digest)
 		}
 
-		delete(deleteMap, manifest.Config.Digest)
 		return nil
 	}
 
-	if err := filepath.Walk(fp, walkFunc); err != nil {
+	for _, fp = range manifestsPaths {
+		if err := filepath.Walk(fp, walkFunc); err != nil {
+			return err
+		}
+	}
+
+	modelsPaths, err := modelsDirs()
+	if err != nil {
 		return err
 	}
 
-	// only delete the files which are still in the deleteMap
+	// only delete the files which are still in the deleteMap, from whichever
+	// models directories have them
 	for k := range deleteMap {
 		fp, err := GetBlobsPath(k)
 		if err != nil {
 			slog.Info(fmt.Sprintf("couldn't get file path for '%s': %v", k, err))
 			continue
 		}
-		if err := os.Remove(fp); err != nil {
-			slog.Info(fmt.Sprintf("couldn't remove file '%s': %v", fp, err))
-			continue
+
+		for i, dir := range modelsPaths {
+			if i > 0 {
+				fp = resolveBlobPath(filepath.Join(dir, "blobs"), filepath.Base(fp))
+			}
+
+			if err := os.Remove(fp); err != nil && !errors.Is(err, os.ErrNotExist) {
+				slog.Info(fmt.Sprintf("couldn't remove file '%s': %v", fp, err))
+			}
 		}
 	}
 
@@ -690,6 +712,11 @@ func PruneLayers() error {
 	}
 
 	for _, blob := range blobs {
+		if blob.IsDir() {
+			// e.g. quarantined blobs
+			continue
+		}
+
 		name := blob.Name()
 		name = strings.ReplaceAll(name, "-", ":")
 
@@ -708,6 +735,16 @@ func PruneLayers() error {
 		deleteMap[name] = struct{}{}
 	}
 
+	// include blobs in shard directories
+	digests, err := listBlobs()
+	if err != nil {
+		return err
+	}
+
+	for _, digest := range digests {
+		deleteMap[digest] = struct{}{}
+	}
+
 	slog.Info(fmt.Sprintf("total blobs: %d", len(deleteMap)))
 
 	err = deleteUnusedLayers(nil, deleteMap)
@@ -766,18 +803,16 @@ func DeleteModel(name string) error {
 	}
 	deleteMap[manifest.Config.Digest] = struct{}{}
 
-	err = deleteUnusedLayers(&mp, deleteMap)
-	if err != nil {
-		return err
+	// a Store other than the FileStore has no way to remove blobs, so they
+	// are kept there
+	if _, ok := activeStore().(FileStore); ok {
+		if err := deleteUnusedLayers(&mp, deleteMap); err != nil {
+			return err
+		}
 	}
 
-	fp, err := mp.GetManifestPath()
-	if err != nil {
-		return err
-	}
-	err = os.Remove(fp)
-	if err != nil {
-		slog.Info(fmt.Sprintf("couldn't remove manifest file '%s': %v", fp, err))
+	if err := activeStore().DeleteManifest(mp); err != nil {
+		slog.Info(fmt.Sprintf("couldn't remove manifest of %s: %v", mp.GetShortTagname(), err))
 		return err
 	}
 
@@ -810,8 +845,10 @@ func PushModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 	}
 
 	fn(api.ProgressResponse{Status: "pushing manifest"})
-	requestURL := mp.BaseURL()
-	requestURL = requestURL.JoinPath("v2", mp.GetNamespaceRepository(), "manifests", mp.Tag)
+	requestURL, err := mp.ManifestURL()
+	if err != nil {
+		return err
+	}
 
 	manifestJSON, err := json.Marshal(manifest)
 	if err != nil {
@@ -861,9 +898,9 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 
 	fn(api.ProgressResponse{Status: "pulling manifest"})
 
-	manifest, err = pullModelManifest(ctx, mp, regOpts)
+	manifest, manifestJSON, err := pullModelManifest(ctx, mp, regOpts)
 	if err != nil {
-		return fmt.Errorf("pull model manifest: %s", err)
+		return fmt.Errorf("pull model manifest: %w", err)
 	}
 
 	var layers []*Layer
@@ -905,22 +942,24 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 
 	fn(api.ProgressResponse{Status: "writing manifest"})
 
-	manifestJSON, err := json.Marshal(manifest)
-	if err != nil {
-		return err
+	var digests []string
+	for _, layer := range layers {
+		digests = append(digests, layer.Digest)
 	}
 
-	fp, err := mp.GetManifestPath()
-	if err != nil {
+	if err := storeBlobs(digests); err != nil {
 		return err
 	}
-	if err := os.MkdirAll(filepath.Dir(fp), 0o755); err != nil {
+
+	// the manifest is written as the registry served it, so a model pinned
+	// by digest hashes to that digest; an unchanged manifest is left alone
+	// so its mtime still tells when the model last changed
+	if _, err := mp.WriteManifestIfChanged(manifestJSON); err != nil {
+		slog.Info(fmt.Sprintf("couldn't write manifest of %s", mp.GetShortTagname()))
 		return err
 	}
 
-	err = os.WriteFile(fp, manifestJSON, 0o644)
-	if err != nil {
-		slog.Info(fmt.Sprintf("couldn't write to %s", fp))
+	if err := mp.RecordPulled(); err != nil {
 		return err
 	}
 
@@ -937,23 +976,40 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 	return nil
 }
 
-func pullModelManifest(ctx context.Context, mp ModelPath, regOpts *registryOptions) (*ManifestV2, error) {
-	requestURL := mp.BaseURL().JoinPath("v2", mp.GetNamespaceRepository(), "manifests", mp.Tag)
+// pullModelManifest fetches the model's manifest from its registry, returning
+// it both decoded and as the raw bytes which were verified against the
+// model's digest, if it's pinned to one.
+func pullModelManifest(ctx context.Context, mp ModelPath, regOpts *registryOptions) (*ManifestV2, []byte, error) {
+	requestURL, err := mp.ManifestURL()
+	if err != nil {
+		return nil, nil, err
+	}
 
 	headers := make(http.Header)
 	headers.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json")
 	resp, err := makeRequestWithRetry(ctx, http.MethodGet, requestURL, headers, nil, regOpts)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
 
+	bts, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if mp.Digest != "" {
+		if err := VerifyManifestDigest(bts, mp.Digest); err != nil {
+			return nil, nil, err
+		}
+	}
+
 	var m *ManifestV2
-	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
-		return nil, err
+	if err := json.Unmarshal(bts, &m); err != nil {
+		return nil, nil, err
 	}
 
-	return m, err
+	return m, bts, err
 }
 
 // GetSHA256Digest returns the SHA256 hash of a given buffer and returns it, and the size of buffer
@@ -1058,6 +1114,11 @@ func makeRequest(ctx context.Context, method string, requestURL *url.URL, header
 		requestURL.Scheme = "http"
 	}
 
+	// after --insecure, which doesn't override OLLAMA_REQUIRE_TLS
+	if err := requireTLS(requestURL.Scheme, requestURL.Host, false); err != nil {
+		return nil, err
+	}
+
 	req, err := http.NewRequestWithContext(ctx, method, requestURL.String(), body)
 	if err != nil {
 		return nil, err
@@ -1086,7 +1147,12 @@ func makeRequest(ctx context.Context, method string, requestURL *url.URL, header
 		req.ContentLength = contentLength
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	client, err := registryClient(requestURL)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -1094,6 +1160,34 @@ func makeRequest(ctx context.Context, method string, requestURL *url.URL, header
 	return resp, nil
 }
 
+// registryClients caches the HTTP clients of registries with a custom TLS
+// configuration by host.
+var registryClients sync.Map
+
+// registryClient returns the HTTP client to use for requests to the registry
+// at requestURL, which trusts the registry's private CA if it has one.
+func registryClient(requestURL *url.URL) (*http.Client, error) {
+	if requestURL.Scheme != "https" {
+		return http.DefaultClient, nil
+	}
+
+	if client, ok := registryClients.Load(requestURL.Host); ok {
+		return client.(*http.Client), nil
+	}
+
+	tlsConfig, err := ModelPath{Registry: requestURL.Host}.TLSConfig()
+	if err != nil {
+		return nil, err
+	} else if tlsConfig == nil {
+		return http.DefaultClient, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	client, _ := registryClients.LoadOrStore(requestURL.Host, &http.Client{Transport: transport})
+	return client.(*http.Client), nil
+}
+
 func getValue(header, key string) string {
 	startIdx := strings.Index(header, key+"=")
 	if startIdx == -1 {
@@ -1130,11 +1224,16 @@ func parseRegistryChallenge(authStr string) registryChallenge {
 var errDigestMismatch = errors.New("digest mismatch, file must be downloaded again")
 
 func verifyBlob(digest string) error {
-	fp, err := GetBlobsPath(digest)
+	fp, err := readBlobPath(digest)
 	if err != nil {
 		return err
 	}
 
+	return verifyBlobFile(fp, digest)
+}
+
+// verifyBlobFile checks that the file at fp hashes to digest.
+func verifyBlobFile(fp, digest string) error {
 	f, err := os.Open(fp)
 	if err != nil {
 		return err
@@ -1142,7 +1241,7 @@ func verifyBlob(digest string) error {
 	defer f.Close()
 
 	fileDigest, _ := GetSHA256Digest(f)
-	if digest != fileDigest {
+	if !DigestsEqual(digest, fileDigest) {
 		return fmt.Errorf("%w: want %s, got %s", errDigestMismatch, digest, fileDigest)
 	}
 
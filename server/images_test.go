@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/server/envconfig"
+)
+
+// writeTestBlob writes a blob with contents into the store and returns its
+// layer.
+func writeTestBlob(t *testing.T, contents string) *Layer {
+	t.Helper()
+
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(contents)))
+	if _, err := WriteBlob(digest, strings.NewReader(contents)); err != nil {
+		t.Fatal(err)
+	}
+
+	return &Layer{MediaType: "application/vnd.ollama.image.model", Digest: digest, Size: int64(len(contents))}
+}
+
+func TestPruneLayers(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	tagged := writeTestModel(t, "llama3", "config", "model")
+
+	// a repository at the root of its registry
+	root, err := ParseModelPathWithOptions("myregistry.com/model:v1", ParseOptions{RootRepositories: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootConfig, rootModel := writeTestBlob(t, "root config"), writeTestBlob(t, "root model")
+	manifest, err := json.Marshal(ManifestV2{SchemaVersion: 2, Config: rootConfig, Layers: []*Layer{rootModel}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := root.writeManifest(manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	// a model pinned by digest, stored under its digest-named manifest
+	pinnedLayer := writeTestBlob(t, "pinned model")
+	manifest, err = json.Marshal(ManifestV2{SchemaVersion: 2, Layers: []*Layer{pinnedLayer}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pinned := ParseModelPath(fmt.Sprintf("pinned@sha256:%x", sha256.Sum256(manifest)))
+	if err := pinned.writeManifest(manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	orphan := writeTestBlob(t, "orphan")
+
+	if err := PruneLayers(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, digest := range append(tagged, rootConfig.Digest, rootModel.Digest, pinnedLayer.Digest) {
+		p, err := GetBlobsPath(digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("referenced blob %s was pruned: %v", digest, err)
+		}
+	}
+
+	p, err := GetBlobsPath(orphan.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Errorf("expected the unreferenced blob to be pruned, got %v", err)
+	}
+}
+
+func TestRequireTLS(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	t.Cleanup(envconfig.LoadConfig)
+	t.Setenv("OLLAMA_REQUIRE_TLS", "1")
+	envconfig.LoadConfig()
+
+	srv := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(srv.Close)
+
+	// --insecure doesn't override OLLAMA_REQUIRE_TLS
+	regOpts := &registryOptions{Insecure: true}
+	fn := func(api.ProgressResponse) {}
+
+	for _, op := range []struct {
+		name string
+		f    func(name string) error
+	}{
+		{"pull", func(name string) error { return PullModel(context.Background(), name, regOpts, fn) }},
+		{"push", func(name string) error { return PushModel(context.Background(), name, regOpts, fn) }},
+	} {
+		t.Run(op.name, func(t *testing.T) {
+			// pushing needs the model locally before it contacts the registry
+			writeTestModel(t, "http://example.com/ns/model:latest", "config", "model")
+			writeTestModel(t, "http://"+srv.Listener.Addr().String()+"/ns/model:latest", "config", "model")
+
+			if err := op.f("http://example.com/ns/model:latest"); !errors.Is(err, ErrInsecureProtocol) {
+				t.Errorf("expected ErrInsecureProtocol, got %v", err)
+			}
+
+			// local registries are still reachable over http
+			if err := op.f("http://" + srv.Listener.Addr().String() + "/ns/model:latest"); errors.Is(err, ErrInsecureProtocol) {
+				t.Errorf("expected a local registry to be allowed, got %v", err)
+			}
+		})
+	}
+
+	// blob downloads and uploads make their requests the same way
+	u := &url.URL{Scheme: "https", Host: "example.com", Path: "/v2/ns/model/blobs/sha256:abc"}
+	if _, err := makeRequest(context.Background(), http.MethodGet, u, nil, nil, regOpts); !errors.Is(err, ErrInsecureProtocol) {
+		t.Errorf("expected ErrInsecureProtocol, got %v", err)
+	}
+}
+
+func TestPullModelPinnedDigest(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	config, layer := writeTestBlob(t, "config"), writeTestBlob(t, "model")
+
+	// indented, so re-encoding it would change its digest
+	manifest, err := json.MarshalIndent(ManifestV2{SchemaVersion: 2, Config: config, Layers: []*Layer{layer}}, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(manifest))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/ns/model/manifests/"+digest {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Write(manifest)
+	}))
+	t.Cleanup(srv.Close)
+
+	name := "http://" + srv.Listener.Addr().String() + "/ns/model@" + digest
+	if err := PullModel(context.Background(), name, &registryOptions{Insecure: true}, func(api.ProgressResponse) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ParseModelPath(name).LocalManifestDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != digest {
+		t.Errorf("stored manifest has digest %s, want the pinned %s", got, digest)
+	}
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// indexFile is the name of the optional index in a models directory listing
+// its manifests, so ListModelPaths needn't walk the manifests directory, which
+// is slow on network filesystems. Along with the manifests it records the
+// modification time of every directory under the manifests directory, so a
+// manifest added or removed by any means, which changes its directory's
+// modification time, makes the index stale. Writes through the store also
+// remove it outright, see writeManifestFile.
+const indexFile = "index.json"
+
+const indexVersion = 2
+
+// indexRacyWindow is how recently a directory may have been modified for its
+// modification time not to be trusted: on filesystems with coarse timestamps
+// a manifest added right after the index was written could leave it unchanged.
+// Such directories are recorded as always stale, like racily clean files in
+// git's index.
+const indexRacyWindow = 2 * time.Second
+
+type modelsIndex struct {
+	Version int `json:"version"`
+	// Manifests are the slash separated paths of the manifests relative to
+	// the manifests directory, before any ignore patterns are applied.
+	Manifests []string `json:"manifests"`
+	// Dirs maps the slash separated path of every directory under the
+	// manifests directory, "." for the directory itself, to its modification
+	// time in nanoseconds, or 0 if it was modified too recently to trust.
+	Dirs map[string]int64 `json:"dirs"`
+}
+
+// readIndex returns the manifests listed by the index of the models directory
+// dir. It reports false if there's no index, it can't be read or a directory
+// under the manifests directory changed since it was written.
+func readIndex(dir string) ([]string, bool) {
+	b, err := os.ReadFile(filepath.Join(dir, indexFile))
+	if err != nil {
+		return nil, false
+	}
+
+	var index modelsIndex
+	if err := json.Unmarshal(b, &index); err != nil || index.Version != indexVersion || index.Dirs["."] == 0 {
+		return nil, false
+	}
+
+	for _, rel := range index.Manifests {
+		if !filepath.IsLocal(filepath.FromSlash(rel)) {
+			return nil, false
+		}
+	}
+
+	manifests := filepath.Join(dir, "manifests")
+	for rel, mtime := range index.Dirs {
+		if !filepath.IsLocal(filepath.FromSlash(rel)) {
+			return nil, false
+		}
+
+		fi, err := os.Stat(filepath.Join(manifests, filepath.FromSlash(rel)))
+		if err != nil || !fi.IsDir() || mtime == 0 || fi.ModTime().UnixNano() != mtime {
+			return nil, false
+		}
+	}
+
+	return index.Manifests, true
+}
+
+// writeIndex replaces the index of the models directory dir with one listing
+// manifests as found in dirs.
+func writeIndex(dir string, manifests []string, dirs map[string]int64) error {
+	b, err := json.Marshal(modelsIndex{Version: indexVersion, Manifests: manifests, Dirs: dirs})
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(dir, indexFile), b)
+}
+
+// removeIndex removes the index of the models directory dir, if there is one.
+func removeIndex(dir string) error {
+	if err := os.Remove(filepath.Join(dir, indexFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// invalidateIndex removes the index of every models directory after a
+// manifest is written or deleted, so the next listing walks them again.
+func invalidateIndex() error {
+	dirs, err := modelsDirs()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, dir := range dirs {
+		errs = append(errs, removeIndex(dir))
+	}
+
+	return errors.Join(errs...)
+}
+
+// walkManifests returns the sorted, slash separated paths of the manifests in
+// the models directory dir relative to its manifests directory, along with
+// the modification times of the directories walked for the index.
+func walkManifests(dir string) ([]string, map[string]int64, error) {
+	manifests := filepath.Join(dir, "manifests")
+	if _, err := os.Stat(manifests); errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	}
+
+	racy := time.Now().Add(-indexRacyWindow)
+	rels := []string{}
+	dirs := make(map[string]int64)
+	if err := filepath.WalkDir(manifests, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(manifests, path)
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+
+			var mtime int64
+			if fi.ModTime().Before(racy) {
+				mtime = fi.ModTime().UnixNano()
+			}
+
+			dirs[filepath.ToSlash(rel)] = mtime
+			return nil
+		}
+
+		if _, ok := modelPathFromManifestPath(rel); ok {
+			rels = append(rels, filepath.ToSlash(rel))
+		}
+
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	slices.Sort(rels)
+	return rels, dirs, nil
+}
+
+// ignoredPath reports whether the slash separated manifest path rel, or any of
+// the directories it is in, matches any of patterns.
+func ignoredPath(patterns []string, rel string) bool {
+	for i := range rel {
+		if rel[i] == '/' && ignored(patterns, rel[:i]) {
+			return true
+		}
+	}
+
+	return ignored(patterns, rel)
+}
+
+// RebuildIndex regenerates the index of every models directory from its
+// manifests directory.
+func RebuildIndex() error {
+	dirs, err := modelsDirs()
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		rels, mtimes, err := walkManifests(dir)
+		if err != nil {
+			return err
+		}
+
+		if err := mkdirAll(dir); err != nil {
+			return err
+		}
+
+		if err := writeIndex(dir, rels, mtimes); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
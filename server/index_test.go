@@ -0,0 +1,284 @@
+package server
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/types/model"
+)
+
+func listNames(t *testing.T) []string {
+	t.Helper()
+
+	mps, err := ListModelPaths()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for _, mp := range mps {
+		names = append(names, mp.GetShortTagname())
+	}
+
+	return names
+}
+
+// ageManifests backdates every directory under the manifests directory of
+// the models directory dir, so an index written next isn't racy.
+func ageManifests(t *testing.T, dir string) {
+	t.Helper()
+
+	old := time.Now().Add(-time.Hour)
+	if err := filepath.WalkDir(filepath.Join(dir, "manifests"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+
+		return os.Chtimes(path, old, old)
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readIndexFile returns the index of the models directory dir without
+// checking whether it's stale.
+func readIndexFile(t *testing.T, dir string) modelsIndex {
+	t.Helper()
+
+	b, err := os.ReadFile(filepath.Join(dir, indexFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var index modelsIndex
+	if err := json.Unmarshal(b, &index); err != nil {
+		t.Fatal(err)
+	}
+
+	return index
+}
+
+func writeIndexFile(t *testing.T, dir string, index modelsIndex) {
+	t.Helper()
+
+	b, err := json.Marshal(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, indexFile), b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIndexHit(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", dir)
+
+	writeTestModel(t, "llama3", "config", "model")
+	if _, err := os.Stat(filepath.Join(dir, indexFile)); !os.IsNotExist(err) {
+		t.Fatalf("index exists before listing: %v", err)
+	}
+
+	ageManifests(t, dir)
+	if got := listNames(t); !slices.Equal(got, []string{"llama3:latest"}) {
+		t.Fatalf("got %v", got)
+	}
+
+	rels, ok := readIndex(dir)
+	if !ok || !slices.Equal(rels, []string{"registry.ollama.ai/library/llama3/latest"}) {
+		t.Fatalf("index %v, %v", rels, ok)
+	}
+
+	// a model only the index knows about is listed, showing the listing came
+	// from the index
+	index := readIndexFile(t, dir)
+	index.Manifests = append(index.Manifests, "registry.ollama.ai/library/ghost/latest")
+	writeIndexFile(t, dir, index)
+
+	if got := listNames(t); !slices.Equal(got, []string{"ghost:latest", "llama3:latest"}) {
+		t.Fatalf("got %v", got)
+	}
+
+	// writing a model through the store invalidates the index
+	writeTestModel(t, "phi3", "config", "model")
+	if _, err := os.Stat(filepath.Join(dir, indexFile)); !os.IsNotExist(err) {
+		t.Fatalf("index exists after writing a manifest: %v", err)
+	}
+
+	if got := listNames(t); !slices.Equal(got, []string{"llama3:latest", "phi3:latest"}) {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestIndexStale(t *testing.T) {
+	cases := map[string]func(t *testing.T, dir string){
+		"added manifest": func(t *testing.T, dir string) {
+			// behind the store's back, so the index isn't invalidated
+			p := filepath.Join(dir, "manifests", "registry.ollama.ai", "library", "mistral", "latest")
+			if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.WriteFile(p, []byte("{}"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		},
+		"added tag": func(t *testing.T, dir string) {
+			p := filepath.Join(dir, "manifests", "registry.ollama.ai", "library", "llama3", "8b")
+			if err := os.WriteFile(p, []byte("{}"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		},
+		"deleted manifest": func(t *testing.T, dir string) {
+			if err := os.Remove(filepath.Join(dir, "manifests", "registry.ollama.ai", "library", "phi3", "latest")); err != nil {
+				t.Fatal(err)
+			}
+		},
+		"corrupt": func(t *testing.T, dir string) {
+			if err := os.WriteFile(filepath.Join(dir, indexFile), []byte("{"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		},
+		"version": func(t *testing.T, dir string) {
+			index := readIndexFile(t, dir)
+			index.Version++
+			writeIndexFile(t, dir, index)
+		},
+		"outside manifests": func(t *testing.T, dir string) {
+			index := readIndexFile(t, dir)
+			index.Manifests = append(index.Manifests, "../index.json")
+			writeIndexFile(t, dir, index)
+		},
+		"racy": func(t *testing.T, dir string) {
+			index := readIndexFile(t, dir)
+			index.Dirs["registry.ollama.ai"] = 0
+			writeIndexFile(t, dir, index)
+		},
+	}
+
+	for name, stale := range cases {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv("OLLAMA_MODELS", dir)
+
+			writeTestModel(t, "llama3", "config", "model")
+			writeTestModel(t, "phi3", "config", "model")
+			ageManifests(t, dir)
+			listNames(t)
+
+			if _, ok := readIndex(dir); !ok {
+				t.Fatal("index wasn't written")
+			}
+
+			stale(t, dir)
+
+			if _, ok := readIndex(dir); ok {
+				t.Fatal("expected a stale index")
+			}
+
+			want, _, err := walkManifests(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			listNames(t)
+
+			// the walk rewrote the index, though as it's racy it'll be
+			// walked again next time
+			if got := readIndexFile(t, dir).Manifests; !slices.Equal(got, want) {
+				t.Fatalf("index %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestPreviewMatchesIndex(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", dir)
+
+	writeTestModel(t, "llama3", "config", "model")
+	ageManifests(t, dir)
+
+	mps, err := PreviewMatches("llama3:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mps) != 1 {
+		t.Fatalf("got %v", mps)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, indexFile)); !os.IsNotExist(err) {
+		t.Fatalf("PreviewMatches wrote the index: %v", err)
+	}
+}
+
+func TestCopyModelIndex(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", dir)
+
+	writeTestModel(t, "llama3", "config", "model")
+	ageManifests(t, dir)
+	listNames(t)
+
+	if err := CopyModel(model.ParseName("llama3"), model.ParseName("llama3:copy")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := listNames(t); !slices.Equal(got, []string{"llama3:copy", "llama3:latest"}) {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestRebuildIndex(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", dir)
+
+	writeTestModel(t, "llama3", "config", "model")
+	writeTestModel(t, "ghcr.io/org/team/model:v1", "config", "model")
+	listNames(t)
+
+	// a manifest copied in by hand is listed once the index is rebuilt
+	p := filepath.Join(dir, "manifests", "registry.ollama.ai", "library", "mistral", "latest")
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(p, []byte("{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ageManifests(t, dir)
+	if err := RebuildIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	rels, ok := readIndex(dir)
+	want := []string{
+		"ghcr.io/org/team/model/v1",
+		"registry.ollama.ai/library/llama3/latest",
+		"registry.ollama.ai/library/mistral/latest",
+	}
+	if !ok || !slices.Equal(rels, want) {
+		t.Fatalf("index %v, %v, want %v", rels, ok, want)
+	}
+
+	if got := listNames(t); !slices.Equal(got, []string{"ghcr.io/org/team/model:v1", "llama3:latest", "mistral:latest"}) {
+		t.Fatalf("got %v", got)
+	}
+
+	// ignore patterns still apply to models listed by the index
+	if err := os.WriteFile(filepath.Join(dir, ignoreFile), []byte("ghcr.io\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := listNames(t); !slices.Equal(got, []string{"llama3:latest", "mistral:latest"}) {
+		t.Fatalf("got %v", got)
+	}
+}
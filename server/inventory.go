@@ -0,0 +1,1323 @@
+package server
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/ollama/ollama/server/envconfig"
+)
+
+// ListModelPaths returns the model paths of every manifest in the active
+// store, sorted by their canonical String form so the order doesn't depend on
+// the filesystem. Models stored in several models directories are listed once.
+func ListModelPaths() ([]ModelPath, error) {
+	return activeStore().ListManifests()
+}
+
+// listModelPaths lists the manifests in the models directories, rewriting
+// stale indexes of the directories it walks if updateIndex is set.
+func listModelPaths(updateIndex bool) ([]ModelPath, error) {
+	dirs, err := modelsDirs()
+	if err != nil {
+		return nil, err
+	}
+
+	var mps []ModelPath
+	for _, dir := range dirs {
+		found, err := listModelPathsIn(dir, updateIndex)
+		if err != nil {
+			return nil, err
+		}
+
+		mps = append(mps, found...)
+	}
+
+	slices.SortFunc(mps, func(a, b ModelPath) int {
+		return strings.Compare(a.String(), b.String())
+	})
+
+	return slices.Compact(mps), nil
+}
+
+// listModelPathsIn returns the model paths of the manifests in the models
+// directory dir, read from its index if it has a valid one. Otherwise the
+// manifests directory is walked and, if updateIndex is set, the index
+// rewritten.
+func listModelPathsIn(dir string, updateIndex bool) ([]ModelPath, error) {
+	manifests := filepath.Join(dir, "manifests")
+	if _, err := os.Stat(manifests); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	ignore, err := readIgnorePatterns(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	rels, ok := readIndex(dir)
+	if !ok {
+		var mtimes map[string]int64
+		if rels, mtimes, err = walkManifests(dir); err != nil {
+			return nil, err
+		}
+
+		// the index is only a cache; a read-only models directory is walked
+		// every time
+		if updateIndex {
+			if err := writeIndex(dir, rels, mtimes); err != nil {
+				slog.Debug("couldn't write models index", "dir", dir, "error", err)
+			}
+		}
+	}
+
+	var mps []ModelPath
+	for _, rel := range rels {
+		if ignoredPath(ignore, rel) {
+			continue
+		}
+
+		if mp, ok := modelPathFromManifestPath(rel); ok {
+			mps = append(mps, mp)
+		}
+	}
+
+	return mps, nil
+}
+
+// MatchLocal returns the local models matching pattern, a model reference
+// whose components may contain path.Match wildcards, e.g. "llama3:*" for every
+// tag of llama3 or "jmorganca/*" for the latest tag of every model in the
+// jmorganca namespace. Omitted components match their defaults as in
+// ParseModelPath. The result is sorted like ListModelPaths.
+func MatchLocal(pattern string) ([]ModelPath, error) {
+	return matchLocal(pattern, true)
+}
+
+// matchLocal is MatchLocal, listing the models of a FileStore with
+// listModelPaths.
+func matchLocal(pattern string, updateIndex bool) ([]ModelPath, error) {
+	want := ParseModelPath(pattern)
+	if want.Repository == "" {
+		return nil, fmt.Errorf("%w: model repository name is required", errModelPathInvalid)
+	}
+
+	for _, p := range []string{want.Registry, want.Namespace, want.Repository, want.Tag} {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("%q: %w", pattern, err)
+		}
+	}
+
+	list := ListModelPaths
+	if _, ok := activeStore().(FileStore); ok {
+		list = func() ([]ModelPath, error) { return listModelPaths(updateIndex) }
+	}
+
+	mps, err := list()
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []ModelPath
+	for _, mp := range mps {
+		if matchComponent(strings.ToLower(want.Registry), strings.ToLower(mp.Registry)) &&
+			matchComponent(want.Namespace, mp.Namespace) &&
+			matchComponent(want.Repository, mp.Repository) &&
+			matchComponent(want.StorageTag(), mp.StorageTag()) {
+			matches = append(matches, mp)
+		}
+	}
+
+	return matches, nil
+}
+
+func matchComponent(pattern, name string) bool {
+	// errors are reported by MatchLocal
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// PreviewMatches returns the models a bulk operation on pattern would act on,
+// as matched by MatchLocal. It never modifies the store, so it can be shown to
+// the user for confirmation first.
+func PreviewMatches(pattern string) ([]ModelPath, error) {
+	// not even the models index is rewritten
+	return matchLocal(pattern, false)
+}
+
+// ignoreFile lists glob patterns, one per line, of paths relative to the
+// manifests directory which are excluded when enumerating models, e.g.
+// registry.ollama.ai/experiments to skip a whole namespace. Blank lines and
+// lines starting with # are ignored.
+const ignoreFile = ".ollamaignore"
+
+// readIgnorePatterns returns the patterns in the ignore file of the models
+// directory dir, if there is one.
+func readIgnorePatterns(dir string) ([]string, error) {
+	b, err := os.ReadFile(filepath.Join(dir, ignoreFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var patterns []string
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if _, err := path.Match(line, ""); err != nil {
+			return nil, fmt.Errorf("%s: %q: %w", ignoreFile, line, err)
+		}
+
+		patterns = append(patterns, strings.Trim(line, "/"))
+	}
+
+	return patterns, nil
+}
+
+// ignored reports whether the slash separated path rel matches any of
+// patterns.
+func ignored(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		// errors are reported by readIgnorePatterns
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// modelPathFromManifestPath converts a manifest path relative to the manifests
+// directory, e.g. registry/namespace/repository/tag, into a ModelPath.
+func modelPathFromManifestPath(rel string) (ModelPath, bool) {
+	dir, tag := filepath.Split(filepath.ToSlash(rel))
+	dir = strings.Trim(dir, "/")
+	if strings.Count(dir, "/") < 1 || strings.HasPrefix(tag, ".") || isDigestManifestName(tag) {
+		// too shallow to be a manifest, a temporary file or a digest-named
+		// copy of a tagged manifest
+		return ModelPath{}, false
+	}
+
+	// manifests of repositories at the root of a registry sit one level
+	// higher, directly in the registry's directory
+	// whatever tags were stored are listed, whichever options they were
+	// parsed with
+	mp, err := ParseModelPathWithOptions(dir+":"+tag, ParseOptions{RootRepositories: true, AllowPlusInTags: true})
+	if err != nil {
+		return ModelPath{}, false
+	}
+
+	if strings.Count(dir, "/") == 1 {
+		// the default registry has no root repositories, and a namespace
+		// configured for the registry doesn't apply to what's on disk
+		if strings.EqualFold(mp.aliasedRegistry(), DefaultRegistry) {
+			return ModelPath{}, false
+		}
+
+		mp.Namespace = ""
+	}
+
+	// a '+' in the tag was allowed when the model was stored
+	if mp.ValidateWithOptions(ParseOptions{AllowPlusInTags: true}) != nil {
+		return ModelPath{}, false
+	}
+
+	return mp, true
+}
+
+// LocalRegistries returns the sorted, distinct registry hosts of the local
+// models.
+func LocalRegistries() ([]string, error) {
+	mps, err := ListModelPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	var registries []string
+	for _, mp := range mps {
+		registries = append(registries, mp.Registry)
+	}
+
+	slices.Sort(registries)
+	return slices.Compact(registries), nil
+}
+
+// ListModelsByLastUsed returns the local models ordered from most to least
+// recently used, based on the access time of their manifests.
+func ListModelsByLastUsed() ([]ModelPath, error) {
+	mps, err := ListModelPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	used := make(map[ModelPath]time.Time, len(mps))
+	for _, mp := range mps {
+		p, err := mp.manifestReadPath()
+		if err != nil {
+			return nil, err
+		}
+
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+
+		used[mp] = lastUsed(fi)
+	}
+
+	slices.SortStableFunc(mps, func(a, b ModelPath) int {
+		return used[b].Compare(used[a])
+	})
+
+	return mps, nil
+}
+
+// lastUsed returns the access time of fi, falling back to the modification
+// time on filesystems that don't keep access times up to date (e.g. noatime).
+func lastUsed(fi os.FileInfo) time.Time {
+	if atime := accessTime(fi); atime.After(fi.ModTime()) {
+		return atime
+	}
+
+	return fi.ModTime()
+}
+
+// ReferencedBlobs returns the digests of the config and layers referenced by
+// the model's manifest.
+func (mp ModelPath) ReferencedBlobs() ([]string, error) {
+	manifest, _, err := GetManifest(mp)
+	if err != nil {
+		return nil, err
+	}
+
+	var digests []string
+	if manifest.Config != nil {
+		digests = append(digests, manifest.Config.Digest)
+	}
+
+	for _, layer := range manifest.Layers {
+		digests = append(digests, layer.Digest)
+	}
+
+	return digests, nil
+}
+
+// AllRepositoryBlobs returns the sorted digests of every blob referenced by
+// any local tag of the model's repository, e.g. to prefetch a whole
+// repository into a cache.
+func (mp ModelPath) AllRepositoryBlobs() ([]string, error) {
+	tags, err := mp.ListTags()
+	if err != nil {
+		return nil, err
+	}
+
+	var digests []string
+	for _, tag := range tags {
+		mp.Tag = tag
+		mp.Digest = ""
+		referenced, err := mp.ReferencedBlobs()
+		if err != nil {
+			return nil, err
+		}
+
+		digests = append(digests, referenced...)
+	}
+
+	slices.Sort(digests)
+	return slices.Compact(digests), nil
+}
+
+// UniqueBytes returns the total size of the blobs referenced by the local
+// models refs, counting blobs shared between them once, e.g. to project the
+// storage needed by a bundle of models. Sizes are taken from the manifests.
+func UniqueBytes(refs []ModelPath) (int64, error) {
+	sizes := make(map[string]int64)
+	for _, mp := range refs {
+		manifest, _, err := GetManifest(mp)
+		if err != nil {
+			return 0, err
+		}
+
+		layers := manifest.Layers
+		if manifest.Config != nil {
+			layers = append(layers, manifest.Config)
+		}
+
+		for _, layer := range layers {
+			if layer != nil {
+				sizes[canonicalDigest(layer.Digest)] = layer.Size
+			}
+		}
+	}
+
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+
+	return total, nil
+}
+
+// FindBrokenModels returns the local models which can't be loaded because
+// their manifest is unreadable or references blobs which are missing from the
+// store.
+func FindBrokenModels() ([]ModelPath, error) {
+	mps, err := ListModelPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	var broken []ModelPath
+	for _, mp := range mps {
+		ok, err := blobsPresent(mp)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			broken = append(broken, mp)
+		}
+	}
+
+	return broken, nil
+}
+
+// blobsPresent reports whether every blob referenced by mp exists.
+func blobsPresent(mp ModelPath) (bool, error) {
+	digests, err := mp.ReferencedBlobs()
+	if err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	for _, digest := range digests {
+		blob, err := readBlobPath(digest)
+		if errors.Is(err, ErrInvalidDigestFormat) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		if _, err := os.Stat(blob); errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// ListTags returns the sorted tags available locally for the model's
+// repository.
+func (mp ModelPath) ListTags() ([]string, error) {
+	p, err := mp.GetManifestPath()
+	if err != nil {
+		return nil, err
+	}
+
+	dirs, err := modelsDirs()
+	if err != nil {
+		return nil, err
+	}
+
+	rel, err := filepath.Rel(dirs[0], filepath.Dir(p))
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []string
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(filepath.Join(dir, rel))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			// dot files are temporary files of in-progress writes
+			if !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") && !isDigestManifestName(entry.Name()) {
+				tags = append(tags, entry.Name())
+			}
+		}
+	}
+
+	slices.Sort(tags)
+	tags = slices.Compact(tags)
+	return tags, nil
+}
+
+// PlanSync compares desired against the local store and returns the models
+// which must be pulled and removed for the store to hold exactly the desired
+// models. A desired model pinned to a digest must be pulled again if its local
+// manifest doesn't match the digest. toPull keeps the order of desired and
+// toRemove the order of ListModelPaths.
+func PlanSync(desired []ModelPath) (toPull, toRemove []ModelPath, err error) {
+	local, err := ListModelPaths()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	present := make(map[string]bool, len(local))
+	for _, mp := range local {
+		present[mp.CacheKey()] = true
+	}
+
+	wanted := make(map[string]bool, len(desired))
+	for _, mp := range desired {
+		if err := mp.Validate(); err != nil {
+			return nil, nil, err
+		}
+
+		untagged := mp
+		untagged.Digest = ""
+		key := untagged.CacheKey()
+		if wanted[key] {
+			continue
+		}
+
+		wanted[key] = true
+		if !present[key] {
+			toPull = append(toPull, mp)
+			continue
+		}
+
+		if _, err := mp.resolvedManifestDigest(); errors.Is(err, os.ErrNotExist) {
+			toPull = append(toPull, mp)
+		} else if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, mp := range local {
+		if !wanted[mp.CacheKey()] {
+			toRemove = append(toRemove, mp)
+		}
+	}
+
+	return toPull, toRemove, nil
+}
+
+// ListTagsPaged returns up to limit of the tags ListTags returns, starting
+// after the tag after, along with the cursor to pass as after to fetch the
+// next page. next is empty once the last page has been returned. A limit of
+// zero or less returns every remaining tag.
+func (mp ModelPath) ListTagsPaged(limit int, after string) (tags []string, next string, err error) {
+	tags, err = mp.ListTags()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if after != "" {
+		i, found := slices.BinarySearch(tags, after)
+		if found {
+			i++
+		}
+
+		tags = tags[i:]
+	}
+
+	if limit > 0 && len(tags) > limit {
+		tags = tags[:limit]
+		next = tags[limit-1]
+	}
+
+	return tags, next, nil
+}
+
+var errNoSemverTags = errors.New("no semantic version tags")
+
+// LatestSemverTag returns the model path of the local tag of mp's repository
+// with the highest semantic version, e.g. v1.10 over v1.2. Tags which aren't
+// versions, such as latest, are ignored.
+func (mp ModelPath) LatestSemverTag() (ModelPath, error) {
+	tags, err := mp.ListTags()
+	if err != nil {
+		return ModelPath{}, err
+	}
+
+	var best string
+	var bestVersion semver
+	for _, tag := range tags {
+		v, ok := parseSemver(tag)
+		if !ok {
+			continue
+		}
+
+		if best == "" || v.compare(bestVersion) > 0 || (v.compare(bestVersion) == 0 && tag > best) {
+			best, bestVersion = tag, v
+		}
+	}
+
+	if best == "" {
+		return ModelPath{}, fmt.Errorf("%w: %s", errNoSemverTags, mp.GetShortTagname())
+	}
+
+	mp.Tag = best
+	mp.Digest = ""
+	return mp, nil
+}
+
+// semver is a version of the form [v]major[.minor[.patch]][-prerelease]. A
+// bare number without the v prefix, e.g. 13, isn't considered a version.
+type semver struct {
+	parts      [3]int
+	prerelease string
+}
+
+func parseSemver(s string) (semver, bool) {
+	prefixed := strings.HasPrefix(s, "v") || strings.HasPrefix(s, "V")
+	if prefixed {
+		s = s[1:]
+	}
+
+	s, prerelease, _ := strings.Cut(s, "-")
+	fields := strings.Split(s, ".")
+	if len(fields) > 3 || (len(fields) == 1 && !prefixed) {
+		return semver{}, false
+	}
+
+	v := semver{prerelease: prerelease}
+	for i, field := range fields {
+		if field == "" || strings.Trim(field, "0123456789") != "" {
+			return semver{}, false
+		}
+
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return semver{}, false
+		}
+
+		v.parts[i] = n
+	}
+
+	return v, true
+}
+
+// compare returns -1, 0 or 1 as v is lower than, equal to or higher than
+// other. A prerelease is lower than the release it precedes.
+func (v semver) compare(other semver) int {
+	for i := range v.parts {
+		if c := cmp.Compare(v.parts[i], other.parts[i]); c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case v.prerelease == other.prerelease:
+		return 0
+	case v.prerelease == "":
+		return 1
+	case other.prerelease == "":
+		return -1
+	}
+
+	return strings.Compare(v.prerelease, other.prerelease)
+}
+
+// LocalTagPaths returns a model path for each tag available locally for the
+// model's repository.
+func (mp ModelPath) LocalTagPaths() ([]ModelPath, error) {
+	tags, err := mp.ListTags()
+	if err != nil {
+		return nil, err
+	}
+
+	mps := make([]ModelPath, len(tags))
+	for i, tag := range tags {
+		mps[i] = mp
+		mps[i].Tag = tag
+		mps[i].Digest = ""
+	}
+
+	return mps, nil
+}
+
+// ResolveLocalTag resolves a reference using the default tag to the only tag
+// available locally when no manifest exists for the default tag. References
+// with an explicit tag are returned unchanged. It returns ErrAmbiguousTag if
+// the repository has several tags and none of them is the default.
+func (mp ModelPath) ResolveLocalTag() (ModelPath, error) {
+	if mp.Tag != DefaultTag {
+		return mp, nil
+	}
+
+	p, err := mp.manifestReadPath()
+	if err != nil {
+		return ModelPath{}, err
+	}
+
+	if _, err := os.Stat(p); err == nil {
+		return mp, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return ModelPath{}, err
+	}
+
+	tags, err := mp.ListTags()
+	if err != nil {
+		return ModelPath{}, err
+	}
+
+	switch len(tags) {
+	case 0:
+		return ModelPath{}, fmt.Errorf("%s: %w", mp.GetShortTagname(), os.ErrNotExist)
+	case 1:
+		mp.Tag = tags[0]
+		return mp, nil
+	default:
+		return ModelPath{}, fmt.Errorf("%w: %s has tags %s", ErrAmbiguousTag, mp.GetShortTagname(), strings.Join(tags, ", "))
+	}
+}
+
+// ModelsReferencingBlob returns every local model whose manifest references
+// the blob with the given digest. Manifests which can't be read are skipped.
+func ModelsReferencingBlob(digest string) ([]ModelPath, error) {
+	if !blobDigestRegEx.MatchString(digest) {
+		return nil, ErrInvalidDigestFormat
+	}
+
+	mps, err := ListModelPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	var referencing []ModelPath
+	for _, mp := range mps {
+		digests, err := mp.ReferencedBlobs()
+		if err != nil {
+			continue
+		}
+
+		if slices.ContainsFunc(digests, func(d string) bool { return DigestsEqual(d, digest) }) {
+			referencing = append(referencing, mp)
+		}
+	}
+
+	return referencing, nil
+}
+
+// BlobUsage describes a blob in the store and how many local models use it.
+type BlobUsage struct {
+	Digest   string
+	Size     int64
+	RefCount int
+}
+
+// BlobUsageReport returns every blob in the store along with the number of
+// local manifests referencing it, largest blobs first.
+func BlobUsageReport() ([]BlobUsage, error) {
+	digests, err := listBlobs()
+	if err != nil {
+		return nil, err
+	}
+
+	refs, err := blobRefCounts()
+	if err != nil {
+		return nil, err
+	}
+
+	usage := make([]BlobUsage, 0, len(digests))
+	for _, digest := range digests {
+		blob, err := GetBlobsPath(digest)
+		if err != nil {
+			return nil, err
+		}
+
+		fi, err := os.Stat(blob)
+		if err != nil {
+			return nil, err
+		}
+
+		usage = append(usage, BlobUsage{Digest: digest, Size: fi.Size(), RefCount: refs[canonicalDigest(digest)]})
+	}
+
+	slices.SortFunc(usage, func(a, b BlobUsage) int {
+		if a.Size != b.Size {
+			return cmp.Compare(b.Size, a.Size)
+		}
+
+		return strings.Compare(a.Digest, b.Digest)
+	})
+
+	return usage, nil
+}
+
+// ModelFamilies groups the local models by the canonical digest of their
+// config blob, since models derived from the same base, e.g. by changing the
+// system prompt, share it. Models without a config are grouped by their first
+// layer instead, and manifests which can't be read are skipped. The models of
+// each family are in the order of ListModelPaths.
+func ModelFamilies() (map[string][]ModelPath, error) {
+	mps, err := ListModelPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	families := make(map[string][]ModelPath)
+	for _, mp := range mps {
+		manifest, _, err := GetManifest(mp)
+		if err != nil {
+			continue
+		}
+
+		var base string
+		switch {
+		case manifest.Config != nil:
+			base = manifest.Config.Digest
+		case len(manifest.Layers) > 0 && manifest.Layers[0] != nil:
+			base = manifest.Layers[0].Digest
+		default:
+			continue
+		}
+
+		base = canonicalDigest(base)
+		families[base] = append(families[base], mp)
+	}
+
+	return families, nil
+}
+
+// blobRefCounts returns the number of local manifests referencing each blob,
+// keyed by canonical digest. Every manifest in every models directory counts,
+// including ignored ones, ones shadowed by another models directory and the
+// digest-named manifests of models pinned by digest, since their blobs are
+// still needed. Manifests which can't be read are skipped.
+func blobRefCounts() (map[string]int, error) {
+	manifestsPaths, err := manifestsDirs()
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make(map[string]int)
+	for _, manifests := range manifestsPaths {
+		var paths []string
+		if err := filepath.WalkDir(manifests, func(path string, d fs.DirEntry, err error) error {
+			if errors.Is(err, fs.ErrNotExist) && path == manifests {
+				return fs.SkipDir
+			} else if err != nil {
+				return err
+			}
+
+			if d.IsDir() {
+				return nil
+			}
+
+			rel, err := filepath.Rel(manifests, path)
+			if err != nil {
+				return err
+			}
+
+			if _, ok := modelPathFromManifestPath(rel); ok || isDigestManifestName(d.Name()) {
+				paths = append(paths, path)
+			}
+
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+
+		for _, p := range paths {
+			b, err := os.ReadFile(p)
+			if err != nil {
+				continue
+			}
+
+			var manifest ManifestV2
+			if err := json.Unmarshal(b, &manifest); err != nil {
+				continue
+			}
+
+			layers := manifest.Layers
+			if manifest.Config != nil {
+				layers = append(layers, manifest.Config)
+			}
+
+			seen := make(map[string]bool)
+			for _, layer := range layers {
+				if layer == nil {
+					continue
+				}
+
+				digest := canonicalDigest(layer.Digest)
+				if !seen[digest] {
+					seen[digest] = true
+					refs[digest]++
+				}
+			}
+		}
+	}
+
+	return refs, nil
+}
+
+// InventoryEntry describes a local model in the output of
+// ExportInventoryJSON. The JSON field names are part of the export format and
+// must not change.
+type InventoryEntry struct {
+	// Reference is the fully qualified name of the model, e.g.
+	// registry.ollama.ai/library/llama3:latest.
+	Reference string `json:"reference"`
+	// ManifestDigest is the sha256:<hex> digest of the local manifest.
+	ManifestDigest string `json:"manifest_digest"`
+	// Size is the total size in bytes of the config and layers.
+	Size int64 `json:"size"`
+	// Blobs are the digests of the config and layers, config first.
+	Blobs []string `json:"blobs"`
+}
+
+// ExportInventoryJSON writes a JSON array with an InventoryEntry for every
+// local model to w. Models whose manifest can't be read are omitted.
+func ExportInventoryJSON(w io.Writer) error {
+	mps, err := ListModelPaths()
+	if err != nil {
+		return err
+	}
+
+	entries := make([]InventoryEntry, 0, len(mps))
+	for _, mp := range mps {
+		manifest, digest, err := GetManifest(mp)
+		if err != nil {
+			continue
+		}
+
+		entry := InventoryEntry{
+			Reference:      mp.GetFullTagname(),
+			ManifestDigest: "sha256:" + digest,
+			Blobs:          []string{},
+		}
+
+		for _, layer := range append([]*Layer{manifest.Config}, manifest.Layers...) {
+			if layer != nil {
+				entry.Size += layer.Size
+				entry.Blobs = append(entry.Blobs, layer.Digest)
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return json.NewEncoder(w).Encode(entries)
+}
+
+// ListModelsWithDigests maps the full reference of every local model, as in
+// ExportInventoryJSON, to the sha256:<hex> digest of its manifest, e.g. for
+// diffing the models of two machines. Models whose manifest can't be read are
+// omitted.
+func ListModelsWithDigests() (map[string]string, error) {
+	mps, err := ListModelPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	digests := make(map[string]string, len(mps))
+	for _, mp := range mps {
+		digest, err := mp.LocalManifestDigest()
+		if err != nil {
+			continue
+		}
+
+		digests[mp.GetFullTagname()] = digest
+	}
+
+	return digests, nil
+}
+
+// MoveTo moves the model into the models directory destRoot, e.g. to balance
+// large models across disks. Its manifest and the blobs only it references are
+// moved, while blobs shared with other models are copied since those models
+// still need them. Every blob is verified against its digest as it is copied,
+// and nothing is removed until the model is complete in destRoot.
+func (mp ModelPath) MoveTo(destRoot string) error {
+	if err := mp.Validate(); err != nil {
+		return err
+	}
+
+	src, err := mp.manifestReadPath()
+	if err != nil {
+		return err
+	}
+
+	manifest, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	p, err := mp.GetManifestPath()
+	if err != nil {
+		return err
+	}
+
+	dir, err := modelsDir()
+	if err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(dir, p)
+	if err != nil {
+		return err
+	}
+
+	dst := filepath.Join(destRoot, rel)
+	if sameFile(src, dst) {
+		return nil
+	}
+
+	digests, err := mp.ReferencedBlobs()
+	if err != nil {
+		return err
+	}
+
+	slices.Sort(digests)
+	digests = slices.Compact(digests)
+
+	refs, err := blobRefCounts()
+	if err != nil {
+		return err
+	}
+
+	var unique []string
+	for _, digest := range digests {
+		from, err := readBlobPath(digest)
+		if err != nil {
+			return err
+		}
+
+		to := resolveBlobPath(filepath.Join(destRoot, "blobs"), strings.Replace(canonicalDigest(digest), ":", "-", 1))
+		if err := copyBlobFile(from, to, digest); err != nil {
+			return fmt.Errorf("blob %s: %w", digest, err)
+		}
+
+		// blobs read from a cache directory aren't part of the store
+		if _, ok := IsStoreBlobPath(from); ok && refs[canonicalDigest(digest)] <= 1 && !sameFile(from, to) {
+			unique = append(unique, from)
+		}
+	}
+
+	if err := writeManifestFile(dst, manifest); err != nil {
+		return err
+	}
+
+	if pulledAt, err := os.ReadFile(pulledAtPath(src)); err == nil {
+		if err := writeFileAtomic(pulledAtPath(dst), pulledAt); err != nil {
+			return err
+		}
+	}
+
+	if err := removeManifestFile(src); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	// destRoot needn't be one of the models directories
+	if err := removeIndex(destRoot); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, blob := range unique {
+		if err := os.Remove(blob); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// sameFile reports whether a and b are the same path once made absolute.
+func sameFile(a, b string) bool {
+	a, errA := filepath.Abs(a)
+	b, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && a == b
+}
+
+var errManifestExists = errors.New("manifest already exists")
+
+// RewriteRegistry relabels every local model stored under the registry from as
+// a model of the registry to, e.g. when moving from the public registry to a
+// mirror. Only manifests are moved, into the first models directory like any
+// other write; blobs are shared and left in place. It fails without moving
+// anything if a model already exists under to.
+func RewriteRegistry(from, to string) (rewritten []ModelPath, err error) {
+	if !validRegistryHost(to) {
+		return nil, fmt.Errorf("%w: invalid registry host %q", errModelPathInvalid, to)
+	}
+
+	if canonical, ok := registryAliases[strings.ToLower(from)]; ok {
+		from = canonical
+	}
+
+	mps, err := ListModelPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	type move struct {
+		src, dst string
+		mp       ModelPath
+	}
+
+	manifests, err := GetManifestPath()
+	if err != nil {
+		return nil, err
+	}
+
+	dirs, err := manifestsDirs()
+	if err != nil {
+		return nil, err
+	}
+
+	var moves []move
+	oldDirs := make(map[string]bool)
+	for _, mp := range mps {
+		if !strings.EqualFold(mp.Registry, from) {
+			continue
+		}
+
+		// the model may be in any of the models directories but is always
+		// rewritten into the first, like any other manifest write
+		src, err := mp.manifestReadPath()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, dir := range dirs {
+			if rel, err := filepath.Rel(dir, src); err == nil && filepath.IsLocal(rel) {
+				oldDirs[filepath.Join(dir, strings.Split(rel, string(filepath.Separator))[0])] = true
+				break
+			}
+		}
+
+		mp.Registry = to
+		dst, err := mp.GetManifestPath()
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := os.Stat(dst); err == nil {
+			return nil, fmt.Errorf("%w: %s", errManifestExists, mp.GetShortTagname())
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+
+		moves = append(moves, move{src, dst, mp})
+	}
+
+	for _, m := range moves {
+		relocate := moveManifestFile
+		if rel, err := filepath.Rel(manifests, m.src); err != nil || !filepath.IsLocal(rel) {
+			relocate = func(src, dst string) error {
+				if err := copyManifestFile(src, dst); err != nil {
+					return err
+				}
+
+				return removeManifestFile(src)
+			}
+		}
+
+		if err := relocate(m.src, m.dst); err != nil {
+			return rewritten, err
+		}
+
+		rewritten = append(rewritten, m.mp)
+	}
+
+	// remove the now empty directories of the old registry
+	for dir := range oldDirs {
+		if err := PruneDirectory(dir); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return rewritten, err
+		}
+	}
+
+	return rewritten, nil
+}
+
+// FindDuplicateManifests groups the local models by manifest digest and
+// returns the groups spanning more than one registry, e.g. copies left behind
+// under the old registry by an interrupted migration. Tags of a single
+// registry sharing a manifest, such as latest and 8b, are intentional and
+// aren't reported. Manifests which can't be read are skipped.
+func FindDuplicateManifests() (map[string][]ModelPath, error) {
+	mps, err := ListModelPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string][]ModelPath)
+	for _, mp := range mps {
+		digest, err := mp.LocalManifestDigest()
+		if err != nil {
+			continue
+		}
+
+		groups[digest] = append(groups[digest], mp)
+	}
+
+	for digest, group := range groups {
+		if !slices.ContainsFunc(group, func(mp ModelPath) bool {
+			return mp.canonicalRegistry() != group[0].canonicalRegistry()
+		}) {
+			delete(groups, digest)
+		}
+	}
+
+	return groups, nil
+}
+
+// validRegistryHost reports whether host is usable as the registry of a model
+// path, i.e. a bare host with an optional port.
+func validRegistryHost(host string) bool {
+	if host == "" || strings.ContainsFunc(host, unicode.IsControl) {
+		return false
+	}
+
+	u, err := url.Parse("//" + host)
+	return err == nil && u.Host == host && u.Path == ""
+}
+
+// FindOrphanManifests returns the paths of the digest-named manifests, see
+// GetManifestPathByDigest, which none of the tags in their repository
+// currently point at, so they can be garbage collected. Digest-named
+// manifests of models pulled by digest, which have a pull record, are models
+// in their own right and never orphans.
+func FindOrphanManifests() ([]string, error) {
+	manifestsPaths, err := manifestsDirs()
+	if err != nil {
+		return nil, err
+	}
+
+	// digests of tagged manifests and digest-named files, by repository
+	// directory relative to the manifests directory
+	tagged := make(map[string]map[string]bool)
+	named := make(map[string][]string)
+	for _, manifests := range manifestsPaths {
+		if err := filepath.WalkDir(manifests, func(path string, d fs.DirEntry, err error) error {
+			if errors.Is(err, fs.ErrNotExist) && path == manifests {
+				return fs.SkipDir
+			} else if err != nil {
+				return err
+			}
+
+			if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+				return nil
+			}
+
+			rel, err := filepath.Rel(manifests, filepath.Dir(path))
+			if err != nil {
+				return err
+			}
+
+			if isDigestManifestName(d.Name()) {
+				if _, err := os.Stat(pulledAtPath(path)); errors.Is(err, os.ErrNotExist) {
+					named[rel] = append(named[rel], path)
+				} else if err != nil {
+					return err
+				}
+
+				return nil
+			}
+
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+
+			if tagged[rel] == nil {
+				tagged[rel] = make(map[string]bool)
+			}
+
+			tagged[rel][fmt.Sprintf("sha256-%x", sha256.Sum256(b))] = true
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	var orphans []string
+	for rel, paths := range named {
+		for _, p := range paths {
+			if !tagged[rel][strings.ToLower(filepath.Base(p))] {
+				orphans = append(orphans, p)
+			}
+		}
+	}
+
+	slices.Sort(orphans)
+	return orphans, nil
+}
+
+// CheckStorePermissions walks the blobs and manifests directories of every
+// models directory and returns a description of each problem found: files and
+// directories the current user can't read, and permissions broader than
+// OLLAMA_FILE_MODE and OLLAMA_DIR_MODE. Permission bits aren't checked on
+// Windows, which doesn't use them.
+func CheckStorePermissions() ([]string, error) {
+	dirs, err := modelsDirs()
+	if err != nil {
+		return nil, err
+	}
+
+	var issues []string
+	for _, dir := range dirs {
+		for _, root := range []string{filepath.Join(dir, "blobs"), filepath.Join(dir, "manifests")} {
+			if err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+				if errors.Is(err, fs.ErrNotExist) && path == root {
+					return fs.SkipDir
+				} else if err != nil {
+					// WalkDir reports unreadable directories after visiting them
+					issues = append(issues, fmt.Sprintf("%s: not readable: %v", path, err))
+					return nil
+				}
+
+				fi, err := d.Info()
+				if err != nil {
+					issues = append(issues, fmt.Sprintf("%s: %v", path, err))
+					return nil
+				}
+
+				want := cmp.Or(envconfig.FileMode, defaultFileMode)
+				if d.IsDir() {
+					want = cmp.Or(envconfig.DirMode, defaultDirMode)
+				} else if f, err := os.Open(path); err != nil {
+					issues = append(issues, fmt.Sprintf("%s: not readable: %v", path, err))
+				} else {
+					f.Close()
+				}
+
+				if runtime.GOOS != "windows" {
+					if extra := fi.Mode().Perm() &^ want; extra != 0 {
+						issues = append(issues, fmt.Sprintf("%s: mode %#o is broader than the expected %#o", path, fi.Mode().Perm(), want))
+					}
+				}
+
+				return nil
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return issues, nil
+}
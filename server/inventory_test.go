@@ -0,0 +1,1299 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/types/model"
+)
+
+// writeTestModel writes a manifest for name into the store, creating a blob
+// for each of contents. The first content is used as the config layer.
+func writeTestModel(t *testing.T, name string, contents ...string) []string {
+	t.Helper()
+
+	var layers []*Layer
+	var digests []string
+	for _, c := range contents {
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(c)))
+		if _, err := WriteBlob(digest, strings.NewReader(c)); err != nil {
+			t.Fatal(err)
+		}
+
+		layers = append(layers, &Layer{MediaType: "application/vnd.ollama.image.model", Digest: digest, Size: int64(len(c))})
+		digests = append(digests, digest)
+	}
+
+	if err := WriteManifest(name, layers[0], layers[1:]); err != nil {
+		t.Fatal(err)
+	}
+
+	return digests
+}
+
+func TestListModelPaths(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	writeTestModel(t, "llama3", "config", "model")
+	writeTestModel(t, "ghcr.io/org/team/model:v1", "config", "model")
+
+	mps, err := ListModelPaths()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]bool)
+	for _, mp := range mps {
+		got[mp.GetFullTagname()] = true
+	}
+
+	for _, want := range []string{"registry.ollama.ai/library/llama3:latest", "ghcr.io/org/team/model:v1"} {
+		if !got[want] {
+			t.Errorf("expected %s in %v", want, mps)
+		}
+	}
+
+	if len(mps) != 2 {
+		t.Errorf("got %d models, want 2", len(mps))
+	}
+}
+
+func TestLocalRegistries(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	if registries, err := LocalRegistries(); err != nil {
+		t.Fatal(err)
+	} else if len(registries) > 0 {
+		t.Errorf("expected no registries, got %v", registries)
+	}
+
+	writeTestModel(t, "llama3", "config", "model")
+	writeTestModel(t, "jmorganca/mistral", "config", "model")
+	writeTestModel(t, "ghcr.io/org/team/model:v1", "config", "model")
+	writeTestModel(t, "ghcr.io/org/other", "config", "model")
+
+	registries, err := LocalRegistries()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"ghcr.io", DefaultRegistry}; !slices.Equal(registries, want) {
+		t.Errorf("got %v, want %v", registries, want)
+	}
+}
+
+func TestListModelsByLastUsed(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	now := time.Now()
+	for _, m := range []struct {
+		name string
+		age  time.Duration
+	}{
+		{"oldest", 3 * time.Hour},
+		{"newest", time.Hour},
+		{"middle", 2 * time.Hour},
+	} {
+		writeTestModel(t, m.name, "config", "model")
+
+		p, err := ParseModelPath(m.name).GetManifestPath()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Chtimes(p, now.Add(-m.age), now.Add(-m.age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mps, err := ListModelsByLastUsed()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, mp := range mps {
+		got = append(got, mp.Repository)
+	}
+
+	if want := []string{"newest", "middle", "oldest"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFindBrokenModels(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	writeTestModel(t, "healthy", "config", "healthy model")
+	digests := writeTestModel(t, "broken", "config", "broken model")
+
+	blob, err := GetBlobsPath(digests[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(blob); err != nil {
+		t.Fatal(err)
+	}
+
+	mps, err := FindBrokenModels()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mps) != 1 || mps[0].Repository != "broken" {
+		t.Errorf("got %v, want only broken", mps)
+	}
+}
+
+func TestResolveLocalTag(t *testing.T) {
+	t.Run("single tag", func(t *testing.T) {
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+		writeTestModel(t, "llama3:8b", "config", "model")
+
+		mp, err := ParseModelPath("llama3").ResolveLocalTag()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if mp.Tag != "8b" {
+			t.Errorf("got tag %q, want 8b", mp.Tag)
+		}
+	})
+
+	t.Run("latest present", func(t *testing.T) {
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+		writeTestModel(t, "llama3:8b", "config", "model")
+		writeTestModel(t, "llama3:latest", "config", "model")
+
+		mp, err := ParseModelPath("llama3").ResolveLocalTag()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if mp.Tag != DefaultTag {
+			t.Errorf("got tag %q, want %s", mp.Tag, DefaultTag)
+		}
+	})
+
+	t.Run("multiple tags", func(t *testing.T) {
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+		writeTestModel(t, "llama3:8b", "config", "model")
+		writeTestModel(t, "llama3:70b", "config", "model")
+
+		if _, err := ParseModelPath("llama3").ResolveLocalTag(); !errors.Is(err, ErrAmbiguousTag) {
+			t.Fatalf("expected ErrAmbiguousTag, got %v", err)
+		}
+	})
+
+	t.Run("explicit tag", func(t *testing.T) {
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+		writeTestModel(t, "llama3:8b", "config", "model")
+
+		mp, err := ParseModelPath("llama3:70b").ResolveLocalTag()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if mp.Tag != "70b" {
+			t.Errorf("got tag %q, want 70b", mp.Tag)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+		if _, err := ParseModelPath("llama3").ResolveLocalTag(); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected os.ErrNotExist, got %v", err)
+		}
+	})
+}
+
+func TestListModelPathsOrder(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	names := []string{
+		"zeta:1",
+		"example.com/ns/alpha:2",
+		"alpha:b",
+		"mistral",
+		"alpha:a",
+		"jmorganca/beta",
+	}
+
+	for _, name := range names {
+		writeTestModel(t, name, "config", "model")
+	}
+
+	var want []string
+	for _, name := range names {
+		want = append(want, ParseModelPath(name).String())
+	}
+	slices.Sort(want)
+
+	for range 3 {
+		mps, err := ListModelPaths()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for _, mp := range mps {
+			got = append(got, mp.String())
+		}
+
+		if !slices.Equal(got, want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestLocalTagPaths(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	for _, name := range []string{"llama3:8b", "llama3:70b", "llama3:latest", "mistral:7b"} {
+		writeTestModel(t, name, "config", "model")
+	}
+
+	mps, err := ParseModelPath("llama3:8b").LocalTagPaths()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []ModelPath{ParseModelPath("llama3:70b"), ParseModelPath("llama3:8b"), ParseModelPath("llama3:latest")}
+	if !slices.Equal(mps, want) {
+		t.Errorf("got %v, want %v", mps, want)
+	}
+
+	if mps, err := ParseModelPath("missing").LocalTagPaths(); err != nil {
+		t.Fatal(err)
+	} else if len(mps) != 0 {
+		t.Errorf("expected no tags, got %v", mps)
+	}
+}
+
+func TestListModelPathsIgnore(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", dir)
+
+	for _, name := range []string{"llama3", "experiments/llama3", "experiments/mistral", "backups/llama3:old", "backups/llama3:keep"} {
+		writeTestModel(t, name, "config", "model")
+	}
+
+	ignore := "# skip scratch work\n\nregistry.ollama.ai/experiments\nregistry.ollama.ai/backups/*/old\n"
+	if err := os.WriteFile(filepath.Join(dir, ignoreFile), []byte(ignore), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	mps, err := ListModelPaths()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, mp := range mps {
+		got = append(got, mp.GetShortTagname())
+	}
+
+	if want := []string{"backups/llama3:keep", "llama3:latest"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	t.Run("invalid pattern", func(t *testing.T) {
+		if err := os.WriteFile(filepath.Join(dir, ignoreFile), []byte("[\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := ListModelPaths(); err == nil {
+			t.Fatal("expected error for invalid pattern")
+		}
+	})
+}
+
+func TestModelsReferencingBlob(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	shared := writeTestModel(t, "llama3", "config", "shared weights")
+	writeTestModel(t, "llama3:custom", "custom config", "shared weights")
+	writeTestModel(t, "mistral", "config", "other weights")
+
+	mps, err := ModelsReferencingBlob(strings.Replace(shared[1], ":", "-", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []ModelPath{ParseModelPath("llama3:custom"), ParseModelPath("llama3")}; !slices.Equal(mps, want) {
+		t.Errorf("got %v, want %v", mps, want)
+	}
+
+	if _, err := ModelsReferencingBlob("sha256:1234"); !errors.Is(err, ErrInvalidDigestFormat) {
+		t.Errorf("expected ErrInvalidDigestFormat, got %v", err)
+	}
+}
+
+func TestAllRepositoryBlobs(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	latest := writeTestModel(t, "llama3", "config", "shared weights")
+	custom := writeTestModel(t, "llama3:custom", "custom config", "shared weights", "adapter")
+	writeTestModel(t, "mistral", "mistral config", "other weights")
+
+	digests, err := ParseModelPath("llama3:custom").AllRepositoryBlobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := append(latest, custom[0], custom[2])
+	slices.Sort(want)
+	if !slices.Equal(digests, want) {
+		t.Errorf("got %v, want %v", digests, want)
+	}
+
+	if digests, err := ParseModelPath("missing").AllRepositoryBlobs(); err != nil {
+		t.Fatal(err)
+	} else if len(digests) > 0 {
+		t.Errorf("expected no blobs for a missing repository, got %v", digests)
+	}
+}
+
+func TestModelFamilies(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	base := writeTestModel(t, "llama3", "base config", "weights")
+	writeTestModel(t, "jmorganca/llama3-chat", "base config", "weights", "system prompt")
+	other := writeTestModel(t, "mistral", "mistral config", "weights")
+
+	families, err := ModelFamilies()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]ModelPath{
+		base[0]:  {ParseModelPath("jmorganca/llama3-chat"), ParseModelPath("llama3")},
+		other[0]: {ParseModelPath("mistral")},
+	}
+
+	if !reflect.DeepEqual(families, want) {
+		t.Errorf("got %v, want %v", families, want)
+	}
+}
+
+func TestBlobUsageReport(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	a := writeTestModel(t, "llama3", "config a", "shared weights!")
+	b := writeTestModel(t, "llama3:custom", "config b", "shared weights!")
+
+	unused := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("unused")))
+	if _, err := WriteBlob(unused, strings.NewReader("unused")); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := BlobUsageReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []BlobUsage{
+		{Digest: a[1], Size: 15, RefCount: 2},
+		{Digest: min(a[0], b[0]), Size: 8, RefCount: 1},
+		{Digest: max(a[0], b[0]), Size: 8, RefCount: 1},
+		{Digest: unused, Size: 6, RefCount: 0},
+	}
+
+	if !slices.Equal(usage, want) {
+		t.Errorf("got %v, want %v", usage, want)
+	}
+}
+
+func TestMoveTo(t *testing.T) {
+	models := t.TempDir()
+	dest := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", models)
+
+	moved := writeTestModel(t, "llama3", "config", "shared weights", "llama3 weights")
+	writeTestModel(t, "mistral", "mistral config", "shared weights")
+
+	mp := ParseModelPath("llama3")
+	if err := mp.RecordPulled(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mp.MoveTo(dest); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, digest := range moved {
+		name := strings.Replace(digest, ":", "-", 1)
+		if err := verifyBlobFile(filepath.Join(dest, "blobs", name), digest); err != nil {
+			t.Errorf("%s: expected an intact copy in the destination, got %v", digest, err)
+		}
+
+		// only the shared blob is still needed by mistral
+		_, err := os.Stat(filepath.Join(models, "blobs", name))
+		if shared := digest == moved[1]; shared && err != nil {
+			t.Errorf("%s: expected the shared blob to be kept, got %v", digest, err)
+		} else if !shared && !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s: expected the blob to be removed, got %v", digest, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dest, "manifests", DefaultRegistry, DefaultNamespace, "llama3", "latest")); err != nil {
+		t.Errorf("expected the manifest in the destination, got %v", err)
+	}
+
+	if _, _, err := GetManifest(mp); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the manifest to be removed, got %v", err)
+	}
+
+	if err := ParseModelPath("mistral").VerifyDeep(context.Background()); err != nil {
+		t.Errorf("expected mistral to be intact, got %v", err)
+	}
+
+	// the moved model is found again once its new root is a models directory
+	t.Setenv("OLLAMA_MODELS", models+string(filepath.ListSeparator)+dest)
+	if err := mp.VerifyDeep(context.Background()); err != nil {
+		t.Errorf("expected llama3 to be intact, got %v", err)
+	}
+
+	if _, ok, err := mp.PulledAt(); err != nil || !ok {
+		t.Errorf("expected the pull record to be moved, got %t, %v", ok, err)
+	}
+
+	if err := ParseModelPath("missing").MoveTo(dest); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist, got %v", err)
+	}
+}
+
+func TestMoveToUnlistedReferences(t *testing.T) {
+	models, other, dest := t.TempDir(), t.TempDir(), t.TempDir()
+
+	// a model in another models directory
+	t.Setenv("OLLAMA_MODELS", other)
+	writeTestModel(t, "phi3", "phi3 config", "shared with phi3")
+
+	t.Setenv("OLLAMA_MODELS", models)
+	moved := writeTestModel(t, "llama3", "config", "shared with phi3", "shared with hidden", "llama3 weights")
+
+	// and one hidden from listings by the ignore file
+	writeTestModel(t, "experiments/hidden", "hidden config", "shared with hidden")
+	if err := os.WriteFile(filepath.Join(models, ignoreFile), []byte("registry.ollama.ai/experiments\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("OLLAMA_MODELS", models+string(filepath.ListSeparator)+other)
+	if err := ParseModelPath("llama3").MoveTo(dest); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, digest := range moved {
+		_, err := os.Stat(filepath.Join(models, "blobs", strings.Replace(digest, ":", "-", 1)))
+		if shared := digest == moved[1] || digest == moved[2]; shared && err != nil {
+			t.Errorf("%s: expected the shared blob to be kept, got %v", digest, err)
+		} else if !shared && !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s: expected the blob to be removed, got %v", digest, err)
+		}
+	}
+}
+
+func TestMoveToPinnedReference(t *testing.T) {
+	models, dest := t.TempDir(), t.TempDir()
+	t.Setenv("OLLAMA_MODELS", models)
+
+	moved := writeTestModel(t, "llama3", "config", "shared weights", "llama3 weights")
+
+	// a model pinned by digest, stored under its digest-named manifest, which
+	// shares a blob with llama3
+	shared := &Layer{MediaType: "application/vnd.ollama.image.model", Digest: moved[1], Size: int64(len("shared weights"))}
+	manifest, err := json.Marshal(ManifestV2{SchemaVersion: 2, Layers: []*Layer{shared}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pinned := ParseModelPath(fmt.Sprintf("pinned@sha256:%x", sha256.Sum256(manifest)))
+	if err := pinned.writeManifest(manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ParseModelPath("llama3").MoveTo(dest); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(models, "blobs", strings.Replace(moved[1], ":", "-", 1))); err != nil {
+		t.Errorf("expected the blob shared with the pinned model to be kept, got %v", err)
+	}
+
+	if err := pinned.VerifyDeep(context.Background()); err != nil {
+		t.Errorf("expected the pinned model to be intact, got %v", err)
+	}
+}
+
+func TestRewriteRegistry(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	writeTestModel(t, "llama3", "config a", "weights a")
+	writeTestModel(t, "jmorganca/mistral:7b", "config b", "weights b")
+	writeTestModel(t, "example.com/ns/other", "config c", "weights c")
+
+	if err := ParseModelPath("llama3").RecordPulled(); err != nil {
+		t.Fatal(err)
+	}
+
+	rewritten, err := RewriteRegistry("ollama.com", "corp.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the pull record moves with its manifest
+	if _, ok, err := ParseModelPath("corp.example.com/library/llama3").PulledAt(); err != nil || !ok {
+		t.Errorf("expected the pull record to be moved, got %t, %v", ok, err)
+	}
+
+	var got []string
+	for _, mp := range rewritten {
+		got = append(got, mp.GetShortTagname())
+	}
+
+	want := []string{"corp.example.com/jmorganca/mistral:7b", "corp.example.com/library/llama3:latest"}
+	if !slices.Equal(got, want) {
+		t.Errorf("rewritten = %v, want %v", got, want)
+	}
+
+	mps, err := ListModelPaths()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got = nil
+	for _, mp := range mps {
+		got = append(got, mp.GetShortTagname())
+	}
+
+	want = append(want, "example.com/ns/other:latest")
+	if !slices.Equal(got, want) {
+		t.Errorf("models = %v, want %v", got, want)
+	}
+
+	// blobs are untouched, so the moved models are still complete
+	broken, err := FindBrokenModels()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(broken) > 0 {
+		t.Errorf("broken models after rewrite: %v", broken)
+	}
+
+	manifests, err := GetManifestPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(manifests, DefaultRegistry)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected old registry directory to be removed, got %v", err)
+	}
+
+	t.Run("conflict", func(t *testing.T) {
+		writeTestModel(t, "llama3", "config a", "weights a")
+		if _, err := RewriteRegistry(DefaultRegistry, "corp.example.com"); !errors.Is(err, errManifestExists) {
+			t.Errorf("expected errManifestExists, got %v", err)
+		}
+
+		if _, err := ParseModelPath("llama3").LocalManifestDigest(); err != nil {
+			t.Errorf("expected model to be left in place: %v", err)
+		}
+	})
+
+	t.Run("secondary directory", func(t *testing.T) {
+		primary, secondary := t.TempDir(), t.TempDir()
+		t.Setenv("OLLAMA_MODELS", secondary)
+		writeTestModel(t, "mirror.example.com/library/phi3", "config phi3", "weights phi3")
+		if err := ParseModelPath("mirror.example.com/library/phi3").RecordPulled(); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Setenv("OLLAMA_MODELS", strings.Join([]string{primary, secondary}, string(filepath.ListSeparator)))
+		if _, err := RewriteRegistry("mirror.example.com", "corp.example.com"); err != nil {
+			t.Fatal(err)
+		}
+
+		moved := ParseModelPath("corp.example.com/library/phi3")
+		if err := moved.VerifyDeep(context.Background()); err != nil {
+			t.Errorf("expected the rewritten model to be complete: %v", err)
+		}
+
+		if _, ok, err := moved.PulledAt(); err != nil || !ok {
+			t.Errorf("expected the pull record to be moved, got %t, %v", ok, err)
+		}
+
+		if _, err := os.Stat(filepath.Join(secondary, "manifests", "mirror.example.com")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected old registry directory to be removed, got %v", err)
+		}
+	})
+
+	t.Run("invalid host", func(t *testing.T) {
+		for _, host := range []string{"", "corp.example.com/ns", "corp\n.example.com"} {
+			if _, err := RewriteRegistry(DefaultRegistry, host); !errors.Is(err, errModelPathInvalid) {
+				t.Errorf("%q: expected errModelPathInvalid, got %v", host, err)
+			}
+		}
+	})
+}
+
+func TestFindDuplicateManifests(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	writeTestModel(t, "llama3", "config", "weights")
+	writeTestModel(t, "llama3:8b", "config", "weights")
+	writeTestModel(t, "mirror.example.com/library/llama3", "config", "weights")
+	writeTestModel(t, "mistral", "mistral config", "weights")
+
+	duplicates, err := FindDuplicateManifests()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest, err := ParseModelPath("llama3").LocalManifestDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]ModelPath{
+		digest: {
+			ParseModelPath("mirror.example.com/library/llama3"),
+			ParseModelPath("llama3:8b"),
+			ParseModelPath("llama3"),
+		},
+	}
+
+	if !reflect.DeepEqual(duplicates, want) {
+		t.Errorf("got %v, want %v", duplicates, want)
+	}
+}
+
+func TestExportInventoryJSON(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var b bytes.Buffer
+	if err := ExportInventoryJSON(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.TrimSpace(b.String()); got != "[]" {
+		t.Errorf("empty store: got %s, want []", got)
+	}
+
+	digests := writeTestModel(t, "llama3", "config", "weights")
+
+	mp := ParseModelPath("llama3")
+	manifestDigest, err := mp.LocalManifestDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.Reset()
+	if err := ExportInventoryJSON(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []map[string]any
+	if err := json.Unmarshal(b.Bytes(), &entries); err != nil {
+		t.Fatalf("invalid JSON %s: %v", b.String(), err)
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+
+	want := map[string]any{
+		"reference":       mp.GetFullTagname(),
+		"manifest_digest": manifestDigest,
+		"size":            float64(len("config") + len("weights")),
+		"blobs":           []any{digests[0], digests[1]},
+	}
+
+	if !reflect.DeepEqual(entries[0], want) {
+		t.Errorf("got %v, want %v", entries[0], want)
+	}
+}
+
+func TestPreviewMatches(t *testing.T) {
+	models := filepath.Join(t.TempDir(), "models")
+	t.Setenv("OLLAMA_MODELS", models)
+
+	if mps, err := PreviewMatches("*"); err != nil {
+		t.Fatal(err)
+	} else if len(mps) != 0 {
+		t.Errorf("expected no matches in an empty store, got %v", mps)
+	}
+
+	if _, err := os.Stat(models); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected preview not to create the store, got %v", err)
+	}
+
+	writeTestModel(t, "llama3", "config", "weights")
+	writeTestModel(t, "llama3:8b", "config", "weights")
+	writeTestModel(t, "llama2", "config", "weights")
+	writeTestModel(t, "jmorganca/llama3", "config", "weights")
+	writeTestModel(t, "example.com/ns/llama3:8b", "config", "weights")
+
+	cases := []struct {
+		pattern string
+		want    []string
+	}{
+		{"llama3", []string{"llama3:latest"}},
+		{"llama3:*", []string{"llama3:8b", "llama3:latest"}},
+		{"llama*", []string{"llama2:latest", "llama3:latest"}},
+		{"*/llama3", []string{"jmorganca/llama3:latest", "llama3:latest"}},
+		{"*/*/llama3:8b", []string{"example.com/ns/llama3:8b", "llama3:8b"}},
+		{"mistral:*", nil},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.pattern, func(t *testing.T) {
+			preview, err := PreviewMatches(tt.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, mp := range preview {
+				got = append(got, mp.GetShortTagname())
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := PreviewMatches("llama3:[8b"); !errors.Is(err, path.ErrBadPattern) {
+		t.Errorf("expected path.ErrBadPattern, got %v", err)
+	}
+
+	t.Run("preview matches operation", func(t *testing.T) {
+		before, err := ListModelPaths()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		preview, err := PreviewMatches("llama3:*")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		matches, err := MatchLocal("llama3:*")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !slices.Equal(preview, matches) {
+			t.Fatalf("preview %v differs from matches %v", preview, matches)
+		}
+
+		for _, mp := range matches {
+			if err := DeleteModel(mp.GetFullTagname()); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		after, err := ListModelPaths()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		deleted := slices.DeleteFunc(before, func(mp ModelPath) bool {
+			return slices.Contains(after, mp)
+		})
+
+		if !slices.Equal(deleted, preview) {
+			t.Errorf("deleted %v, previewed %v", deleted, preview)
+		}
+	})
+}
+
+func TestMultipleModelsDirs(t *testing.T) {
+	primary, secondary := t.TempDir(), t.TempDir()
+
+	t.Setenv("OLLAMA_MODELS", secondary)
+	big := writeTestModel(t, "llama3:70b", `{"model_type":"70B"}`, "weights 70b")
+	writeTestModel(t, "mistral", "config mistral", "weights mistral")
+
+	t.Setenv("OLLAMA_MODELS", primary)
+	writeTestModel(t, "llama3:8b", "config 8b", "weights 8b")
+	// the primary copy shadows the secondary one
+	writeTestModel(t, "mistral", "config mistral", "weights mistral")
+
+	t.Setenv("OLLAMA_MODELS", strings.Join([]string{primary, secondary}, string(filepath.ListSeparator)))
+
+	mps, err := ListModelPaths()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, mp := range mps {
+		got = append(got, mp.GetShortTagname())
+	}
+
+	if want := []string{"llama3:70b", "llama3:8b", "mistral:latest"}; !slices.Equal(got, want) {
+		t.Errorf("ListModelPaths = %v, want %v", got, want)
+	}
+
+	if tags, err := ParseModelPath("llama3").ListTags(); err != nil {
+		t.Fatal(err)
+	} else if want := []string{"70b", "8b"}; !slices.Equal(tags, want) {
+		t.Errorf("ListTags = %v, want %v", tags, want)
+	}
+
+	if broken, err := FindBrokenModels(); err != nil {
+		t.Fatal(err)
+	} else if len(broken) > 0 {
+		t.Errorf("expected models in both directories to be complete, got broken %v", broken)
+	}
+
+	m, err := GetModel("llama3:70b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(m.ModelPath, secondary) {
+		t.Errorf("expected model blob to be read from %s, got %s", secondary, m.ModelPath)
+	}
+
+	data := "new blob"
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(data)))
+	if _, err := WriteBlob(digest, strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	if blob, err := GetBlobsPath(digest); err != nil {
+		t.Fatal(err)
+	} else if !strings.HasPrefix(blob, primary) {
+		t.Errorf("expected blob to be written to %s, got %s", primary, blob)
+	}
+
+	// a model in the secondary directory is copied into the primary one
+	if err := CopyModel(model.ParseName("llama3:70b"), model.ParseName("llama3:copy")); err != nil {
+		t.Fatal(err)
+	}
+
+	if p, err := ParseModelPath("llama3:copy").manifestReadPath(); err != nil {
+		t.Fatal(err)
+	} else if !strings.HasPrefix(p, primary) {
+		t.Errorf("expected the copy to be written to %s, got %s", primary, p)
+	}
+
+	if err := DeleteModel("llama3:70b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := GetManifest(ParseModelPath("llama3:70b")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected deleted model to be gone, got %v", err)
+	}
+
+	secondaryBlob := func(digest string) string {
+		return resolveBlobPath(filepath.Join(secondary, "blobs"), strings.Replace(digest, ":", "-", 1))
+	}
+
+	// the copy still uses the blobs in the secondary directory
+	for _, digest := range big {
+		if _, err := os.Stat(secondaryBlob(digest)); err != nil {
+			t.Errorf("blob %s of the copy was pruned: %v", digest, err)
+		}
+	}
+
+	if err := DeleteModel("llama3:copy"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, digest := range big {
+		if _, err := os.Stat(secondaryBlob(digest)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected unused blob %s to be pruned from %s, got %v", digest, secondary, err)
+		}
+	}
+}
+
+func TestPlanSync(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	writeTestModel(t, "llama3:8b", "config", "weights")
+	writeTestModel(t, "llama3:70b", "config", "big weights")
+	writeTestModel(t, "mistral", "config", "mistral weights")
+
+	stale := ParseModelPath("llama3:70b")
+	stale.Digest = fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("a different manifest")))
+
+	toPull, toRemove, err := PlanSync([]ModelPath{
+		ParseModelPath("llama3:8b"),
+		ParseModelPath("mistral:latest"),
+		stale,
+		ParseModelPath("phi3"),
+		ParseModelPath("phi3:latest"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pulls, removes []string
+	for _, mp := range toPull {
+		pulls = append(pulls, mp.GetShortTagname())
+	}
+
+	for _, mp := range toRemove {
+		removes = append(removes, mp.GetShortTagname())
+	}
+
+	if want := []string{"llama3:70b", "phi3:latest"}; !slices.Equal(pulls, want) {
+		t.Errorf("got toPull %v, want %v", pulls, want)
+	}
+
+	if len(removes) > 0 {
+		t.Errorf("got toRemove %v, want none", removes)
+	}
+
+	if _, toRemove, err := PlanSync([]ModelPath{ParseModelPath("mistral")}); err != nil {
+		t.Fatal(err)
+	} else if len(toRemove) != 2 {
+		t.Errorf("expected both llama3 tags to be removed, got %v", toRemove)
+	}
+
+	// names that differ only in case outside the tag share a manifest
+	if toPull, toRemove, err := PlanSync([]ModelPath{
+		ParseModelPath("Library/Llama3:8b"),
+		ParseModelPath("llama3:70b"),
+		ParseModelPath("MISTRAL"),
+	}); err != nil {
+		t.Fatal(err)
+	} else if len(toPull) > 0 || len(toRemove) > 0 {
+		t.Errorf("expected nothing to sync, got toPull %v, toRemove %v", toPull, toRemove)
+	}
+
+	if _, _, err := PlanSync([]ModelPath{{}}); !errors.Is(err, errModelPathInvalid) {
+		t.Errorf("expected errModelPathInvalid, got %v", err)
+	}
+}
+
+func TestListTagsPaged(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	for _, tag := range []string{"e", "a", "d", "b", "c"} {
+		writeTestModel(t, "llama3:"+tag, "config", "weights")
+	}
+
+	mp := ParseModelPath("llama3")
+
+	var pages [][]string
+	var after string
+	for {
+		tags, next, err := mp.ListTagsPaged(2, after)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pages = append(pages, tags)
+		if next == "" {
+			break
+		}
+
+		after = next
+	}
+
+	want := [][]string{{"a", "b"}, {"c", "d"}, {"e"}}
+	if !slices.EqualFunc(pages, want, slices.Equal) {
+		t.Errorf("got pages %v, want %v", pages, want)
+	}
+
+	cases := []struct {
+		limit     int
+		after     string
+		wantTags  []string
+		wantAfter string
+	}{
+		{0, "", []string{"a", "b", "c", "d", "e"}, ""},
+		{4, "a", []string{"b", "c", "d", "e"}, ""},
+		{1, "bb", []string{"c"}, "c"},
+		{2, "e", nil, ""},
+	}
+
+	for _, tt := range cases {
+		tags, next, err := mp.ListTagsPaged(tt.limit, tt.after)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !slices.Equal(tags, tt.wantTags) || next != tt.wantAfter {
+			t.Errorf("ListTagsPaged(%d, %q) = %v, %q, want %v, %q", tt.limit, tt.after, tags, next, tt.wantTags, tt.wantAfter)
+		}
+	}
+}
+
+func TestLatestSemverTag(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	if _, err := ParseModelPath("llama3").LatestSemverTag(); !errors.Is(err, errNoSemverTags) {
+		t.Errorf("expected errNoSemverTags for a missing repository, got %v", err)
+	}
+
+	for _, tag := range []string{"latest", "8b", "13", "v1.2", "v1.10", "v1.10-rc1", "1.9.9"} {
+		writeTestModel(t, "llama3:"+tag, "config", "weights")
+	}
+
+	mp, err := ParseModelPath("llama3").LatestSemverTag()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mp.Tag != "v1.10" {
+		t.Errorf("got %s, want v1.10", mp.Tag)
+	}
+
+	writeTestModel(t, "llama3:v2.0-beta", "config", "weights")
+	if mp, err := ParseModelPath("llama3").LatestSemverTag(); err != nil {
+		t.Fatal(err)
+	} else if mp.Tag != "v2.0-beta" {
+		t.Errorf("got %s, want v2.0-beta", mp.Tag)
+	}
+
+	writeTestModel(t, "mistral:latest", "config", "weights")
+	if _, err := ParseModelPath("mistral").LatestSemverTag(); !errors.Is(err, errNoSemverTags) {
+		t.Errorf("expected errNoSemverTags, got %v", err)
+	}
+}
+
+func TestParseSemver(t *testing.T) {
+	valid := []string{"v1", "V1", "v1.2", "1.2", "1.2.3", "v1.2.3-rc1"}
+	for _, s := range valid {
+		if _, ok := parseSemver(s); !ok {
+			t.Errorf("%s: expected a version", s)
+		}
+	}
+
+	invalid := []string{"", "v", "13", "8b", "latest", "v1.x", "1.2.3.4", "v1..2", "q4_0", "v-1"}
+	for _, s := range invalid {
+		if _, ok := parseSemver(s); ok {
+			t.Errorf("%s: expected not a version", s)
+		}
+	}
+}
+
+func TestFindOrphanManifests(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	if orphans, err := FindOrphanManifests(); err != nil {
+		t.Fatal(err)
+	} else if len(orphans) != 0 {
+		t.Errorf("expected no orphans in an empty store, got %v", orphans)
+	}
+
+	mp := ParseModelPath("llama3")
+
+	// keep a digest-named copy of each manifest the tag points at
+	copyTagged := func() string {
+		t.Helper()
+		p, err := mp.TagManifestDigestPath()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		manifest, err := mp.readManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(p, manifest, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		return p
+	}
+
+	writeTestModel(t, "llama3", "config v1", "weights v1")
+	old := copyTagged()
+
+	if orphans, err := FindOrphanManifests(); err != nil {
+		t.Fatal(err)
+	} else if len(orphans) != 0 {
+		t.Errorf("expected no orphans, got %v", orphans)
+	}
+
+	// move the tag to a new manifest
+	writeTestModel(t, "llama3", "config v2", "weights v2")
+	current := copyTagged()
+
+	orphans, err := FindOrphanManifests()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{old}; !slices.Equal(orphans, want) {
+		t.Errorf("got %v, want %v", orphans, want)
+	}
+
+	if slices.Contains(orphans, current) {
+		t.Errorf("manifest %s the tag points at reported as orphan", current)
+	}
+
+	// a manifest is only kept alive by tags of its own repository
+	writeTestModel(t, "mistral", "config v1", "weights v1")
+	if orphans, err := FindOrphanManifests(); err != nil {
+		t.Fatal(err)
+	} else if want := []string{old}; !slices.Equal(orphans, want) {
+		t.Errorf("got %v, want %v", orphans, want)
+	}
+
+	// a model pulled by digest is stored under its digest-named manifest
+	// without any tag pointing at it
+	manifest := []byte(`{"schemaVersion":2,"layers":[]}`)
+	pinned := ParseModelPath(fmt.Sprintf("llama3@sha256:%x", sha256.Sum256(manifest)))
+	if err := pinned.writeManifest(manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pinned.RecordPulled(); err != nil {
+		t.Fatal(err)
+	}
+
+	if orphans, err := FindOrphanManifests(); err != nil {
+		t.Fatal(err)
+	} else if want := []string{old}; !slices.Equal(orphans, want) {
+		t.Errorf("got %v, want %v", orphans, want)
+	}
+}
+
+func TestCheckStorePermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix permissions are not supported on windows")
+	}
+
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	digests := writeTestModel(t, "llama3", "config", "weights")
+
+	if issues, err := CheckStorePermissions(); err != nil {
+		t.Fatal(err)
+	} else if len(issues) > 0 {
+		t.Errorf("expected no issues, got %v", issues)
+	}
+
+	broad, err := GetBlobsPath(digests[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chmod(broad, 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	unreadable, err := GetBlobsPath(digests[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chmod(unreadable, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	issues, err := CheckStorePermissions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{broad + ": mode 0666 is broader than the expected 0644"}
+	// root can read any file regardless of its mode
+	if os.Geteuid() != 0 {
+		want = append(want, unreadable+": not readable: open "+unreadable+": permission denied")
+	}
+
+	slices.Sort(issues)
+	slices.Sort(want)
+	if !slices.Equal(issues, want) {
+		t.Errorf("got %q, want %q", issues, want)
+	}
+}
+
+func TestUniqueBytes(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	writeTestModel(t, "llama3", "config", "weights")
+	writeTestModel(t, "llama3:chat", "config", "weights", "template")
+	writeTestModel(t, "phi3", "other config", "weights")
+
+	cases := []struct {
+		refs []string
+		want int64
+	}{
+		{nil, 0},
+		{[]string{"llama3"}, int64(len("config") + len("weights"))},
+		{[]string{"llama3", "llama3"}, int64(len("config") + len("weights"))},
+		{[]string{"llama3", "llama3:chat"}, int64(len("config") + len("weights") + len("template"))},
+		{[]string{"llama3", "llama3:chat", "phi3"}, int64(len("config") + len("weights") + len("template") + len("other config"))},
+	}
+
+	for _, tt := range cases {
+		var refs []ModelPath
+		for _, ref := range tt.refs {
+			refs = append(refs, ParseModelPath(ref))
+		}
+
+		if got, err := UniqueBytes(refs); err != nil {
+			t.Fatal(err)
+		} else if got != tt.want {
+			t.Errorf("%v: got %d, want %d", tt.refs, got, tt.want)
+		}
+	}
+
+	if _, err := UniqueBytes([]ModelPath{ParseModelPath("missing")}); err == nil {
+		t.Error("expected an error for a missing model")
+	}
+}
+
+func TestListModelsWithDigests(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	writeTestModel(t, "llama3", "config", "model")
+	writeTestModel(t, "llama3:8b", "config", "model")
+	writeTestModel(t, "ghcr.io/org/team/model:v1", "other config", "model")
+
+	want := make(map[string]string)
+	for _, name := range []string{"llama3", "llama3:8b", "ghcr.io/org/team/model:v1"} {
+		mp := ParseModelPath(name)
+		digest, err := mp.LocalManifestDigest()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want[mp.GetFullTagname()] = digest
+	}
+
+	got, err := ListModelsWithDigests()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !maps.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if got["registry.ollama.ai/library/llama3:latest"] != got["registry.ollama.ai/library/llama3:8b"] {
+		t.Error("expected tags of the same manifest to share a digest")
+	}
+
+	if got["registry.ollama.ai/library/llama3:latest"] == got["ghcr.io/org/team/model:v1"] {
+		t.Error("expected different manifests to have different digests")
+	}
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"crypto/sha256"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 )
@@ -15,30 +16,80 @@ type Layer struct {
 	status    string
 }
 
+// DigestWriter passes writes through to an underlying writer while computing
+// their sha256 digest.
+type DigestWriter struct {
+	w    io.Writer
+	hash hash.Hash
+}
+
+// NewDigestWriter returns a DigestWriter writing to w.
+func NewDigestWriter(w io.Writer) *DigestWriter {
+	return &DigestWriter{w: w, hash: sha256.New()}
+}
+
+func (d *DigestWriter) Write(p []byte) (int, error) {
+	n, err := d.w.Write(p)
+	d.hash.Write(p[:n])
+	return n, err
+}
+
+// Digest returns the sha256:<hex> digest of the bytes written so far.
+func (d *DigestWriter) Digest() string {
+	return fmt.Sprintf("sha256:%x", d.hash.Sum(nil))
+}
+
 func NewLayer(r io.Reader, mediatype string) (*Layer, error) {
+	return newLayer(r, mediatype, "")
+}
+
+// WriteBlob stores the contents of r in the blobs directory under digest. The
+// data is written to a temporary file first and only moved into place once its
+// sha256 matches digest, otherwise errDigestMismatch is returned.
+func WriteBlob(digest string, r io.Reader) (int64, error) {
+	layer, err := newLayer(r, "", digest)
+	if err != nil {
+		return 0, err
+	}
+
+	return layer.Size, nil
+}
+
+// newLayer writes the contents of r to the blobs directory like NewLayer. If
+// want is set, the contents are only moved into place if their digest matches
+// it.
+func newLayer(r io.Reader, mediatype, want string) (*Layer, error) {
 	blobs, err := GetBlobsPath("")
 	if err != nil {
 		return nil, err
 	}
 
-	temp, err := os.CreateTemp(blobs, "sha256-")
+	temp, err := createTemp(blobs, "sha256-")
 	if err != nil {
 		return nil, err
 	}
 	defer temp.Close()
 	defer os.Remove(temp.Name())
 
-	sha256sum := sha256.New()
-	n, err := io.Copy(io.MultiWriter(temp, sha256sum), r)
+	w := NewDigestWriter(temp)
+	n, err := io.Copy(w, r)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := chmodFile(temp); err != nil {
+		return nil, err
+	}
+
 	if err := temp.Close(); err != nil {
 		return nil, err
 	}
 
-	digest := fmt.Sprintf("sha256:%x", sha256sum.Sum(nil))
+	digest := w.Digest()
+	if want != "" && !DigestsEqual(want, digest) {
+		return nil, fmt.Errorf("%w: want %s, got %s", errDigestMismatch, want, digest)
+	}
+
 	blob, err := GetBlobsPath(digest)
 	if err != nil {
 		return nil, err
@@ -81,7 +132,7 @@ func NewLayerFromLayer(digest, mediatype, from string) (*Layer, error) {
 }
 
 func (l *Layer) Open() (io.ReadCloser, error) {
-	blob, err := GetBlobsPath(l.Digest)
+	blob, err := readBlobPath(l.Digest)
 	if err != nil {
 		return nil, err
 	}
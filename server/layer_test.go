@@ -0,0 +1,240 @@
+package server
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/ollama/ollama/server/envconfig"
+)
+
+func TestWriteBlob(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	data := "hello world"
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(data)))
+
+	n, err := WriteBlob(digest, strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != int64(len(data)) {
+		t.Errorf("got %d bytes, want %d", n, len(data))
+	}
+
+	blob, err := GetBlobsPath(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := os.ReadFile(blob); err != nil {
+		t.Fatal(err)
+	} else if string(b) != data {
+		t.Errorf("got %q, want %q", b, data)
+	}
+
+	t.Run("mismatch", func(t *testing.T) {
+		wrong := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("something else")))
+		if _, err := WriteBlob(wrong, strings.NewReader(data)); !errors.Is(err, errDigestMismatch) {
+			t.Fatalf("expected errDigestMismatch, got %v", err)
+		}
+
+		blob, err := GetBlobsPath(wrong)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.Stat(blob); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected no blob to be written, got %v", err)
+		}
+	})
+}
+
+func TestFileModes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix permissions are not supported on windows")
+	}
+
+	// without OLLAMA_FILE_MODE and OLLAMA_DIR_MODE the umask applies, as for
+	// any file or directory created with the default modes
+	probe := t.TempDir()
+	if err := os.WriteFile(filepath.Join(probe, "file"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(filepath.Join(probe, "dir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	var umasked [2]os.FileMode
+	for i, name := range []string{"file", "dir"} {
+		fi, err := os.Stat(filepath.Join(probe, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		umasked[i] = fi.Mode().Perm()
+	}
+
+	cases := []struct {
+		name              string
+		fileMode, dirMode string
+		wantFile, wantDir os.FileMode
+	}{
+		{"default", "", "", umasked[0], umasked[1]},
+		{"group readable", "0640", "0750", 0o640, 0o750},
+		// explicit modes aren't narrowed by the umask
+		{"group writable", "0664", "0777", 0o664, 0o777},
+		{"invalid", "rw-r--r--", "01777", umasked[0], umasked[1]},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			models := t.TempDir()
+			t.Setenv("OLLAMA_MODELS", models)
+			t.Cleanup(envconfig.LoadConfig)
+			t.Setenv("OLLAMA_FILE_MODE", tt.fileMode)
+			t.Setenv("OLLAMA_DIR_MODE", tt.dirMode)
+			envconfig.LoadConfig()
+
+			digests := writeTestModel(t, "llama3", "config", "weights")
+
+			blob, err := GetBlobsPath(digests[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			manifest, err := ParseModelPath("llama3").GetManifestPath()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, p := range []string{blob, manifest} {
+				if fi, err := os.Stat(p); err != nil {
+					t.Fatal(err)
+				} else if fi.Mode().Perm() != tt.wantFile {
+					t.Errorf("%s: got mode %#o, want %#o", p, fi.Mode().Perm(), tt.wantFile)
+				}
+			}
+
+			dirs := []string{filepath.Dir(blob), filepath.Dir(manifest), filepath.Dir(filepath.Dir(manifest))}
+			for _, p := range dirs {
+				if fi, err := os.Stat(p); err != nil {
+					t.Fatal(err)
+				} else if fi.Mode().Perm() != tt.wantDir {
+					t.Errorf("%s: got mode %#o, want %#o", p, fi.Mode().Perm(), tt.wantDir)
+				}
+			}
+		})
+	}
+}
+
+func TestDigestWriter(t *testing.T) {
+	for _, data := range []string{"", "hello world", strings.Repeat("model weights ", 10000)} {
+		var b strings.Builder
+		w := NewDigestWriter(&b)
+		if _, err := io.Copy(w, strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+
+		if want := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(data))); w.Digest() != want {
+			t.Errorf("got %s, want %s", w.Digest(), want)
+		}
+
+		if b.String() != data {
+			t.Errorf("expected writes to be passed through")
+		}
+	}
+}
+
+// spyReader records the entries of dir when it is first read from, i.e. while
+// a temporary file for the data it returns is open.
+type spyReader struct {
+	io.Reader
+	dir     string
+	entries []os.DirEntry
+}
+
+func (r *spyReader) Read(p []byte) (int, error) {
+	if r.entries == nil {
+		r.entries, _ = os.ReadDir(r.dir)
+	}
+
+	return r.Reader.Read(p)
+}
+
+func TestStoreTmpDir(t *testing.T) {
+	data := "hello world"
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(data)))
+
+	t.Run("same filesystem", func(t *testing.T) {
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+		tmp := t.TempDir()
+		t.Cleanup(envconfig.LoadConfig)
+		t.Setenv("OLLAMA_TMP_DIR", tmp)
+		envconfig.LoadConfig()
+
+		if same, err := sameFilesystem(tmp, os.Getenv("OLLAMA_MODELS")); err != nil || !same {
+			t.Skip("temporary directories are on different filesystems")
+		}
+
+		r := &spyReader{Reader: strings.NewReader(data), dir: tmp}
+		if _, err := WriteBlob(digest, r); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(r.entries) != 1 || !strings.HasPrefix(r.entries[0].Name(), "sha256-") {
+			t.Errorf("expected the temporary file in OLLAMA_TMP_DIR, got %v", r.entries)
+		}
+
+		if entries, err := os.ReadDir(tmp); err != nil {
+			t.Fatal(err)
+		} else if len(entries) > 0 {
+			t.Errorf("expected the temporary file to be renamed, got %v", entries)
+		}
+
+		if _, err := CopyBlobTo(digest, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("different filesystem", func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip("needs a directory on a different filesystem")
+		}
+
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+		t.Cleanup(envconfig.LoadConfig)
+		t.Setenv("OLLAMA_TMP_DIR", "/proc")
+		envconfig.LoadConfig()
+
+		blobs, err := GetBlobsPath("")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if same, err := sameFilesystem("/proc", blobs); err != nil || same {
+			t.Skip("/proc is on the same filesystem as the models directory")
+		}
+
+		r := &spyReader{Reader: strings.NewReader(data), dir: blobs}
+		if _, err := WriteBlob(digest, r); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(r.entries) != 1 || !strings.HasPrefix(r.entries[0].Name(), "sha256-") {
+			t.Errorf("expected the temporary file in the blobs directory, got %v", r.entries)
+		}
+
+		if _, err := CopyBlobTo(digest, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
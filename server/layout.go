@@ -0,0 +1,107 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// layoutVersionFile is the name of the file in the models directory recording
+// the version of the store's on-disk layout.
+const layoutVersionFile = "layout_version"
+
+// layoutVersion is the layout this code reads and writes. Stores written
+// before the layout was versioned are version 0, which may still have blobs
+// named sha256:<hex> rather than sha256-<hex>.
+const layoutVersion = 1
+
+var errLayoutTooNew = errors.New("store layout is newer than supported")
+
+// StoreNeedsMigration compares the layout version of the models directory with
+// the version this code expects, reporting whether the store must be migrated
+// from the one to the other. A store without a version file is version 0
+// unless it is empty, in which case there's nothing to migrate. A store newer
+// than this code returns errLayoutTooNew.
+func StoreNeedsMigration() (from, to int, needed bool, err error) {
+	dir, err := modelsDir()
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	from, ok, err := readLayoutVersion(dir)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	if !ok {
+		empty, err := storeEmpty(dir)
+		if err != nil {
+			return 0, 0, false, err
+		}
+
+		if empty {
+			return layoutVersion, layoutVersion, false, nil
+		}
+	}
+
+	if from > layoutVersion {
+		return from, layoutVersion, false, fmt.Errorf("%w: version %d, want %d", errLayoutTooNew, from, layoutVersion)
+	}
+
+	return from, layoutVersion, from < layoutVersion, nil
+}
+
+// readLayoutVersion returns the layout version recorded in the models
+// directory dir, reporting false if there's no version file.
+func readLayoutVersion(dir string) (int, bool, error) {
+	b, err := os.ReadFile(filepath.Join(dir, layoutVersionFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+
+	version, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || version < 0 {
+		return 0, false, fmt.Errorf("%s: invalid version %q", layoutVersionFile, strings.TrimSpace(string(b)))
+	}
+
+	return version, true, nil
+}
+
+// recordLayoutVersion writes the current layout version to the models
+// directory once the store has been migrated, unless it's already recorded.
+func recordLayoutVersion() error {
+	dir, err := modelsDir()
+	if err != nil {
+		return err
+	}
+
+	if version, ok, err := readLayoutVersion(dir); err == nil && ok && version == layoutVersion {
+		return nil
+	}
+
+	return writeFileAtomic(filepath.Join(dir, layoutVersionFile), []byte(strconv.Itoa(layoutVersion)+"\n"))
+}
+
+// storeEmpty reports whether the models directory dir has neither manifests
+// nor blobs.
+func storeEmpty(dir string) (bool, error) {
+	for _, sub := range []string{"manifests", "blobs"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+
+		if len(entries) > 0 {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestStoreNeedsMigration(t *testing.T) {
+	check := func(t *testing.T, wantFrom int, wantNeeded bool) {
+		t.Helper()
+
+		from, to, needed, err := StoreNeedsMigration()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if from != wantFrom || to != layoutVersion || needed != wantNeeded {
+			t.Errorf("got %d, %d, %v, want %d, %d, %v", from, to, needed, wantFrom, layoutVersion, wantNeeded)
+		}
+	}
+
+	t.Run("up to date", func(t *testing.T) {
+		dir := t.TempDir()
+		t.Setenv("OLLAMA_MODELS", dir)
+
+		writeTestModel(t, "llama3", "config", "model")
+		if err := recordLayoutVersion(); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := os.ReadFile(filepath.Join(dir, layoutVersionFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := strconv.Itoa(layoutVersion) + "\n"; string(b) != want {
+			t.Errorf("got %q, want %q", b, want)
+		}
+
+		check(t, layoutVersion, false)
+	})
+
+	t.Run("older", func(t *testing.T) {
+		dir := t.TempDir()
+		t.Setenv("OLLAMA_MODELS", dir)
+
+		writeTestModel(t, "llama3", "config", "model")
+		if err := os.WriteFile(filepath.Join(dir, layoutVersionFile), []byte("0\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		check(t, 0, true)
+
+		if err := recordLayoutVersion(); err != nil {
+			t.Fatal(err)
+		}
+
+		check(t, layoutVersion, false)
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+		// a new store has nothing to migrate
+		check(t, layoutVersion, false)
+
+		if _, err := GetBlobsPath(""); err != nil {
+			t.Fatal(err)
+		}
+
+		check(t, layoutVersion, false)
+
+		// but one written before the layout was versioned does
+		writeTestModel(t, "llama3", "config", "model")
+		check(t, 0, true)
+	})
+
+	t.Run("newer", func(t *testing.T) {
+		dir := t.TempDir()
+		t.Setenv("OLLAMA_MODELS", dir)
+
+		if err := os.WriteFile(filepath.Join(dir, layoutVersionFile), []byte(strconv.Itoa(layoutVersion+1)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, needed, err := StoreNeedsMigration(); !errors.Is(err, errLayoutTooNew) || needed {
+			t.Errorf("expected errLayoutTooNew, got %v, %v", needed, err)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		dir := t.TempDir()
+		t.Setenv("OLLAMA_MODELS", dir)
+
+		if err := os.WriteFile(filepath.Join(dir, layoutVersionFile), []byte("one"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, _, err := StoreNeedsMigration(); err == nil {
+			t.Error("expected an error for an invalid version file")
+		}
+	})
+}
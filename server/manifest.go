@@ -4,11 +4,18 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"math/rand/v2"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/ollama/ollama/server/envconfig"
 	"github.com/ollama/ollama/types/model"
 )
 
@@ -35,8 +42,13 @@ func ParseNamedManifest(name model.Name) (*Manifest, error) {
 		return nil, err
 	}
 
+	p, err := readPath(filepath.Join(manifests, name.Filepath()))
+	if err != nil {
+		return nil, err
+	}
+
 	var manifest ManifestV2
-	manifestfile, err := os.Open(filepath.Join(manifests, name.Filepath()))
+	manifestfile, err := os.Open(p)
 	if err != nil {
 		return nil, err
 	}
@@ -52,6 +64,21 @@ func ParseNamedManifest(name model.Name) (*Manifest, error) {
 	}, nil
 }
 
+// VerifyManifestDigest checks that manifestBytes hash to the expected digest,
+// e.g. for a manifest pulled by digest. The digests are compared in constant
+// time.
+func VerifyManifestDigest(manifestBytes []byte, expected string) error {
+	if !blobDigestRegEx.MatchString(expected) {
+		return fmt.Errorf("%w: %q", ErrInvalidDigestFormat, expected)
+	}
+
+	if got := fmt.Sprintf("sha256:%x", sha256.Sum256(manifestBytes)); !DigestsEqual(expected, got) {
+		return fmt.Errorf("manifest %w: want %s, got %s", errDigestMismatch, expected, got)
+	}
+
+	return nil
+}
+
 func WriteManifest(name string, config *Layer, layers []*Layer) error {
 	manifest := ManifestV2{
 		SchemaVersion: 2,
@@ -61,7 +88,8 @@ func WriteManifest(name string, config *Layer, layers []*Layer) error {
 	}
 
 	var b bytes.Buffer
-	if err := json.NewEncoder(&b).Encode(manifest); err != nil {
+	w := NewDigestWriter(&b)
+	if err := json.NewEncoder(w).Encode(manifest); err != nil {
 		return err
 	}
 
@@ -71,9 +99,645 @@ func WriteManifest(name string, config *Layer, layers []*Layer) error {
 		return err
 	}
 
-	if err := os.MkdirAll(filepath.Dir(manifestPath), 0o755); err != nil {
+	// like WriteManifestIfChanged, an unchanged manifest is left alone so
+	// its mtime still tells when the model last changed
+	if existing, err := os.ReadFile(manifestPath); err == nil && DigestsEqual(fmt.Sprintf("sha256:%x", sha256.Sum256(existing)), w.Digest()) {
+		slog.Debug("manifest unchanged", "name", name, "digest", w.Digest())
+		return nil
+	}
+
+	if err := writeManifestFile(manifestPath, b.Bytes()); err != nil {
+		return err
+	}
+
+	slog.Debug("wrote manifest", "name", name, "digest", w.Digest())
+	return nil
+}
+
+// readManifest returns the raw bytes of the model's manifest from the active
+// store.
+func (mp ModelPath) readManifest() ([]byte, error) {
+	return activeStore().ReadManifest(mp)
+}
+
+// writeManifest writes the raw bytes of the model's manifest to the active
+// store.
+func (mp ModelPath) writeManifest(manifest []byte) error {
+	return activeStore().WriteManifest(mp, manifest)
+}
+
+// writeManifestFile atomically writes the manifest file p, creating its
+// directory, and invalidates the models index. Every manifest written to the
+// filesystem goes through it, or removeManifestFile and moveManifestFile for
+// removals and renames.
+func writeManifestFile(p string, manifest []byte) error {
+	if err := mkdirAll(filepath.Dir(p)); err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(p, manifest); err != nil {
+		return err
+	}
+
+	return invalidateIndex()
+}
+
+// removeManifestFile removes the manifest file p along with its pulled_at
+// sidecar and invalidates the models index.
+func removeManifestFile(p string) error {
+	if err := os.Remove(p); err != nil {
+		return err
+	}
+
+	if err := os.Remove(pulledAtPath(p)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return invalidateIndex()
+}
+
+// moveManifestFile renames the manifest file src to dst along with its
+// pulled_at sidecar, creating dst's directory, and invalidates the models
+// index.
+func moveManifestFile(src, dst string) error {
+	if err := mkdirAll(filepath.Dir(dst)); err != nil {
+		return err
+	}
+
+	if err := os.Rename(src, dst); err != nil {
+		return errors.Join(err, invalidateIndex())
+	}
+
+	if err := os.Rename(pulledAtPath(src), pulledAtPath(dst)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.Join(err, invalidateIndex())
+	}
+
+	return invalidateIndex()
+}
+
+// copyManifestFile copies the manifest file src to dst along with its
+// pulled_at sidecar, for moves between models directories which may be on
+// different file systems. The caller removes src.
+func copyManifestFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	if err := writeManifestFile(dst, data); err != nil {
+		return err
+	}
+
+	if pulledAt, err := os.ReadFile(pulledAtPath(src)); err == nil {
+		return writeFileAtomic(pulledAtPath(dst), pulledAt)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to name and renames it
+// over name, so readers see either the previous or the new contents but never
+// a partially written file.
+func writeFileAtomic(name string, data []byte) error {
+	temp, err := createTemp(filepath.Dir(name), "."+filepath.Base(name)+"-")
+	if err != nil {
+		return err
+	}
+	defer temp.Close()
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		return err
+	}
+
+	if err := chmodFile(temp); err != nil {
+		return err
+	}
+
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), name)
+}
+
+// createTemp creates a temporary file to be renamed into dir. It is created in
+// OLLAMA_TMP_DIR, e.g. a fast local disk when the store is on a network mount,
+// if that is on the same filesystem as dir so the rename stays atomic, and in
+// dir otherwise.
+func createTemp(dir, pattern string) (*os.File, error) {
+	if tmp := envconfig.StoreTmpDir; tmp != "" {
+		if same, err := sameFilesystem(tmp, dir); err == nil && same {
+			dir = tmp
+		} else if err != nil {
+			slog.Debug("couldn't compare filesystems", "OLLAMA_TMP_DIR", tmp, "dir", dir, "error", err)
+		}
+	}
+
+	// unlike os.CreateTemp, which always uses 0o600, the file is created
+	// with defaultFileMode so the umask applies as for any other file
+	for range 10000 {
+		name := filepath.Join(dir, pattern+strconv.FormatUint(uint64(rand.Uint32()), 10))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, defaultFileMode)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+
+		return f, err
+	}
+
+	return nil, &os.PathError{Op: "createtemp", Path: filepath.Join(dir, pattern+"*"), Err: os.ErrExist}
+}
+
+// defaultFileMode and defaultDirMode are the permission bits files and
+// directories in the store are created with, narrowed by the umask, unless
+// OLLAMA_FILE_MODE or OLLAMA_DIR_MODE are set.
+const (
+	defaultFileMode os.FileMode = 0o644
+	defaultDirMode  os.FileMode = 0o755
+)
+
+// chmodFile sets the mode of f to OLLAMA_FILE_MODE if it is set. Otherwise f
+// keeps the mode it was created with.
+func chmodFile(f *os.File) error {
+	if envconfig.FileMode == 0 {
+		return nil
+	}
+
+	return f.Chmod(envconfig.FileMode)
+}
+
+// mkdirAll creates dir along with any missing parents. If OLLAMA_DIR_MODE is
+// set, the directories it creates are given exactly that mode; otherwise they
+// are created with defaultDirMode narrowed by the umask.
+func mkdirAll(dir string) error {
+	if envconfig.DirMode == 0 {
+		return os.MkdirAll(dir, defaultDirMode)
+	}
+
+	// find the directories missing before MkdirAll so existing ones keep
+	// their mode
+	var missing []string
+	for p := filepath.Clean(dir); ; p = filepath.Dir(p) {
+		if _, err := os.Stat(p); err == nil {
+			break
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		missing = append(missing, p)
+		if filepath.Dir(p) == p {
+			break
+		}
+	}
+
+	if err := os.MkdirAll(dir, envconfig.DirMode); err != nil {
+		return err
+	}
+
+	for _, p := range missing {
+		if err := os.Chmod(p, envconfig.DirMode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RetagFrom points mp's tag at the manifest of src. The manifest is replaced
+// atomically so concurrent readers never observe a missing or partially
+// written tag.
+func (mp ModelPath) RetagFrom(src ModelPath) error {
+	if err := mp.Validate(); err != nil {
+		return err
+	}
+
+	manifest, err := src.readManifest()
+	if err != nil {
+		return err
+	}
+
+	_, err = mp.WriteManifestIfChanged(manifest)
+	return err
+}
+
+// WriteManifestIfChanged replaces the model's manifest with data unless the
+// existing manifest has the same digest, leaving it and its mtime untouched.
+// changed reports whether data was written.
+func (mp ModelPath) WriteManifestIfChanged(data []byte) (changed bool, err error) {
+	digest, err := mp.LocalManifestDigest()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+
+	if err == nil && DigestsEqual(digest, fmt.Sprintf("sha256:%x", sha256.Sum256(data))) {
+		return false, nil
+	}
+
+	if err := mp.writeManifest(data); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// LayerDiff compares the blobs referenced by the manifests of old and new.
+// added are only referenced by new and have to be downloaded, removed are only
+// referenced by old, and shared are referenced by both.
+func LayerDiff(old, new ModelPath) (added, removed, shared []string, err error) {
+	oldBlobs, err := old.ReferencedBlobs()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	newBlobs, err := new.ReferencedBlobs()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	inOld := make(map[string]bool, len(oldBlobs))
+	for _, digest := range oldBlobs {
+		inOld[digest] = true
+	}
+
+	inNew := make(map[string]bool, len(newBlobs))
+	for _, digest := range newBlobs {
+		if inNew[digest] {
+			continue
+		}
+		inNew[digest] = true
+
+		if inOld[digest] {
+			shared = append(shared, digest)
+		} else {
+			added = append(added, digest)
+		}
+	}
+
+	for _, digest := range oldBlobs {
+		if !inNew[digest] {
+			removed = append(removed, digest)
+			// only report each digest once
+			inNew[digest] = true
+		}
+	}
+
+	return added, removed, shared, nil
+}
+
+// tagAlias is stored in place of a manifest for a tag which points at another
+// tag of the same repository, e.g. {"aliasOf":"v1.4"}.
+type tagAlias struct {
+	AliasOf string `json:"aliasOf"`
+}
+
+var (
+	errTagAliasCycle    = errors.New("tag alias cycle")
+	errTagAliasDangling = errors.New("tag alias points at a missing tag")
+	errTagAliasNested   = errors.New("tag alias points at another alias")
+)
+
+// readTagAlias returns the tag mp's manifest is an alias of, if any.
+func (mp ModelPath) readTagAlias() (string, bool, error) {
+	b, err := mp.readManifest()
+	if err != nil {
+		return "", false, err
+	}
+
+	var alias tagAlias
+	if err := json.Unmarshal(b, &alias); err != nil || alias.AliasOf == "" {
+		// not an alias, which includes manifests which fail to parse
+		return "", false, nil
+	}
+
+	return alias.AliasOf, true, nil
+}
+
+// ResolveTagAlias returns the model path of the tag mp aliases if its manifest
+// is a tag alias, or mp unchanged otherwise. Only a single level of
+// indirection is followed: an alias of an alias is an error, reported as a
+// cycle when it leads back to mp.
+func (mp ModelPath) ResolveTagAlias() (ModelPath, error) {
+	aliasOf, ok, err := mp.readTagAlias()
+	if err != nil || !ok {
+		return mp, err
+	}
+
+	target := mp
+	target.Tag = aliasOf
+	if err := target.Validate(); err != nil {
+		return ModelPath{}, err
+	}
+
+	if target.StorageTag() == mp.StorageTag() {
+		return ModelPath{}, fmt.Errorf("%w: %s -> %s", errTagAliasCycle, mp.Tag, target.Tag)
+	}
+
+	next, ok, err := target.readTagAlias()
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return ModelPath{}, fmt.Errorf("%w: %s -> %s", errTagAliasDangling, mp.Tag, target.Tag)
+	case err != nil:
+		return ModelPath{}, err
+	case ok && next == mp.StorageTag():
+		return ModelPath{}, fmt.Errorf("%w: %s -> %s -> %s", errTagAliasCycle, mp.Tag, target.Tag, next)
+	case ok:
+		return ModelPath{}, fmt.Errorf("%w: %s -> %s -> %s", errTagAliasNested, mp.Tag, target.Tag, next)
+	}
+
+	return target, nil
+}
+
+// PullSize sums the sizes of the blobs referenced by a freshly fetched
+// manifest for mp, split into those which still have to be downloaded and
+// those already present in the local store. Blobs referenced more than once
+// are only counted once.
+func (mp ModelPath) PullSize(manifestBytes []byte) (toDownload int64, alreadyPresent int64, err error) {
+	var manifest ManifestV2
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return 0, 0, fmt.Errorf("%s: %w", mp.GetShortTagname(), err)
+	}
+
+	seen := make(map[string]bool)
+	for _, layer := range append(manifest.Layers, manifest.Config) {
+		if layer == nil || seen[layer.Digest] {
+			continue
+		}
+		seen[layer.Digest] = true
+
+		blob, err := readBlobPath(layer.Digest)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if _, err := os.Stat(blob); errors.Is(err, os.ErrNotExist) {
+			toDownload += layer.Size
+		} else if err != nil {
+			return 0, 0, err
+		} else {
+			alreadyPresent += layer.Size
+		}
+	}
+
+	return toDownload, alreadyPresent, nil
+}
+
+// LocalManifestDigest returns the sha256:<hex> digest of the model's manifest
+// in the local store.
+func (mp ModelPath) LocalManifestDigest() (string, error) {
+	manifest, err := mp.readManifest()
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(manifest)), nil
+}
+
+// SameManifestAs reports whether mp and other resolve to the same manifest in
+// the local store, e.g. a tag and a digest pin of the tagged manifest. A model
+// pinned to a digest its locally stored manifest doesn't match is reported as
+// not existing.
+func (mp ModelPath) SameManifestAs(other ModelPath) (bool, error) {
+	a, err := mp.resolvedManifestDigest()
+	if err != nil {
+		return false, err
+	}
+
+	b, err := other.resolvedManifestDigest()
+	if err != nil {
+		return false, err
+	}
+
+	return DigestsEqual(a, b), nil
+}
+
+// resolvedManifestDigest returns the digest of the local manifest mp resolves
+// to, checking it against mp's digest when pinned.
+func (mp ModelPath) resolvedManifestDigest() (string, error) {
+	digest, err := mp.LocalManifestDigest()
+	if err != nil {
+		return "", err
+	}
+
+	if mp.Digest != "" && !DigestsEqual(digest, mp.Digest) {
+		return "", fmt.Errorf("%s: %w", mp, os.ErrNotExist)
+	}
+
+	return digest, nil
+}
+
+// TagManifestDigestPath returns the path of the digest-named manifest backing
+// the model's tag, i.e. GetManifestPathByDigest for the digest of the tag's
+// local manifest.
+func (mp ModelPath) TagManifestDigestPath() (string, error) {
+	digest, err := mp.LocalManifestDigest()
+	if err != nil {
+		return "", err
+	}
+
+	return mp.GetManifestPathByDigest(digest)
+}
+
+// Age returns how long ago the model's local manifest was last written.
+func (mp ModelPath) Age() (time.Duration, error) {
+	p, err := mp.manifestReadPath()
+	if err != nil {
+		return 0, err
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Since(fi.ModTime()), nil
+}
+
+// RecordPulled records the current time as when the model was last pulled
+// from its registry, in a .<tag>.pulled_at file next to its manifest. Unlike
+// the manifest's modification time, it isn't changed by copying or retagging.
+func (mp ModelPath) RecordPulled() error {
+	p, err := mp.GetManifestPath()
+	if err != nil {
+		return err
+	}
+
+	if err := mkdirAll(filepath.Dir(p)); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(pulledAtPath(p), []byte(time.Now().UTC().Format(time.RFC3339Nano)))
+}
+
+// PulledAt returns when the model was last recorded as pulled by
+// RecordPulled. ok is false if it never was, e.g. for models created locally
+// or pulled by older versions.
+func (mp ModelPath) PulledAt() (pulledAt time.Time, ok bool, err error) {
+	p, err := mp.manifestReadPath()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	b, err := os.ReadFile(pulledAtPath(p))
+	if errors.Is(err, os.ErrNotExist) {
+		return time.Time{}, false, nil
+	} else if err != nil {
+		return time.Time{}, false, err
+	}
+
+	pulledAt, err = time.Parse(time.RFC3339Nano, strings.TrimSpace(string(b)))
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	return pulledAt, true, nil
+}
+
+// pulledAtPath returns the path of the pull record of the manifest at p. It
+// is a dot file so it is never mistaken for a tag.
+func pulledAtPath(p string) string {
+	return filepath.Join(filepath.Dir(p), "."+filepath.Base(p)+".pulled_at")
+}
+
+// ShortID returns the first 12 hex characters of the local manifest digest,
+// similar to a Docker image ID.
+func (mp ModelPath) ShortID() (string, error) {
+	digest, err := mp.LocalManifestDigest()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimPrefix(digest, "sha256:")[:12], nil
+}
+
+// NeedsPull reports whether the model has to be pulled because its local
+// manifest is missing or differs from the remote manifest digest.
+func (mp ModelPath) NeedsPull(remoteDigest string) (bool, error) {
+	if !blobDigestRegEx.MatchString(remoteDigest) {
+		return false, fmt.Errorf("%w: %q", ErrInvalidDigestFormat, remoteDigest)
+	}
+
+	local, err := mp.LocalManifestDigest()
+	if errors.Is(err, os.ErrNotExist) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return !DigestsEqual(local, remoteDigest), nil
+}
+
+// manifestIndex is an OCI image index listing a manifest per platform.
+type manifestIndex struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	MediaType     string `json:"mediaType"`
+	Manifests     []struct {
+		MediaType string `json:"mediaType"`
+		Digest    string `json:"digest"`
+		Size      int64  `json:"size"`
+		Platform  *struct {
+			Architecture string `json:"architecture"`
+			OS           string `json:"os"`
+		} `json:"platform,omitempty"`
+	} `json:"manifests"`
+}
+
+var errMalformedManifest = errors.New("malformed manifest")
+
+// TotalManifestBytes returns the total size of the config and layers declared
+// by the manifest manifestBytes, e.g. for a progress bar which shouldn't rely
+// on the registry's Content-Length headers.
+func TotalManifestBytes(manifestBytes []byte) (int64, error) {
+	var m ManifestV2
+	if err := json.Unmarshal(manifestBytes, &m); err != nil {
+		return 0, fmt.Errorf("%w: %w", errMalformedManifest, err)
+	}
+
+	layers := m.Layers
+	if m.Config != nil {
+		layers = append(layers, m.Config)
+	}
+
+	var total int64
+	for i, layer := range layers {
+		if layer == nil {
+			return 0, fmt.Errorf("%w: layer %d is null", errMalformedManifest, i)
+		}
+
+		if layer.Size < 0 || total+layer.Size < total {
+			return 0, fmt.Errorf("%w: invalid size %d for %s", errMalformedManifest, layer.Size, layer.Digest)
+		}
+
+		total += layer.Size
+	}
+
+	return total, nil
+}
+
+// ValidateManifest checks that the local manifest of mp is well-formed: it
+// must parse, and its config and every layer must have a media type, a valid
+// digest and a non-negative size. The error names the offending entry.
+func (mp ModelPath) ValidateManifest() error {
+	manifestBytes, err := mp.readManifest()
+	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(manifestPath, b.Bytes(), 0o644)
+	var m ManifestV2
+	if err := json.Unmarshal(manifestBytes, &m); err != nil {
+		return fmt.Errorf("%w: %w", errMalformedManifest, err)
+	}
+
+	if m.Config == nil {
+		return fmt.Errorf("%w: no config", errMalformedManifest)
+	}
+
+	entries := []string{"config"}
+	layers := []*Layer{m.Config}
+	for i, layer := range m.Layers {
+		entries = append(entries, fmt.Sprintf("layer %d", i))
+		layers = append(layers, layer)
+	}
+
+	for i, layer := range layers {
+		switch {
+		case layer == nil:
+			return fmt.Errorf("%w: %s is null", errMalformedManifest, entries[i])
+		case layer.MediaType == "":
+			return fmt.Errorf("%w: %s has no mediaType", errMalformedManifest, entries[i])
+		case !blobDigestRegEx.MatchString(layer.Digest):
+			return fmt.Errorf("%w: %s: %w: %q", errMalformedManifest, entries[i], ErrInvalidDigestFormat, layer.Digest)
+		case layer.Size < 0:
+			return fmt.Errorf("%w: %s has negative size %d", errMalformedManifest, entries[i], layer.Size)
+		}
+	}
+
+	return nil
+}
+
+var errNoPlatformManifest = errors.New("no manifest for platform")
+
+// SelectPlatformManifest returns the digest of the manifest in the OCI index
+// indexBytes built for goos and goarch, e.g. runtime.GOOS and runtime.GOARCH.
+func SelectPlatformManifest(indexBytes []byte, goos, goarch string) (digest string, err error) {
+	var index manifestIndex
+	if err := json.Unmarshal(indexBytes, &index); err != nil {
+		return "", err
+	}
+
+	for _, m := range index.Manifests {
+		if m.Platform == nil || m.Platform.OS != goos || m.Platform.Architecture != goarch {
+			continue
+		}
+
+		if !blobDigestRegEx.MatchString(m.Digest) {
+			return "", fmt.Errorf("%w: %q", ErrInvalidDigestFormat, m.Digest)
+		}
+
+		return m.Digest, nil
+	}
+
+	return "", fmt.Errorf("%w %s/%s", errNoPlatformManifest, goos, goarch)
 }
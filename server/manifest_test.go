@@ -0,0 +1,806 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLayerDiff(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	old := writeTestModel(t, "llama3:v1", "config v1", "weights", "template v1")
+	new := writeTestModel(t, "llama3:v2", "config v2", "weights", "template v2", "license")
+
+	added, removed, shared, err := LayerDiff(ParseModelPath("llama3:v1"), ParseModelPath("llama3:v2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{new[0], new[2], new[3]}; !slices.Equal(added, want) {
+		t.Errorf("added = %v, want %v", added, want)
+	}
+
+	if want := []string{old[0], old[2]}; !slices.Equal(removed, want) {
+		t.Errorf("removed = %v, want %v", removed, want)
+	}
+
+	if want := []string{old[1]}; !slices.Equal(shared, want) {
+		t.Errorf("shared = %v, want %v", shared, want)
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		if _, _, _, err := LayerDiff(ParseModelPath("llama3:v1"), ParseModelPath("llama3:v3")); err == nil {
+			t.Fatal("expected error for missing manifest")
+		}
+	})
+}
+
+func TestResolveTagAlias(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	writeTestModel(t, "llama3:v1.4", "config", "model")
+
+	alias := func(t *testing.T, from, to string) ModelPath {
+		t.Helper()
+
+		mp := ParseModelPath(from)
+		if err := mp.writeManifest([]byte(`{"aliasOf":"` + to + `"}`)); err != nil {
+			t.Fatal(err)
+		}
+
+		return mp
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		mp, err := alias(t, "llama3:prod", "v1.4").ResolveTagAlias()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if mp.Tag != "v1.4" {
+			t.Errorf("got tag %q, want v1.4", mp.Tag)
+		}
+	})
+
+	t.Run("not an alias", func(t *testing.T) {
+		mp, err := ParseModelPath("llama3:v1.4").ResolveTagAlias()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if mp.Tag != "v1.4" {
+			t.Errorf("got tag %q, want v1.4", mp.Tag)
+		}
+	})
+
+	t.Run("dangling", func(t *testing.T) {
+		if _, err := alias(t, "llama3:beta", "v2.0").ResolveTagAlias(); !errors.Is(err, errTagAliasDangling) {
+			t.Fatalf("expected errTagAliasDangling, got %v", err)
+		}
+	})
+
+	t.Run("self cycle", func(t *testing.T) {
+		if _, err := alias(t, "llama3:loop", "loop").ResolveTagAlias(); !errors.Is(err, errTagAliasCycle) {
+			t.Fatalf("expected errTagAliasCycle, got %v", err)
+		}
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		alias(t, "llama3:ping", "pong")
+		alias(t, "llama3:pong", "ping")
+		if _, err := ParseModelPath("llama3:ping").ResolveTagAlias(); !errors.Is(err, errTagAliasCycle) {
+			t.Fatalf("expected errTagAliasCycle, got %v", err)
+		}
+	})
+
+	t.Run("nested", func(t *testing.T) {
+		alias(t, "llama3:stable", "prod")
+		if _, err := ParseModelPath("llama3:stable").ResolveTagAlias(); !errors.Is(err, errTagAliasNested) {
+			t.Fatalf("expected errTagAliasNested, got %v", err)
+		}
+	})
+}
+
+func TestPullSize(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	present := writeTestModel(t, "llama3:v1", "config", "weights")
+
+	manifest, err := json.Marshal(ManifestV2{
+		SchemaVersion: 2,
+		Config:        &Layer{Digest: present[0], Size: 6},
+		Layers: []*Layer{
+			{Digest: present[1], Size: 7},
+			{Digest: "sha256:456402914e838a953e0cf80caa6adbe75383d9e63584a964f504a7bbb8f7aad9", Size: 100},
+			{Digest: "sha256:0000000000000000000000000000000000000000000000000000000000000000", Size: 1000},
+			{Digest: "sha256:0000000000000000000000000000000000000000000000000000000000000000", Size: 1000},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	toDownload, alreadyPresent, err := ParseModelPath("llama3:v2").PullSize(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if toDownload != 1100 {
+		t.Errorf("toDownload = %d, want 1100", toDownload)
+	}
+
+	if alreadyPresent != 13 {
+		t.Errorf("alreadyPresent = %d, want 13", alreadyPresent)
+	}
+
+	if _, _, err := ParseModelPath("llama3:v2").PullSize([]byte("not json")); err == nil {
+		t.Error("expected error for malformed manifest")
+	}
+}
+
+func TestVerifyManifestDigest(t *testing.T) {
+	manifest := []byte(`{"schemaVersion":2}`)
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(manifest))
+
+	cases := []struct {
+		name     string
+		manifest []byte
+		expected string
+		err      error
+	}{
+		{"match", manifest, digest, nil},
+		{"match dash separator", manifest, strings.Replace(digest, ":", "-", 1), nil},
+		{"substituted manifest", []byte(`{"schemaVersion":1}`), digest, errDigestMismatch},
+		{"invalid digest", manifest, "sha256:1234", ErrInvalidDigestFormat},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := VerifyManifestDigest(tt.manifest, tt.expected); !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestShortID(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	writeTestModel(t, "llama3", "config", "model")
+
+	mp := ParseModelPath("llama3")
+	_, digest, err := GetManifest(mp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if local, err := mp.LocalManifestDigest(); err != nil {
+		t.Fatal(err)
+	} else if local != "sha256:"+digest {
+		t.Errorf("LocalManifestDigest = %s, want sha256:%s", local, digest)
+	}
+
+	id, err := mp.ShortID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(id) != 12 || !strings.HasPrefix(digest, id) {
+		t.Errorf("ShortID = %s, want prefix of %s", id, digest)
+	}
+
+	if _, err := ParseModelPath("missing").ShortID(); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist, got %v", err)
+	}
+}
+
+func TestRetagFrom(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	writeTestModel(t, "llama3:v1.4", "config v1.4", "model")
+	writeTestModel(t, "llama3:v1.5", "config v1.5", "model")
+
+	v14, v15 := ParseModelPath("llama3:v1.4"), ParseModelPath("llama3:v1.5")
+	old, err := v14.readManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	new, err := v15.readManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prod := ParseModelPath("llama3:prod")
+	if err := prod.RetagFrom(v14); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := prod.GetManifestPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 200 {
+			src := v14
+			if i%2 == 0 {
+				src = v15
+			}
+
+			if err := prod.RetagFrom(src); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+
+		b, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(b, old) && !bytes.Equal(b, new) {
+			t.Fatalf("read unexpected manifest %q", b)
+		}
+	}
+
+	if tags, err := prod.ListTags(); err != nil {
+		t.Fatal(err)
+	} else if want := []string{"prod", "v1.4", "v1.5"}; !slices.Equal(tags, want) {
+		t.Errorf("got tags %v, want %v", tags, want)
+	}
+
+	if err := prod.RetagFrom(ParseModelPath("llama3:missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist, got %v", err)
+	}
+}
+
+func TestNeedsPull(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	writeTestModel(t, "llama3", "config", "model")
+
+	mp := ParseModelPath("llama3")
+	local, err := mp.LocalManifestDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		mp     ModelPath
+		remote string
+		want   bool
+	}{
+		{"match", mp, local, false},
+		{"match dash separator", mp, strings.Replace(local, ":", "-", 1), false},
+		{"mismatch", mp, "sha256:0000000000000000000000000000000000000000000000000000000000000000", true},
+		{"missing local", ParseModelPath("mistral"), local, true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.mp.NeedsPull(tt.remote)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := mp.NeedsPull("latest"); !errors.Is(err, ErrInvalidDigestFormat) {
+		t.Errorf("expected ErrInvalidDigestFormat, got %v", err)
+	}
+}
+
+func TestSelectPlatformManifest(t *testing.T) {
+	amd64 := "sha256:" + strings.Repeat("a", 64)
+	arm64 := "sha256:" + strings.Repeat("b", 64)
+	index := []byte(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.oci.image.index.v1+json",
+		"manifests": [
+			{"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "` + amd64 + `", "platform": {"architecture": "amd64", "os": "linux"}},
+			{"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "` + arm64 + `", "platform": {"architecture": "arm64", "os": "darwin"}},
+			{"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:1234"}
+		]
+	}`)
+
+	cases := []struct {
+		goos, goarch string
+		digest       string
+		err          error
+	}{
+		{"linux", "amd64", amd64, nil},
+		{"darwin", "arm64", arm64, nil},
+		{"windows", "amd64", "", errNoPlatformManifest},
+		{"linux", "arm64", "", errNoPlatformManifest},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.goos+"/"+tt.goarch, func(t *testing.T) {
+			digest, err := SelectPlatformManifest(index, tt.goos, tt.goarch)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+
+			if digest != tt.digest {
+				t.Errorf("expected %s, got %s", tt.digest, digest)
+			}
+		})
+	}
+
+	if _, err := SelectPlatformManifest([]byte("not json"), "linux", "amd64"); err == nil {
+		t.Error("expected error for an invalid index")
+	}
+}
+
+func TestTotalManifestBytes(t *testing.T) {
+	manifest := []byte(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+		"config": {"mediaType": "application/vnd.docker.container.image.v1+json", "digest": "sha256:` + strings.Repeat("a", 64) + `", "size": 485},
+		"layers": [
+			{"mediaType": "application/vnd.ollama.image.model", "digest": "sha256:` + strings.Repeat("b", 64) + `", "size": 4661211424},
+			{"mediaType": "application/vnd.ollama.image.license", "digest": "sha256:` + strings.Repeat("c", 64) + `", "size": 12403},
+			{"mediaType": "application/vnd.ollama.image.template", "digest": "sha256:` + strings.Repeat("d", 64) + `", "size": 254}
+		]
+	}`)
+
+	if total, err := TotalManifestBytes(manifest); err != nil {
+		t.Fatal(err)
+	} else if want := int64(485 + 4661211424 + 12403 + 254); total != want {
+		t.Errorf("got %d, want %d", total, want)
+	}
+
+	for _, malformed := range []string{
+		"not json",
+		`{"layers": [null]}`,
+		`{"layers": [{"size": -1}]}`,
+		`{"config": {"size": 9223372036854775807}, "layers": [{"size": 1}]}`,
+	} {
+		if _, err := TotalManifestBytes([]byte(malformed)); !errors.Is(err, errMalformedManifest) {
+			t.Errorf("%s: expected errMalformedManifest, got %v", malformed, err)
+		}
+	}
+}
+
+func TestValidateManifest(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	writeTestModel(t, "llama3", "config", "model")
+
+	mp := ParseModelPath("llama3")
+	if err := mp.ValidateManifest(); err != nil {
+		t.Fatal(err)
+	}
+
+	digest := `"sha256:` + strings.Repeat("a", 64) + `"`
+	cases := []struct {
+		manifest string
+		want     string
+	}{
+		{`{"config": `, "unexpected end of JSON input"},
+		{`{"layers": []}`, "no config"},
+		{`{"config": {"mediaType": "m", "digest": ` + digest + `}, "layers": [null]}`, "layer 0 is null"},
+		{`{"config": {"digest": ` + digest + `}}`, "config has no mediaType"},
+		{`{"config": {"mediaType": "m", "digest": ` + digest + `}, "layers": [{"mediaType": "m", "digest": "sha256:abc"}]}`, `layer 0: invalid digest format: "sha256:abc"`},
+		{`{"config": {"mediaType": "m", "digest": ` + digest + `, "size": -1}}`, "config has negative size -1"},
+	}
+
+	for _, tt := range cases {
+		if err := mp.writeManifest([]byte(tt.manifest)); err != nil {
+			t.Fatal(err)
+		}
+
+		err := mp.ValidateManifest()
+		if !errors.Is(err, errMalformedManifest) || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want %q", tt.manifest, err, tt.want)
+		}
+	}
+
+	if err := mp.writeManifest([]byte(`{"config": {"mediaType": "m", "digest": "sha256-x"}}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mp.ValidateManifest(); !errors.Is(err, ErrInvalidDigestFormat) {
+		t.Errorf("expected ErrInvalidDigestFormat, got %v", err)
+	}
+}
+
+func TestWriteManifestIfChanged(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	mp := ParseModelPath("llama3")
+	manifest := []byte(`{"schemaVersion":2,"layers":[]}`)
+
+	// a missing manifest is written
+	if changed, err := mp.WriteManifestIfChanged(manifest); err != nil {
+		t.Fatal(err)
+	} else if !changed {
+		t.Error("expected a missing manifest to be written")
+	}
+
+	p, err := mp.GetManifestPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(p, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	// an identical manifest is left alone
+	if changed, err := mp.WriteManifestIfChanged(manifest); err != nil {
+		t.Fatal(err)
+	} else if changed {
+		t.Error("expected an identical manifest not to be written")
+	}
+
+	if fi, err := os.Stat(p); err != nil {
+		t.Fatal(err)
+	} else if !fi.ModTime().Equal(old) {
+		t.Errorf("mtime changed to %v, want %v", fi.ModTime(), old)
+	}
+
+	// a different manifest replaces it
+	updated := []byte(`{"schemaVersion":2,"layers":[{}]}`)
+	if changed, err := mp.WriteManifestIfChanged(updated); err != nil {
+		t.Fatal(err)
+	} else if !changed {
+		t.Error("expected a changed manifest to be written")
+	}
+
+	if b, err := os.ReadFile(p); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(b, updated) {
+		t.Errorf("got %s, want %s", b, updated)
+	}
+
+	// retagging onto an identical tag doesn't write either
+	if err := os.Chtimes(p, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	src := ParseModelPath("llama3:copy")
+	if err := src.writeManifest(updated); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mp.RetagFrom(src); err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, err := os.Stat(p); err != nil {
+		t.Fatal(err)
+	} else if !fi.ModTime().Equal(old) {
+		t.Errorf("mtime changed to %v, want %v", fi.ModTime(), old)
+	}
+}
+
+func TestWriteManifestUnchanged(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	config, layer := writeTestBlob(t, "config"), writeTestBlob(t, "model")
+	if err := WriteManifest("llama3", config, []*Layer{layer}); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := ParseModelPath("llama3").GetManifestPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(p, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteManifest("llama3", config, []*Layer{layer}); err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, err := os.Stat(p); err != nil {
+		t.Fatal(err)
+	} else if !fi.ModTime().Equal(old) {
+		t.Errorf("mtime changed to %v, want %v", fi.ModTime(), old)
+	}
+
+	if err := WriteManifest("llama3", config, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if m, _, err := GetManifest(ParseModelPath("llama3")); err != nil {
+		t.Fatal(err)
+	} else if len(m.Layers) != 0 {
+		t.Errorf("expected the changed manifest to be written, got %d layers", len(m.Layers))
+	}
+}
+
+func TestAge(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	writeTestModel(t, "llama3", "config", "model")
+
+	mp := ParseModelPath("llama3")
+	p, err := mp.GetManifestPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backdated := time.Now().Add(-31 * 24 * time.Hour)
+	if err := os.Chtimes(p, backdated, backdated); err != nil {
+		t.Fatal(err)
+	}
+
+	age, err := mp.Age()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if age < 31*24*time.Hour || age > 31*24*time.Hour+time.Minute {
+		t.Errorf("Age = %s, want about 31 days", age)
+	}
+
+	if _, err := ParseModelPath("missing").Age(); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist, got %v", err)
+	}
+}
+
+func TestPulledAt(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	writeTestModel(t, "llama3", "config", "model")
+
+	mp := ParseModelPath("llama3")
+	if pulledAt, ok, err := mp.PulledAt(); err != nil {
+		t.Fatal(err)
+	} else if ok || !pulledAt.IsZero() {
+		t.Errorf("expected no pull record, got %s", pulledAt)
+	}
+
+	before := time.Now()
+	if err := mp.RecordPulled(); err != nil {
+		t.Fatal(err)
+	}
+
+	pulledAt, ok, err := mp.PulledAt()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !ok || pulledAt.Before(before.Add(-time.Second)) || pulledAt.After(time.Now()) {
+		t.Errorf("PulledAt = %s, %t, want about %s", pulledAt, ok, before)
+	}
+
+	if tags, err := mp.ListTags(); err != nil {
+		t.Fatal(err)
+	} else if len(tags) != 1 {
+		t.Errorf("expected the pull record not to be listed as a tag, got %v", tags)
+	}
+
+	p, err := mp.GetManifestPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteModel("llama3"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(pulledAtPath(p)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the pull record to be removed with the model, got %v", err)
+	}
+}
+
+func TestSameManifestAs(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	writeTestModel(t, "llama3", "config", "model")
+	writeTestModel(t, "llama3:8b", "config", "model")
+	writeTestModel(t, "llama3:70b", "config 70b", "model 70b")
+
+	tag := ParseModelPath("llama3")
+	digest, err := tag.LocalManifestDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pinned := ParseModelPath("llama3@" + digest)
+
+	cases := []struct {
+		name string
+		a, b ModelPath
+		want bool
+	}{
+		{"tag and digest pin", tag, pinned, true},
+		{"tags of the same manifest", tag, ParseModelPath("llama3:8b"), true},
+		{"different manifests", tag, ParseModelPath("llama3:70b"), false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			same, err := tt.a.SameManifestAs(tt.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if same != tt.want {
+				t.Errorf("SameManifestAs = %v, want %v", same, tt.want)
+			}
+		})
+	}
+
+	stale := ParseModelPath("llama3@sha256:" + strings.Repeat("0", 64))
+	if _, err := tag.SameManifestAs(stale); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist for a stale pin, got %v", err)
+	}
+}
+
+func TestTagManifestDigestPath(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	writeTestModel(t, "llama3:8b", "config", "model")
+
+	mp := ParseModelPath("llama3:8b")
+	digest, err := mp.LocalManifestDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := mp.TagManifestDigestPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := mp.GetManifestPathByDigest(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p != want {
+		t.Errorf("got %s, want %s", p, want)
+	}
+
+	tagPath, err := mp.GetManifestPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if filepath.Dir(p) != filepath.Dir(tagPath) || filepath.Base(p) != strings.Replace(digest, ":", "-", 1) {
+		t.Errorf("expected %s next to %s", p, tagPath)
+	}
+
+	// a digest-named manifest isn't a tag
+	manifest, err := mp.readManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(p, manifest, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if tags, err := mp.ListTags(); err != nil {
+		t.Fatal(err)
+	} else if !slices.Equal(tags, []string{"8b"}) {
+		t.Errorf("ListTags = %v, want [8b]", tags)
+	}
+
+	if mps, err := ListModelPaths(); err != nil {
+		t.Fatal(err)
+	} else if len(mps) != 1 {
+		t.Errorf("ListModelPaths = %v, want only llama3:8b", mps)
+	}
+
+	if _, err := ParseModelPath("missing").TagManifestDigestPath(); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist, got %v", err)
+	}
+
+	if _, err := mp.GetManifestPathByDigest("sha256:1234"); !errors.Is(err, ErrInvalidDigestFormat) {
+		t.Errorf("expected ErrInvalidDigestFormat, got %v", err)
+	}
+}
+
+func TestGetManifestPathDigestOnly(t *testing.T) {
+	models := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", models)
+
+	writeTestModel(t, "llama3:8b", "config", "model")
+
+	tagged := ParseModelPath("llama3:8b")
+	digest, err := tagged.LocalManifestDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := tagged.readManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mp := ParseModelPath("llama3@" + digest)
+	if mp.Tag != "" {
+		t.Fatalf("expected no tag for a digest-only reference, got %q", mp.Tag)
+	}
+
+	// before the digest-named copy exists, the pin reads the matching tag
+	if b, err := mp.readManifest(); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(b, manifest) {
+		t.Errorf("got %s, want %s", b, manifest)
+	}
+
+	// writing a pinned model, as a pinned pull does, leaves the latest tag
+	// alone
+	writeTestModel(t, "llama3", "latest config", "model")
+	latest, err := ParseModelPath("llama3").readManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mp.writeManifest(manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := ParseModelPath("llama3").readManifest(); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(b, latest) {
+		t.Error("writing a digest-only reference overwrote the latest tag")
+	}
+
+	p, err := mp.GetManifestPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := filepath.Join(models, "manifests", DefaultRegistry, DefaultNamespace, "llama3", strings.Replace(digest, ":", "-", 1)); p != want {
+		t.Errorf("got %s, want %s", p, want)
+	}
+
+	if err := os.WriteFile(p, manifest, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := mp.SameManifestAs(tagged); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Error("expected the digest-only reference to resolve to the tagged manifest")
+	}
+
+	// a tag takes precedence over the digest
+	mp.Tag = "8b"
+	if p, err := mp.GetManifestPath(); err != nil {
+		t.Fatal(err)
+	} else if filepath.Base(p) != "8b" {
+		t.Errorf("expected the tag's manifest path, got %s", p)
+	}
+
+	mp.Tag, mp.Digest = "", "sha256:1234"
+	if _, err := mp.GetManifestPath(); !errors.Is(err, ErrInvalidDigestFormat) {
+		t.Errorf("expected ErrInvalidDigestFormat, got %v", err)
+	}
+}
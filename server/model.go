@@ -50,7 +50,7 @@ func parseFromModel(ctx context.Context, name model.Name, fn func(api.ProgressRe
 		case "application/vnd.ollama.image.model",
 			"application/vnd.ollama.image.projector",
 			"application/vnd.ollama.image.adapter":
-			blobpath, err := GetBlobsPath(layer.Digest)
+			blobpath, err := readBlobPath(layer.Digest)
 			if err != nil {
 				return nil, err
 			}
@@ -169,7 +169,7 @@ func parseFromZipFile(_ context.Context, file *os.File, fn func(api.ProgressResp
 		return nil, fmt.Errorf("aaa: %w", err)
 	}
 
-	blobpath, err := GetBlobsPath(layer.Digest)
+	blobpath, err := readBlobPath(layer.Digest)
 	if err != nil {
 		return nil, err
 	}
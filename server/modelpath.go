@@ -1,13 +1,26 @@
 package server
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"strings"
+	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ollama/ollama/server/envconfig"
 )
 
 type ModelPath struct {
@@ -16,6 +29,8 @@ type ModelPath struct {
 	Namespace      string
 	Repository     string
 	Tag            string
+	// Digest pins the model to a specific manifest, e.g. repo@sha256:<hex>
+	Digest string
 }
 
 const (
@@ -30,11 +45,54 @@ var (
 	ErrInvalidProtocol     = errors.New("invalid protocol scheme")
 	ErrInsecureProtocol    = errors.New("insecure protocol http")
 	ErrInvalidDigestFormat = errors.New("invalid digest format")
+	ErrAmbiguousTag        = errors.New("ambiguous tag")
+	ErrRegistryOnly        = errors.New("reference has a registry but no repository")
 )
 
 // blobDigestRegEx only accept actual sha256 digests
 var blobDigestRegEx = regexp.MustCompile("^sha256[:-][0-9a-fA-F]{64}$")
 
+// storeDigestRegEx accepts the digests of every algorithm blobs may be stored
+// under. Only sha256 blobs can be verified so far.
+var storeDigestRegEx = regexp.MustCompile("^(sha256[:-][0-9a-fA-F]{64}|sha512[:-][0-9a-fA-F]{128})$")
+
+// DigestsEqual reports whether a and b are the same sha256 digest. Both are
+// normalized to the canonical lowercase sha256:<hex> form, so either separator
+// and any hex case are accepted, and compared in constant time. Malformed
+// digests are never equal.
+func DigestsEqual(a, b string) bool {
+	if !blobDigestRegEx.MatchString(a) || !blobDigestRegEx.MatchString(b) {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(canonicalDigest(a)), []byte(canonicalDigest(b))) == 1
+}
+
+// ParseBlobRef parses a bare digest reference to a blob, e.g. sha256:<hex>,
+// and returns it in canonical sha256:<hex> form. Model references, including
+// ones pinned by digest, are rejected with ErrInvalidDigestFormat.
+func ParseBlobRef(s string) (digest string, err error) {
+	if !blobDigestRegEx.MatchString(s) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidDigestFormat, s)
+	}
+
+	return canonicalDigest(s), nil
+}
+
+// canonicalDigest converts a digest to lowercase sha256:<hex> form. It does not
+// validate the digest.
+func canonicalDigest(digest string) string {
+	return strings.ToLower(strings.Replace(digest, "-", ":", 1))
+}
+
+// ParseModelPath parses a model reference such as llama3, jmorganca/llama3:8b
+// or example.com/ns/model@sha256:<hex>, filling in defaults for what it
+// omits. The namespace of a name without one depends on its registry, see
+// defaultNamespace: llama3 is library/llama3 on the default registry while
+// localhost:5000/model is a repository at the root of localhost:5000. Since a
+// two component name such as example.com/model is a namespace and repository
+// on the default registry, use ParseModelPathWithOptions with RootRepositories
+// to treat it as a root repository of example.com instead.
 func ParseModelPath(name string) ModelPath {
 	mp := ModelPath{
 		ProtocolScheme: DefaultProtocolScheme,
@@ -50,18 +108,41 @@ func ParseModelPath(name string) ModelPath {
 		name = after
 	}
 
-	name = strings.ReplaceAll(name, string(os.PathSeparator), "/")
+	name = normalizeSeparators(name, os.PathSeparator)
 	parts := strings.Split(name, "/")
-	switch len(parts) {
-	case 3:
+	namespaced := true
+	switch {
+	case len(parts) > 3 && isRegistryHost(parts[0]):
+		// registries such as ghcr.io allow nested namespaces, e.g.
+		// ghcr.io/org/team/model, so everything between the registry and the
+		// repository is folded into the namespace
+		mp.Registry = parts[0]
+		mp.Namespace = strings.Join(parts[1:len(parts)-1], "/")
+		mp.Repository = parts[len(parts)-1]
+	case len(parts) == 3:
 		mp.Registry = parts[0]
 		mp.Namespace = parts[1]
 		mp.Repository = parts[2]
-	case 2:
+	case len(parts) == 2 && (strings.Contains(parts[0], ":") || parts[0] == "localhost"):
+		// a host with a port, e.g. localhost:5000/llama3, can't be a namespace
+		mp.Registry = parts[0]
+		mp.Repository = parts[1]
+		namespaced = false
+	case len(parts) == 2:
 		mp.Namespace = parts[0]
 		mp.Repository = parts[1]
-	case 1:
+	case len(parts) == 1:
 		mp.Repository = parts[0]
+		namespaced = false
+	}
+
+	if repo, digest, found := strings.Cut(mp.Repository, "@"); found {
+		mp.Repository = repo
+		mp.Digest = digest
+
+		// a model pinned only by digest has no tag; it is stored under its
+		// digest-named manifest rather than overwriting the default tag
+		mp.Tag = ""
 	}
 
 	if repo, tag, found := strings.Cut(mp.Repository, ":"); found {
@@ -69,106 +150,1480 @@ func ParseModelPath(name string) ModelPath {
 		mp.Tag = tag
 	}
 
+	// references passed through URLs may be percent-encoded; decode each
+	// component only after splitting so an encoded '/' or ':' can't introduce
+	// new components, and leave it to Validate to reject what they decode to
+	mp.Namespace = unescapeNamespace(mp.Namespace)
+	mp.Repository = unescapeComponent(mp.Repository)
+	mp.Tag = unescapeComponent(mp.Tag)
+	mp.Digest = unescapeComponent(mp.Digest)
+
+	if canonical, ok := registryAliases[strings.ToLower(mp.Registry)]; ok {
+		mp.Registry = canonical
+	}
+
+	if !namespaced {
+		mp.Namespace = mp.defaultNamespace()
+	}
+
 	return mp
 }
 
-var errModelPathInvalid = errors.New("invalid model path")
+// normalizeSeparators replaces sep, the platform's path separator, with '/' in
+// the path portion of name, e.g. library\llama3:v1.0 pasted on Windows. Any in
+// the tag or digest are left alone, so they are rejected by Validate rather
+// than splitting the tag into extra components.
+func normalizeSeparators(name string, sep rune) string {
+	if sep == '/' {
+		return name
+	}
 
-func (mp ModelPath) Validate() error {
-	if mp.Repository == "" {
-		return fmt.Errorf("%w: model repository name is required", errModelPathInvalid)
+	end, _, _ := strings.Cut(name, "@")
+	if i := strings.LastIndex(end, ":"); i >= 0 && !isRegistryPort(end, i, sep) {
+		end = end[:i]
 	}
 
-	if strings.Contains(mp.Tag, ":") {
-		return fmt.Errorf("%w: ':' (colon) is not allowed in tag names", errModelPathInvalid)
+	return strings.ReplaceAll(end, string(sep), "/") + name[len(end):]
+}
+
+// isRegistryPort reports whether the colon at i in name separates a registry
+// host from its port, e.g. localhost:5000\llama3, rather than starting a tag.
+func isRegistryPort(name string, i int, sep rune) bool {
+	if strings.ContainsAny(name[:i], "/"+string(sep)) {
+		return false
 	}
 
-	return nil
+	port, _, found := strings.Cut(strings.ReplaceAll(name[i+1:], string(sep), "/"), "/")
+	return found && port != "" && strings.Trim(port, "0123456789") == ""
 }
 
-func (mp ModelPath) GetNamespaceRepository() string {
-	return fmt.Sprintf("%s/%s", mp.Namespace, mp.Repository)
+// unescapeComponent percent-decodes s, returning it unchanged if it isn't
+// validly encoded.
+func unescapeComponent(s string) string {
+	if u, err := url.PathUnescape(s); err == nil {
+		return u
+	}
+
+	return s
 }
 
-func (mp ModelPath) GetFullTagname() string {
-	return fmt.Sprintf("%s/%s/%s:%s", mp.Registry, mp.Namespace, mp.Repository, mp.Tag)
+// unescapeNamespace percent-decodes each '/' separated segment of the namespace
+// ns. A segment decoding to a '/' is left encoded, since decoding it would add
+// a level to the namespace, for Validate to reject.
+func unescapeNamespace(ns string) string {
+	segments := strings.Split(ns, "/")
+	for i, segment := range segments {
+		if u := unescapeComponent(segment); !strings.Contains(u, "/") {
+			segments[i] = u
+		}
+	}
+
+	return strings.Join(segments, "/")
 }
 
-func (mp ModelPath) GetShortTagname() string {
-	if mp.Registry == DefaultRegistry {
-		if mp.Namespace == DefaultNamespace {
-			return fmt.Sprintf("%s:%s", mp.Repository, mp.Tag)
+// registryAliases maps hosts users commonly type in place of a registry to the
+// registry they mean.
+var registryAliases = map[string]string{
+	"ollama.ai":  DefaultRegistry,
+	"ollama.com": DefaultRegistry,
+}
+
+// isRegistryHost reports whether s looks like a registry host rather than a
+// namespace, i.e. it contains a domain separator or a port, or is localhost.
+func isRegistryHost(s string) bool {
+	return strings.ContainsAny(s, ".:") || s == "localhost"
+}
+
+// tldRegEx matches the last label of a domain name, which unlike the last
+// part of a versioned name such as llama3.1 is never numeric.
+var tldRegEx = regexp.MustCompile(`\.[a-zA-Z]{2,}$`)
+
+// isHostPort reports whether s is a registry address with a port, e.g.
+// localhost:5000 or myregistry.com:5000, which on its own would parse as a
+// repository tagged with the port. The host has to be local, an IP address or
+// a domain name, so names such as llama3.1:8 aren't mistaken for one.
+func isHostPort(s string) bool {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil || port == "" || strings.Trim(port, "0123456789") != "" {
+		return false
+	}
+
+	return isLocalHost(host) || net.ParseIP(host) != nil || tldRegEx.MatchString(host)
+}
+
+// ParseOptions controls how ParseModelPathWithOptions interprets a name.
+type ParseOptions struct {
+	// RequireTLS rejects references with an explicit http scheme unless they
+	// point at the local machine. It is implied by OLLAMA_REQUIRE_TLS.
+	RequireTLS bool
+
+	// RootRepositories parses two component names whose first component is
+	// a registry host, e.g. myregistry.com/model, as a repository at the
+	// root of that registry with an empty namespace rather than as a
+	// namespace and repository on the default registry. The default
+	// registry has no root repositories, so its namespace stays library.
+	RootRepositories bool
+
+	// AllowPlusInTags accepts '+' in tags, e.g. v1.0+cuda12 carrying semver
+	// build metadata, for registries which permit it. Docker and the OCI
+	// distribution spec don't, so such tags are rejected by default, here
+	// and by Validate, and IsPortable warns about them either way.
+	AllowPlusInTags bool
+}
+
+// ParseModelPathWithOptions parses name like ParseModelPath and additionally
+// enforces opts. It returns ErrInvalidProtocol for schemes other than http and
+// https, ErrInsecureProtocol for http when TLS is required,
+// ErrInvalidDigestFormat when the part after '@' isn't a digest,
+// ErrRegistryOnly for a bare registry address such as localhost:5000,
+// and errModelPathInvalid for a '+' in the tag unless AllowPlusInTags is set.
+func ParseModelPathWithOptions(name string, opts ParseOptions) (ModelPath, error) {
+	mp := ParseModelPath(name)
+
+	switch mp.ProtocolScheme {
+	case "https":
+	case "http":
+		if err := requireTLS(mp.ProtocolScheme, mp.Registry, opts.RequireTLS); err != nil {
+			return ModelPath{}, err
+		}
+	default:
+		return ModelPath{}, fmt.Errorf("%w: %s", ErrInvalidProtocol, mp.ProtocolScheme)
+	}
+
+	if mp.Digest != "" && !blobDigestRegEx.MatchString(mp.Digest) {
+		return ModelPath{}, fmt.Errorf("%w: %q after '@' is not a digest", ErrInvalidDigestFormat, mp.Digest)
+	}
+
+	if err := validatePlusInTag(mp.Tag, opts); err != nil {
+		return ModelPath{}, err
+	}
+
+	// a registry address on its own, e.g. localhost:5000, would otherwise
+	// parse as a repository tagged with the port
+	if isHostPort(strings.TrimPrefix(name, mp.ProtocolScheme+"://")) {
+		return ModelPath{}, fmt.Errorf("%w: %s, is the reference truncated?", ErrRegistryOnly, name)
+	}
+
+	if opts.RootRepositories {
+		if _, after, found := strings.Cut(name, "://"); found {
+			name = after
+		}
+
+		parts := strings.Split(normalizeSeparators(name, os.PathSeparator), "/")
+		if len(parts) == 2 && isRegistryHost(parts[0]) {
+			mp.Registry = parts[0]
+			if canonical, ok := registryAliases[strings.ToLower(mp.Registry)]; ok {
+				mp.Registry = canonical
+			}
+
+			mp.Namespace = mp.defaultNamespace()
 		}
-		return fmt.Sprintf("%s/%s:%s", mp.Namespace, mp.Repository, mp.Tag)
 	}
-	return fmt.Sprintf("%s/%s/%s:%s", mp.Registry, mp.Namespace, mp.Repository, mp.Tag)
+
+	return mp, nil
 }
 
-// modelsDir returns the value of the OLLAMA_MODELS environment variable or the user's home directory if OLLAMA_MODELS is not set.
-// The models directory is where Ollama stores its model files and manifests.
-func modelsDir() (string, error) {
-	if models, exists := os.LookupEnv("OLLAMA_MODELS"); exists {
-		return models, nil
+// requireTLS returns ErrInsecureProtocol for plain http to host if TLS is
+// required, i.e. required or OLLAMA_REQUIRE_TLS is set, unless host is the
+// local machine. Every registry request is checked with it.
+func requireTLS(scheme, host string, required bool) error {
+	if scheme == "http" && (required || envconfig.RequireTLS) && !isLocalHost(host) {
+		return fmt.Errorf("%w: %s", ErrInsecureProtocol, host)
 	}
-	home, err := os.UserHomeDir()
-	if err != nil {
-		return "", err
+
+	return nil
+}
+
+// isLocalHost reports whether host, with or without a port, refers to the
+// loopback interface.
+func isLocalHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
 	}
-	return filepath.Join(home, ".ollama", "models"), nil
+
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
 
-// GetManifestPath returns the path to the manifest file for the given model path, it is up to the caller to create the directory if it does not exist.
-func (mp ModelPath) GetManifestPath() (string, error) {
-	dir, err := modelsDir()
-	if err != nil {
-		return "", err
+// defaultNamespace returns the namespace of names which don't spell one out on
+// the model's registry: the one configured for it in OLLAMA_DEFAULT_NAMESPACES,
+// if any, otherwise library on the default registry, however it is spelled,
+// and none, i.e. a root repository, on other registries, where library is
+// rarely meaningful.
+func (mp ModelPath) defaultNamespace() string {
+	if namespace, ok := mp.configuredNamespace(); ok {
+		return namespace
 	}
 
-	return filepath.Join(dir, "manifests", mp.Registry, mp.Namespace, mp.Repository, mp.Tag), nil
+	if strings.EqualFold(mp.aliasedRegistry(), DefaultRegistry) {
+		return DefaultNamespace
+	}
+
+	return ""
 }
 
-func (mp ModelPath) BaseURL() *url.URL {
-	return &url.URL{
-		Scheme: mp.ProtocolScheme,
-		Host:   mp.Registry,
+// configuredNamespace returns the default namespace OLLAMA_DEFAULT_NAMESPACES
+// sets for the model's registry. Registries match however they are spelled,
+// e.g. ollama.com for registry.ollama.ai or with the default port.
+func (mp ModelPath) configuredNamespace() (string, bool) {
+	registry := mp.aliasedRegistry()
+	for host, namespace := range envconfig.DefaultNamespaces {
+		if strings.EqualFold(ModelPath{ProtocolScheme: mp.ProtocolScheme, Registry: host}.aliasedRegistry(), registry) {
+			return namespace, true
+		}
 	}
+
+	return "", false
 }
 
-func GetManifestPath() (string, error) {
-	dir, err := modelsDir()
-	if err != nil {
-		return "", err
+// aliasedRegistry returns canonicalRegistry with aliases of the default
+// registry resolved.
+func (mp ModelPath) aliasedRegistry() string {
+	registry := mp.canonicalRegistry()
+	if canonical, ok := registryAliases[registry]; ok {
+		return canonical
 	}
 
-	path := filepath.Join(dir, "manifests")
-	if err := os.MkdirAll(path, 0o755); err != nil {
-		return "", err
+	return registry
+}
+
+// RefBuilder assembles a ModelPath field by field, e.g.
+//
+//	mp, err := NewRef().Namespace("jmorganca").Repository("llama3").Build()
+type RefBuilder struct {
+	mp ModelPath
+}
+
+// NewRef returns an empty RefBuilder.
+func NewRef() *RefBuilder {
+	return &RefBuilder{}
+}
+
+func (b *RefBuilder) Registry(registry string) *RefBuilder {
+	b.mp.Registry = registry
+	return b
+}
+
+func (b *RefBuilder) Namespace(namespace string) *RefBuilder {
+	b.mp.Namespace = namespace
+	return b
+}
+
+func (b *RefBuilder) Repository(repository string) *RefBuilder {
+	b.mp.Repository = repository
+	return b
+}
+
+func (b *RefBuilder) Tag(tag string) *RefBuilder {
+	b.mp.Tag = tag
+	return b
+}
+
+// Build fills in defaults for any fields which weren't set and returns the
+// validated ModelPath. The namespace defaults to the registry's, see
+// defaultNamespace.
+func (b *RefBuilder) Build() (ModelPath, error) {
+	mp := b.mp
+	for _, f := range []struct {
+		field *string
+		value string
+	}{
+		{&mp.ProtocolScheme, DefaultProtocolScheme},
+		{&mp.Registry, DefaultRegistry},
+	} {
+		if *f.field == "" {
+			*f.field = f.value
+		}
 	}
 
-	return path, nil
+	// models pinned only by digest stay untagged, see ParseModelPath
+	if mp.Tag == "" && mp.Digest == "" {
+		mp.Tag = DefaultTag
+	}
+
+	if mp.Namespace == "" {
+		mp.Namespace = mp.defaultNamespace()
+	}
+
+	if err := mp.Validate(); err != nil {
+		return ModelPath{}, err
+	}
+
+	return mp, nil
 }
 
-// GetBlobsPath returns the path to a file in the model directory given its SHA256 digest
-// It returns ErrInvalidDigestFormat if the digest is not valid.
-func GetBlobsPath(digest string) (path string, err error) {
-	dir, err := modelsDir()
+// CanonicalizeRef parses and validates name and returns its canonical short
+// form, e.g. "Registry.Ollama.AI/library/llama3:" becomes "llama3:latest".
+// Empty components are filled with their defaults, the registry host is
+// lowercased and a pinned digest is converted to sha256:<hex> form.
+func CanonicalizeRef(name string) (string, error) {
+	mp, err := ParseModelPathWithOptions(name, ParseOptions{})
 	if err != nil {
 		return "", err
 	}
-	dir = filepath.Join(dir, "blobs")
-	if digest != "" {
-		if !blobDigestRegEx.MatchString(digest) {
+
+	if mp.Digest != "" {
+		if !blobDigestRegEx.MatchString(mp.Digest) {
 			return "", ErrInvalidDigestFormat
 		}
-		digest = strings.ReplaceAll(digest, ":", "-")
-		path = filepath.Join(dir, digest)
-	} else {
-		path = dir
+
+		mp.Digest = canonicalDigest(mp.Digest)
 	}
 
-	if err := os.MkdirAll(dir, 0o755); err != nil {
+	mp.Registry = strings.ToLower(mp.Registry)
+	mp, err = (&RefBuilder{mp: mp}).Build()
+	if err != nil {
 		return "", err
 	}
 
-	return path, nil
+	s := mp.GetShortTagname()
+	if mp.Digest != "" {
+		s += "@" + mp.Digest
+	}
+
+	return s, nil
+}
+
+// ValidateFromReference parses and validates the model reference of a
+// Modelfile FROM line, e.g. "FROM llama3:8b", so mistakes are reported with
+// the offending line before a build starts. Local files, e.g. FROM
+// ./model.gguf, aren't model references and are rejected.
+func ValidateFromReference(line string) (ModelPath, error) {
+	fields := strings.Fields(line)
+	if len(fields) > 0 && strings.EqualFold(fields[0], "FROM") {
+		fields = fields[1:]
+	}
+
+	switch {
+	case len(fields) == 0:
+		return ModelPath{}, fmt.Errorf("%q: %w: FROM requires a model reference", line, errModelPathInvalid)
+	case len(fields) > 1:
+		return ModelPath{}, fmt.Errorf("%q: %w: unexpected %q after the model reference", line, errModelPathInvalid, strings.Join(fields[1:], " "))
+	case strings.HasPrefix(fields[0], ".") || strings.HasPrefix(fields[0], "~") || filepath.IsAbs(fields[0]):
+		return ModelPath{}, fmt.Errorf("%q: %w: %s is a file path, not a model reference", line, errModelPathInvalid, fields[0])
+	}
+
+	mp, err := ParseModelPathWithOptions(fields[0], ParseOptions{})
+	if err != nil {
+		return ModelPath{}, fmt.Errorf("%q: %w", line, err)
+	}
+
+	if err := mp.Validate(); err != nil {
+		return ModelPath{}, fmt.Errorf("%q: %w", line, err)
+	}
+
+	return mp, nil
+}
+
+// ParseModelPaths parses and validates a list of model references, one per
+// line, e.g. a file of models to pull. Blank lines and lines starting with '#'
+// are skipped. References which fail to parse are reported in errs, prefixed
+// with their line number, and left out of mps.
+func ParseModelPaths(r io.Reader) (mps []ModelPath, errs []error) {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		mp, err := ParseModelPathWithOptions(line, ParseOptions{})
+		if err == nil {
+			err = mp.Validate()
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", n, err))
+			continue
+		}
+
+		mps = append(mps, mp)
+	}
+
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return mps, errs
+}
+
+var errModelPathInvalid = errors.New("invalid model path")
+
+// Validate checks that mp names a model which can be stored locally and
+// pushed to a registry following the Docker conventions, so it rejects a '+'
+// in the tag; use ValidateWithOptions to accept one.
+func (mp ModelPath) Validate() error {
+	return mp.ValidateWithOptions(ParseOptions{})
+}
+
+// ValidateWithOptions is Validate, accepting a '+' in the tag if
+// opts.AllowPlusInTags is set. The other options only affect parsing.
+func (mp ModelPath) ValidateWithOptions(opts ParseOptions) error {
+	if mp.Repository == "" {
+		// e.g. registry.ollama.ai/, which parses the host as a namespace
+		if registry := mp.Registry; registry != DefaultRegistry || isRegistryHost(mp.Namespace) {
+			if registry == DefaultRegistry {
+				registry = mp.Namespace
+			}
+
+			return fmt.Errorf("%w: %w: %s, is the reference truncated?", errModelPathInvalid, ErrRegistryOnly, registry)
+		}
+
+		return fmt.Errorf("%w: model repository name is required", errModelPathInvalid)
+	}
+
+	// e.g. myregistry.com:5000, which parses the host as a repository tagged
+	// with the port
+	if mp.canonicalRegistry() == DefaultRegistry && mp.Namespace == DefaultNamespace && isHostPort(mp.Repository+":"+mp.Tag) {
+		return fmt.Errorf("%w: %w: %s:%s, is the reference truncated?", errModelPathInvalid, ErrRegistryOnly, mp.Repository, mp.Tag)
+	}
+
+	for _, c := range []struct {
+		kind, value string
+	}{
+		{"registry", mp.Registry},
+		{"namespace", mp.Namespace},
+		{"repository", mp.Repository},
+		{"tag", mp.Tag},
+		{"digest", mp.Digest},
+	} {
+		if !utf8.ValidString(c.value) {
+			return fmt.Errorf("%w: %s is not valid UTF-8", errModelPathInvalid, c.kind)
+		}
+
+		if strings.ContainsFunc(c.value, unicode.IsControl) {
+			return fmt.Errorf("%w: control characters are not allowed in %s names", errModelPathInvalid, c.kind)
+		}
+	}
+
+	if err := validatePathComponents(mp); err != nil {
+		return err
+	}
+
+	if err := validatePlusInTag(mp.Tag, opts); err != nil {
+		return err
+	}
+
+	if strings.Contains(mp.Tag, ":") {
+		return fmt.Errorf("%w: ':' (colon) is not allowed in tag names", errModelPathInvalid)
+	}
+
+	if strings.Contains(mp.Repository, "/") {
+		return fmt.Errorf("%w: '/' (slash) is not allowed in repository names", errModelPathInvalid)
+	}
+
+	if strings.Contains(mp.Tag, "/") {
+		return fmt.Errorf("%w: '/' (slash) is not allowed in tag names", errModelPathInvalid)
+	}
+
+	if strings.Contains(mp.Tag, `\`) {
+		return fmt.Errorf("%w: '\\' (backslash) is not allowed in tag names", errModelPathInvalid)
+	}
+
+	if isReservedTag(mp.Tag) {
+		return fmt.Errorf("%w: %q is a reserved tag name", errModelPathInvalid, mp.Tag)
+	}
+
+	if mp.Digest != "" && !blobDigestRegEx.MatchString(mp.Digest) {
+		// e.g. repo@latest, where a tag was meant
+		return fmt.Errorf("%w: %q after '@' is not a digest", ErrInvalidDigestFormat, mp.Digest)
+	}
+
+	return nil
+}
+
+// validatePlusInTag rejects a '+' in tag unless opts.AllowPlusInTags is set.
+func validatePlusInTag(tag string, opts ParseOptions) error {
+	if !opts.AllowPlusInTags && strings.Contains(tag, "+") {
+		return fmt.Errorf("%w: '+' (plus) is not allowed in tag names", errModelPathInvalid)
+	}
+
+	return nil
+}
+
+// validatePathComponents checks that no component of the model's name, nor
+// any '/' separated segment of its namespace, can step outside the directory
+// it becomes in the manifest path, e.g. a namespace of ../../escape.
+func validatePathComponents(mp ModelPath) error {
+	components := []struct {
+		kind, value string
+	}{
+		{"registry", mp.Registry},
+	}
+
+	if mp.Namespace != "" {
+		for _, segment := range strings.Split(mp.Namespace, "/") {
+			if segment == "" {
+				return fmt.Errorf("%w: empty segment in namespace %q", errModelPathInvalid, mp.Namespace)
+			}
+
+			if strings.Contains(segment, ":") {
+				return fmt.Errorf("%w: ':' (colon) is not allowed in namespace names", errModelPathInvalid)
+			}
+
+			if strings.Contains(strings.ToUpper(segment), "%2F") {
+				return fmt.Errorf("%w: an encoded '/' (%%2F) is not allowed in namespace names", errModelPathInvalid)
+			}
+
+			components = append(components, struct{ kind, value string }{"namespace", segment})
+		}
+	}
+
+	components = append(components, []struct{ kind, value string }{
+		{"repository", mp.Repository},
+		{"tag", mp.Tag},
+	}...)
+
+	for _, c := range components {
+		if c.value == "." || c.value == ".." {
+			return fmt.Errorf("%w: %q is not allowed as a %s name", errModelPathInvalid, c.value, c.kind)
+		}
+
+		if c.kind != "tag" && strings.Contains(c.value, `\`) {
+			return fmt.Errorf("%w: '\\' (backslash) is not allowed in %s names", errModelPathInvalid, c.kind)
+		}
+	}
+
+	if strings.Contains(mp.Registry, "/") {
+		return fmt.Errorf("%w: '/' (slash) is not allowed in registry names", errModelPathInvalid)
+	}
+
+	return nil
+}
+
+// ValidateFilesystemSafe checks that every component of the model's manifest
+// path is a valid file name on the current platform, so a model accepted by
+// its registry can also be stored locally. On Windows, for example, a
+// registry port or a tag named after a device such as CON can't be stored.
+func (mp ModelPath) ValidateFilesystemSafe() error {
+	return mp.validateFilesystemSafe(runtime.GOOS)
+}
+
+func (mp ModelPath) validateFilesystemSafe(goos string) error {
+	components := []struct {
+		kind, value string
+	}{
+		{"registry", mp.Registry},
+	}
+
+	if mp.Namespace != "" {
+		for _, ns := range strings.Split(mp.Namespace, "/") {
+			components = append(components, struct{ kind, value string }{"namespace", ns})
+		}
+	}
+
+	components = append(components, []struct{ kind, value string }{
+		{"repository", mp.Repository},
+		{"tag", mp.StorageTag()},
+	}...)
+
+	for _, c := range components {
+		if err := filenameError(c.value, goos); err != nil {
+			return fmt.Errorf("%w: %s %q can't be stored on %s: %w", errModelPathInvalid, c.kind, c.value, goos, err)
+		}
+	}
+
+	return nil
+}
+
+var (
+	// portableComponent and portableTag are the namespace and repository
+	// component and tag grammars of the OCI distribution spec, which every
+	// registry accepts
+	portableComponent = regexp.MustCompile(`^[a-z0-9]+(?:(?:\.|_|__|-+)[a-z0-9]+)*$`)
+	portableTag       = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+)
+
+// IsPortable reports whether the model's name follows the OCI distribution
+// spec, so that any registry should accept it, and otherwise returns a warning
+// for each problem, e.g. uppercase letters in the repository, which the
+// default registry allows but stricter registries reject.
+func (mp ModelPath) IsPortable() (bool, []string) {
+	var warnings []string
+	warn := func(kind, value, problem string) {
+		warnings = append(warnings, fmt.Sprintf("%s %q %s", kind, value, problem))
+	}
+
+	if mp.Registry != strings.ToLower(mp.Registry) {
+		warn("registry", mp.Registry, "contains uppercase letters")
+	}
+
+	var components []string
+	if mp.Namespace != "" {
+		components = strings.Split(mp.Namespace, "/")
+	}
+
+	components = append(components, mp.Repository)
+	for i, c := range components {
+		kind := "namespace"
+		if i == len(components)-1 {
+			kind = "repository"
+		}
+
+		switch {
+		case strings.ContainsFunc(c, func(r rune) bool { return r > unicode.MaxASCII }):
+			warn(kind, c, "contains non-ASCII characters")
+		case strings.ContainsFunc(c, unicode.IsUpper):
+			warn(kind, c, "contains uppercase letters")
+		case !portableComponent.MatchString(c):
+			warn(kind, c, "must be lowercase letters and digits separated by '.', '_', '__' or '-'")
+		}
+	}
+
+	if name := strings.Join(components, "/"); len(name) > 255 {
+		warn("name", name, "is longer than 255 characters")
+	}
+
+	switch tag := mp.StorageTag(); {
+	case strings.ContainsFunc(tag, func(r rune) bool { return r > unicode.MaxASCII }):
+		warn("tag", tag, "contains non-ASCII characters")
+	case len(tag) > 128:
+		warn("tag", tag, "is longer than 128 characters")
+	case !portableTag.MatchString(tag):
+		warn("tag", tag, "must be letters, digits, '_', '.' and '-' and not start with '.' or '-'")
+	}
+
+	return len(warnings) == 0, warnings
+}
+
+// windowsReservedNames are device names which can't be used as file names on
+// Windows, with or without an extension.
+var windowsReservedNames = []string{
+	"CON", "PRN", "AUX", "NUL",
+	"COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8", "COM9",
+	"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9",
+}
+
+// filenameError returns why name isn't a valid file name on goos, or nil.
+func filenameError(name, goos string) error {
+	switch {
+	case name == "", name == ".", name == "..":
+		return fmt.Errorf("%q is not a file name", name)
+	case len(name) > 255:
+		return errors.New("name is longer than 255 bytes")
+	case strings.ContainsAny(name, "/\x00"):
+		return errors.New("name contains '/' or a NUL byte")
+	}
+
+	if goos != "windows" {
+		return nil
+	}
+
+	if i := strings.IndexFunc(name, func(r rune) bool {
+		return r < 0x20 || strings.ContainsRune(`<>:"\|?*`, r)
+	}); i >= 0 {
+		return fmt.Errorf("%q is not allowed in file names", name[i])
+	}
+
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return errors.New("file names can't end with '.' or ' '")
+	}
+
+	base, _, _ := strings.Cut(name, ".")
+	for _, reserved := range windowsReservedNames {
+		if strings.EqualFold(base, reserved) {
+			return fmt.Errorf("%s is a reserved device name", reserved)
+		}
+	}
+
+	return nil
+}
+
+// reservedTags are names used by the store layout which a tag, being used as
+// a file name, could be confused with.
+var reservedTags = []string{".", "..", "blobs", "certs", "manifests", "quarantine"}
+
+// isReservedTag reports whether tag names a store internal: one of
+// reservedTags, a digest-named manifest, or a dot file such as a temporary
+// file or ignore file.
+func isReservedTag(tag string) bool {
+	for _, reserved := range reservedTags {
+		if strings.EqualFold(tag, reserved) {
+			return true
+		}
+	}
+
+	return strings.HasPrefix(tag, ".") || isDigestManifestName(tag)
+}
+
+var errNamespaceMismatch = errors.New("namespace does not match the signed in user")
+
+// RequiresNamespace checks, before pushing mp to the default registry, that
+// its namespace belongs to username, since the registry only accepts pushes
+// to the user's own namespace. Other registries have their own ownership
+// rules and aren't checked, nor is anything checked without a username.
+func (mp ModelPath) RequiresNamespace(username string) error {
+	if username == "" || mp.canonicalRegistry() != DefaultRegistry || strings.EqualFold(mp.Namespace, username) {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s is in the %q namespace, push it as %s/%s:%s instead", errNamespaceMismatch, mp.GetShortTagname(), mp.Namespace, username, mp.Repository, mp.StorageTag())
+}
+
+// DigestDerivedTag returns a copy of mp tagged sha-<hex[:12]> after digest,
+// e.g. for CI builds which want an immutable tag per build output. The copy is
+// not pinned to the digest.
+func (mp ModelPath) DigestDerivedTag(digest string) (ModelPath, error) {
+	if !blobDigestRegEx.MatchString(digest) {
+		return ModelPath{}, fmt.Errorf("%w: %q", ErrInvalidDigestFormat, digest)
+	}
+
+	mp.Tag = "sha-" + canonicalDigest(digest)[len("sha256:"):][:12]
+	mp.Digest = ""
+	if err := mp.Validate(); err != nil {
+		return ModelPath{}, err
+	}
+
+	return mp, nil
+}
+
+// repositoryName returns the namespace and repository joined by a slash
+// without escaping them, for places which escape it themselves, e.g. query
+// parameters. Use RepositoryPath to build paths.
+func (mp ModelPath) repositoryName() string {
+	if mp.Namespace == "" {
+		return mp.Repository
+	}
+
+	return mp.Namespace + "/" + mp.Repository
+}
+
+// IsFullyQualified reports whether original, the reference mp was parsed from,
+// spells out the registry, namespace and tag rather than relying on their
+// defaults, e.g. registry.ollama.ai/library/llama3:8b but not llama3:8b. A
+// reference pinned by digest doesn't need a tag. It returns false if original
+// doesn't parse to mp.
+func (mp ModelPath) IsFullyQualified(original string) bool {
+	if !ParseModelPath(original).Equal(mp) || mp.Registry == "" || mp.Namespace == "" {
+		return false
+	}
+
+	if _, after, found := strings.Cut(original, "://"); found {
+		original = after
+	}
+
+	parts := strings.Split(normalizeSeparators(original, os.PathSeparator), "/")
+	if len(parts) < 3 || (len(parts) > 3 && !isRegistryHost(parts[0])) {
+		return false
+	}
+
+	repository, _, pinned := strings.Cut(parts[len(parts)-1], "@")
+	_, tag, _ := strings.Cut(repository, ":")
+	return tag != "" || pinned
+}
+
+// String returns the canonical fully qualified reference of the model,
+// including its digest when pinned.
+func (mp ModelPath) String() string {
+	s := mp.GetFullTagname()
+	if s != "" && mp.Digest != "" {
+		s += "@" + mp.Digest
+	}
+
+	return s
+}
+
+// DisplayName returns a short, readable name for the model: its short tag
+// name, or for a pinned model the name without the tag followed by the first
+// 12 hex characters of the digest, e.g. llama3@sha256:abc123def456…
+func (mp ModelPath) DisplayName() string {
+	if mp.Digest == "" {
+		return mp.GetShortTagname()
+	}
+
+	name := strings.TrimSuffix(mp.GetShortTagname(), ":"+mp.StorageTag())
+	if name == "" {
+		return ""
+	}
+
+	digest := mp.Digest
+	if blobDigestRegEx.MatchString(digest) {
+		digest = canonicalDigest(digest)[:len("sha256:")+12] + "…"
+	}
+
+	return name + "@" + digest
+}
+
+// StorageTag returns the tag the model is stored under, which is the default
+// tag when none is set.
+func (mp ModelPath) StorageTag() string {
+	if mp.Tag == "" {
+		return DefaultTag
+	}
+
+	return mp.Tag
+}
+
+// CacheKey returns a key identifying the model for caching. An unset tag and
+// an explicit default tag produce the same key, as do registries spelled with
+// and without the scheme's default port. Like GetManifestPath, it ignores the
+// case of everything but the tag, so names stored in the same manifest have
+// the same key.
+func (mp ModelPath) CacheKey() string {
+	mp.Registry = mp.canonicalRegistry()
+	mp.Namespace = strings.ToLower(mp.Namespace)
+	mp.Repository = strings.ToLower(mp.Repository)
+	mp.Tag = mp.StorageTag()
+	key := mp.GetFullTagname()
+	if mp.Digest != "" {
+		key += "@" + canonicalDigest(mp.Digest)
+	}
+
+	return key
+}
+
+// Equal reports whether mp and other refer to the same model, treating an
+// unset tag as the default tag, see CacheKey.
+func (mp ModelPath) Equal(other ModelPath) bool {
+	return mp.CacheKey() == other.CacheKey()
+}
+
+// EqualIgnoringRegistry reports whether mp and other name the same namespace,
+// repository and tag, regardless of the registry they come from, e.g. a model
+// and its copy on a mirror. An unset tag is treated as the default tag.
+func (mp ModelPath) EqualIgnoringRegistry(other ModelPath) bool {
+	return strings.EqualFold(mp.Namespace, other.Namespace) &&
+		strings.EqualFold(mp.Repository, other.Repository) &&
+		mp.StorageTag() == other.StorageTag()
+}
+
+// canonicalRegistry returns the lowercased registry host without the default
+// port of the scheme, e.g. registry.ollama.ai for registry.ollama.ai:443 over
+// https, for comparing registries.
+func (mp ModelPath) canonicalRegistry() string {
+	registry := strings.ToLower(mp.Registry)
+	host, port, err := net.SplitHostPort(registry)
+	if err != nil {
+		return registry
+	}
+
+	switch {
+	case port == "443" && mp.ProtocolScheme != "http",
+		port == "80" && mp.ProtocolScheme == "http":
+		return host
+	}
+
+	return registry
+}
+
+// RepositoryPath returns the namespace and repository as the registry sees
+// them, e.g. library/llama3 or org/team/model, with each component escaped so
+// the result can be inserted into a /v2/<path>/... request path.
+func (mp ModelPath) RepositoryPath() string {
+	var parts []string
+	if mp.Namespace != "" {
+		parts = strings.Split(mp.Namespace, "/")
+	}
+
+	parts = append(parts, mp.Repository)
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+
+	return strings.Join(parts, "/")
+}
+
+// GetFullTagname returns the fully qualified name of the model, e.g.
+// registry.ollama.ai/library/llama3:latest, or example.com/llama3:latest for
+// a repository at the root of its registry. It returns an empty string if the
+// repository is empty; callers should Validate the model path first.
+func (mp ModelPath) GetFullTagname() string {
+	if mp.Repository == "" {
+		return ""
+	}
+
+	return mp.Registry + "/" + mp.repositoryName() + ":" + mp.StorageTag()
+}
+
+// GetShortTagname returns the shortest unambiguous name of the model, omitting
+// the default registry and namespace. It returns an empty string if the
+// repository is empty; callers should Validate the model path first.
+func (mp ModelPath) GetShortTagname() string {
+	if mp.Repository == "" {
+		return ""
+	}
+
+	if mp.canonicalRegistry() == DefaultRegistry {
+		if mp.Namespace == DefaultNamespace {
+			return mp.Repository + ":" + mp.StorageTag()
+		}
+		return mp.repositoryName() + ":" + mp.StorageTag()
+	}
+	return mp.GetFullTagname()
+}
+
+// modelsDir returns the value of the OLLAMA_MODELS environment variable or the user's home directory if OLLAMA_MODELS is not set.
+// The models directory is where Ollama stores its model files and manifests.
+// When OLLAMA_MODELS lists several directories, it returns the first, which is
+// the one models are written to.
+func modelsDir() (string, error) {
+	dirs, err := modelsDirs()
+	if err != nil {
+		return "", err
+	}
+
+	return dirs[0], nil
+}
+
+// modelsDirs returns the models directories in OLLAMA_MODELS, which may list
+// several separated by the platform's list separator (":" or ";" on windows).
+// Models are read from each directory in order and written to the first.
+func modelsDirs() ([]string, error) {
+	if models, exists := os.LookupEnv("OLLAMA_MODELS"); exists {
+		var dirs []string
+		for _, dir := range filepath.SplitList(models) {
+			if dir != "" {
+				dirs = append(dirs, dir)
+			}
+		}
+
+		if len(dirs) == 0 {
+			return []string{models}, nil
+		}
+
+		return dirs, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	return []string{filepath.Join(home, ".ollama", "models")}, nil
+}
+
+// manifestsDirs returns the manifests directory of each models directory, in
+// the order they are read from.
+func manifestsDirs() ([]string, error) {
+	dirs, err := modelsDirs()
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := make([]string, len(dirs))
+	for i, dir := range dirs {
+		manifests[i] = filepath.Join(dir, "manifests")
+	}
+
+	return manifests, nil
+}
+
+// manifestReadPath returns the path to read the model's manifest from, which
+// is in the first models directory containing it. A model pinned only by
+// digest is read from its digest-named manifest or else from a tag of its
+// repository whose manifest has that digest. It falls back to GetManifestPath
+// if no directory has the manifest.
+func (mp ModelPath) manifestReadPath() (string, error) {
+	p, err := mp.GetManifestPath()
+	if err != nil {
+		return "", err
+	}
+
+	p, err = readPath(p)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(p); err != nil {
+		// a mixed case manifest written before names were lowercased
+		legacy, err := mp.manifestPath(false)
+		if err != nil {
+			return "", err
+		}
+
+		if legacy, err = readPath(legacy); err != nil {
+			return "", err
+		} else if _, err := os.Stat(legacy); err == nil {
+			return legacy, nil
+		}
+	}
+
+	if _, err := os.Stat(p); err != nil && mp.Namespace == "" {
+		// a root repository stored in library before namespace-less names
+		// on registries other than the default one stopped defaulting to it
+		legacy := mp
+		legacy.Namespace = DefaultNamespace
+		if lp, err := legacy.manifestReadPath(); err != nil {
+			return "", err
+		} else if _, err := os.Stat(lp); err == nil {
+			return lp, nil
+		}
+	}
+
+	if _, err := os.Stat(p); err == nil || mp.Digest == "" || mp.Tag != "" {
+		return p, nil
+	}
+
+	tags, err := mp.ListTags()
+	if err != nil {
+		return "", err
+	}
+
+	for _, tag := range tags {
+		tagged := mp
+		tagged.Tag, tagged.Digest = tag, ""
+		tp, err := tagged.manifestReadPath()
+		if err != nil {
+			return "", err
+		}
+
+		b, err := os.ReadFile(tp)
+		if err != nil {
+			continue
+		}
+
+		if DigestsEqual(fmt.Sprintf("sha256:%x", sha256.Sum256(b)), mp.Digest) {
+			return tp, nil
+		}
+	}
+
+	return p, nil
+}
+
+// readPath returns the first existing file among p, a path in the first
+// models directory, and the same path in the other models directories. It
+// returns p if none of them exist.
+func readPath(p string) (string, error) {
+	dirs, err := modelsDirs()
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(p); err == nil || len(dirs) == 1 {
+		return p, nil
+	}
+
+	rel, err := filepath.Rel(dirs[0], p)
+	if err != nil {
+		return "", err
+	}
+
+	for _, dir := range dirs[1:] {
+		candidate := filepath.Join(dir, rel)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+
+	return p, nil
+}
+
+// GetManifestPath returns the path to the manifest file for the given model path, it is up to the caller to create the directory if it does not exist.
+// Nested namespaces (e.g. org/team) map to nested directories. A model pinned
+// to a digest without a tag maps to its digest-named manifest, see
+// GetManifestPathByDigest. Names which would step outside the manifests
+// directory, e.g. with a namespace segment of "..", return errModelPathInvalid.
+//
+// As with model.Name.Filepath, the registry, namespace and repository are
+// lowercased so names differing only in their case map to the same manifest
+// on every platform, while the tag keeps its case.
+func (mp ModelPath) GetManifestPath() (string, error) {
+	return mp.manifestPath(true)
+}
+
+// manifestPath is GetManifestPath, lowercasing the registry, namespace and
+// repository if fold is set. Without it, it returns the path manifests were
+// written to before names were lowercased on case sensitive filesystems.
+func (mp ModelPath) manifestPath(fold bool) (string, error) {
+	if mp.Digest != "" && mp.Tag == "" {
+		return mp.GetManifestPathByDigest(mp.Digest)
+	}
+
+	if err := validatePathComponents(mp); err != nil {
+		return "", err
+	}
+
+	dir, err := modelsDir()
+	if err != nil {
+		return "", err
+	}
+
+	if fold {
+		mp.Registry = strings.ToLower(mp.Registry)
+		mp.Namespace = strings.ToLower(mp.Namespace)
+		mp.Repository = strings.ToLower(mp.Repository)
+	}
+
+	return filepath.Join(dir, "manifests", mp.Registry, filepath.FromSlash(mp.Namespace), mp.Repository, mp.StorageTag()), nil
+}
+
+// GetManifestPathByDigest returns the path of the digest-named manifest with
+// the given digest in the model's repository, e.g.
+// manifests/registry.ollama.ai/library/llama3/sha256-<hex>. Such manifests are
+// content addressed copies and aren't listed as tags. It returns
+// ErrInvalidDigestFormat if the digest is not valid.
+func (mp ModelPath) GetManifestPathByDigest(digest string) (string, error) {
+	if !blobDigestRegEx.MatchString(digest) {
+		return "", ErrInvalidDigestFormat
+	}
+
+	mp.Tag = strings.Replace(canonicalDigest(digest), ":", "-", 1)
+	return mp.GetManifestPath()
+}
+
+// isDigestManifestName reports whether name is the file name of a
+// digest-named manifest rather than a tag.
+func isDigestManifestName(name string) bool {
+	return blobDigestRegEx.MatchString(name)
+}
+
+// ErrOfflineMode is returned when a registry URL is requested while offline
+// mode is enabled.
+var ErrOfflineMode = errors.New("registry access is disabled in offline mode")
+
+var offline atomic.Bool
+
+// SetOffline enables or disables offline mode, in which no registry URLs can
+// be constructed so no registry requests can be made, e.g. on air-gapped
+// hosts. Local paths are unaffected.
+func SetOffline(enabled bool) {
+	offline.Store(enabled)
+}
+
+// BaseURL returns the URL of the model's registry. It returns ErrOfflineMode in
+// offline mode, and ErrInsecureProtocol for an http registry when TLS is
+// required.
+func (mp ModelPath) BaseURL() (*url.URL, error) {
+	if offline.Load() {
+		return nil, fmt.Errorf("%w: %s", ErrOfflineMode, mp.Registry)
+	}
+
+	if err := requireTLS(mp.ProtocolScheme, mp.Registry, false); err != nil {
+		return nil, err
+	}
+
+	return &url.URL{
+		Scheme: mp.ProtocolScheme,
+		Host:   mp.Registry,
+	}, nil
+}
+
+// TLSConfig returns the TLS configuration for connecting to the model's
+// registry. Registries using a private CA can be trusted by placing the CA
+// certificates in <models>/certs/<host>/ca.crt, which are trusted in addition
+// to the system roots. It returns nil, meaning the default configuration, if
+// there is no such file.
+func (mp ModelPath) TLSConfig() (*tls.Config, error) {
+	if mp.Registry == "" || mp.Registry == "." || mp.Registry == ".." || strings.ContainsAny(mp.Registry, `/\`) {
+		return nil, fmt.Errorf("%w: invalid registry host %q", errModelPathInvalid, mp.Registry)
+	}
+
+	dir, err := modelsDir()
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := os.ReadFile(filepath.Join(dir, "certs", mp.Registry, "ca.crt"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("%s: no certificates found in ca.crt", mp.Registry)
+	}
+
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+// BlobURL returns the registry URL of the blob with the given digest in the
+// model's repository. It returns ErrInvalidDigestFormat if the digest is not
+// valid.
+func (mp ModelPath) BlobURL(digest string) (*url.URL, error) {
+	if !blobDigestRegEx.MatchString(digest) {
+		return nil, ErrInvalidDigestFormat
+	}
+
+	base, err := mp.BaseURL()
+	if err != nil {
+		return nil, err
+	}
+
+	return base.JoinPath("v2", mp.RepositoryPath(), "blobs", canonicalDigest(digest)), nil
+}
+
+// ManifestURL returns the registry URL of the model's manifest. A model pinned
+// by digest is requested by its digest, so the registry serves exactly that
+// manifest, otherwise by its tag, see StorageTag.
+func (mp ModelPath) ManifestURL() (*url.URL, error) {
+	reference := mp.StorageTag()
+	if mp.Digest != "" {
+		if !blobDigestRegEx.MatchString(mp.Digest) {
+			return nil, ErrInvalidDigestFormat
+		}
+
+		reference = canonicalDigest(mp.Digest)
+	}
+
+	base, err := mp.BaseURL()
+	if err != nil {
+		return nil, err
+	}
+
+	return base.JoinPath("v2", mp.RepositoryPath(), "manifests", url.PathEscape(reference)), nil
+}
+
+// ManifestsPath returns the path to the manifests directory without creating
+// it.
+func ManifestsPath() (string, error) {
+	dir, err := modelsDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "manifests"), nil
+}
+
+// GetManifestPath returns the path to the manifests directory, creating it if
+// it does not exist.
+func GetManifestPath() (string, error) {
+	path, err := ManifestsPath()
+	if err != nil {
+		return "", err
+	}
+
+	if err := mkdirAll(path); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// BlobsPath returns the path a blob with the given SHA256 digest is written
+// to, or the blobs directory if digest is empty. Unlike GetBlobsPath it never
+// touches the filesystem, so the result depends only on the digest and the
+// environment; a blob stored in the other layout than OLLAMA_BLOB_SHARDING
+// selects isn't found. It returns ErrInvalidDigestFormat if the digest is not
+// valid.
+func BlobsPath(digest string) (string, error) {
+	dir, err := modelsDir()
+	if err != nil {
+		return "", err
+	}
+
+	dir = filepath.Join(dir, "blobs")
+	if digest == "" {
+		return dir, nil
+	}
+
+	if !storeDigestRegEx.MatchString(digest) {
+		return "", ErrInvalidDigestFormat
+	}
+
+	name := strings.ReplaceAll(digest, ":", "-")
+	if envconfig.BlobSharding {
+		return filepath.Join(dir, blobShard(name), name), nil
+	}
+
+	return filepath.Join(dir, name), nil
+}
+
+// GetBlobsPath returns the path to a file in the model directory given its SHA256 digest
+// It returns ErrInvalidDigestFormat if the digest is not valid.
+// Blobs are named <algorithm>-<hex>, e.g. sha256-<hex> or sha512-<hex>, so
+// BlobAlgorithm can recover the algorithm from the path.
+func GetBlobsPath(digest string) (path string, err error) {
+	dir, err := modelsDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "blobs")
+	if digest != "" {
+		if !storeDigestRegEx.MatchString(digest) {
+			return "", ErrInvalidDigestFormat
+		}
+		digest = strings.ReplaceAll(digest, ":", "-")
+		path = resolveBlobPath(dir, digest)
+		dir = filepath.Dir(path)
+	} else {
+		path = dir
+	}
+
+	if err := mkdirAll(dir); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// BlobAlgorithm returns the digest algorithm, sha256 or sha512, of the blob
+// at path, as named by GetBlobsPath. It returns ErrInvalidDigestFormat if the
+// file isn't named like a blob.
+func BlobAlgorithm(path string) (string, error) {
+	name := filepath.Base(path)
+	algorithm, _, _ := strings.Cut(name, "-")
+	if !strings.Contains(name, "-") || !storeDigestRegEx.MatchString(name) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidDigestFormat, name)
+	}
+
+	return algorithm, nil
+}
+
+// BlobLockPath returns the path of the lock file serializing writes of the
+// blob with the given digest, blobs/locks/sha256-<hex>.lock, creating the
+// locks directory if needed. Either digest separator and any hex case map to
+// the same lock.
+func BlobLockPath(digest string) (string, error) {
+	if !blobDigestRegEx.MatchString(digest) {
+		return "", ErrInvalidDigestFormat
+	}
+
+	blobs, err := GetBlobsPath("")
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(blobs, "locks")
+	if err := mkdirAll(dir); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, strings.Replace(canonicalDigest(digest), ":", "-", 1)+".lock"), nil
+}
+
+// RelBlobPath returns the slash separated path of the blob with the given
+// digest relative to the models directory, e.g. blobs/sha256-<hex> or
+// blobs/<hex[:2]>/sha256-<hex> when sharded, for archive and sync tooling.
+func RelBlobPath(digest string) (string, error) {
+	if digest == "" {
+		return "", ErrInvalidDigestFormat
+	}
+
+	blob, err := GetBlobsPath(digest)
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := modelsDir()
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(dir, blob)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.ToSlash(rel), nil
+}
+
+// IsStoreBlobPath reports whether path names a blob in the blobs directory of
+// one of the models directories, in either the flat or the sharded layout, and
+// returns the blob's digest if so. The check is lexical: the blob doesn't need
+// to exist, and symlinks aren't resolved.
+func IsStoreBlobPath(path string) (digest string, ok bool) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+
+	dirs, err := modelsDirs()
+	if err != nil {
+		return "", false
+	}
+
+	for _, dir := range dirs {
+		dir, err := filepath.Abs(filepath.Join(dir, "blobs"))
+		if err != nil {
+			continue
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			continue
+		}
+
+		shard, name := filepath.Split(filepath.ToSlash(rel))
+		// blobs are named <algorithm>-<hex>, never with a colon
+		digest := strings.Replace(name, "-", ":", 1)
+		if strings.Contains(name, ":") || !storeDigestRegEx.MatchString(digest) {
+			continue
+		}
+
+		if shard == "" || shard == blobShard(name)+"/" {
+			return canonicalDigest(digest), true
+		}
+	}
+
+	return "", false
+}
+
+// readBlobPath returns the path to read the blob with the given digest from.
+// The read-only caches in OLLAMA_BLOB_CACHE_DIRS are consulted first, then
+// each models directory in order, falling back to the path in the main store,
+// which is where all blobs are written.
+func readBlobPath(digest string) (string, error) {
+	path, err := GetBlobsPath(digest)
+	if err != nil {
+		return "", err
+	}
+
+	name := filepath.Base(path)
+	for _, dir := range envconfig.BlobCacheDirs {
+		cached := resolveBlobPath(dir, name)
+		if _, err := os.Stat(cached); err == nil {
+			return cached, nil
+		}
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	dirs, err := modelsDirs()
+	if err != nil {
+		return "", err
+	}
+
+	for _, dir := range dirs[1:] {
+		p := resolveBlobPath(filepath.Join(dir, "blobs"), name)
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+
+	return path, nil
+}
+
+// resolveBlobPath returns the path of the blob named name in dir. Blobs are
+// read from either the flat (blobs/sha256-<hex>) or the sharded
+// (blobs/<hex[:2]>/sha256-<hex>) layout, whichever they exist in, while new
+// blobs are written to the sharded layout only when OLLAMA_BLOB_SHARDING is
+// set.
+func resolveBlobPath(dir, name string) string {
+	flat := filepath.Join(dir, name)
+	sharded := filepath.Join(dir, blobShard(name), name)
+
+	preferred, other := flat, sharded
+	if envconfig.BlobSharding {
+		preferred, other = sharded, flat
+	}
+
+	if _, err := os.Stat(preferred); err != nil {
+		if _, err := os.Stat(other); err == nil {
+			return other
+		}
+	}
+
+	return preferred
+}
+
+// blobShard returns the shard directory of the blob named name, which is the
+// first two characters of its hex digest.
+func blobShard(name string) string {
+	_, hex, _ := strings.Cut(name, "-")
+	return strings.ToLower(hex[:2])
+}
+
+// isBlobShard reports whether name is a shard directory name.
+func isBlobShard(name string) bool {
+	return len(name) == 2 && strings.Trim(name, "0123456789abcdef") == ""
 }
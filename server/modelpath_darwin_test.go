@@ -0,0 +1,28 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManifestPathCollisionDarwin(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	writeTestModel(t, "Library/Llama3:Latest", "config", "model")
+
+	p, err := ParseModelPath("library/llama3").GetManifestPath()
+	assert.Nil(t, err)
+
+	_, err = os.Stat(p)
+	assert.Nil(t, err)
+
+	// the directory on disk uses the canonical lowercase spelling regardless of
+	// the spelling used to create it
+	entries, err := os.ReadDir(filepath.Dir(filepath.Dir(p)))
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "llama3", entries[0].Name())
+}
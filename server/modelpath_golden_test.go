@@ -0,0 +1,115 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files in testdata")
+
+// legacyModelPaths are reference strings found in existing scripts and
+// Modelfiles. Their parse results and the names they print as are recorded
+// in testdata so changes to ParseModelPath which alter them are caught; such
+// changes must be gated behind ParseOptions or, like the namespace of
+// localhost:5000/llama3, be revertible with OLLAMA_DEFAULT_NAMESPACES.
+var legacyModelPaths = []string{
+	"llama2",
+	"llama2:13b",
+	"llama2:13b-chat-q4_0",
+	"library/llama2",
+	"jmorganca/llama2:latest",
+	"registry.ollama.ai/library/llama2:latest",
+	"https://registry.ollama.ai/library/llama2:7b",
+	"http://registry.ollama.ai/library/llama2:7b",
+	"ollama.ai/library/llama2",
+	"myhost:5000/ns/model:tag",
+	"myhost:5000/ns/model",
+	"http://myhost:5000/ns/model:tag",
+	"localhost:5000/llama3",
+	"localhost:5000/llama3:v1",
+	"localhost/ns/model:tag",
+	"127.0.0.1:5000/ns/model:tag",
+	"example.com/ns/repo",
+	"ghcr.io/org/team/model:v1",
+	"ns/repo@sha256:456402914e838a953e0cf80caa6adbe75383d9e63584a964f504a7bbb8f7aad9",
+	"ns/repo:tag@sha256:456402914e838a953e0cf80caa6adbe75383d9e63584a964f504a7bbb8f7aad9",
+	"Library/Llama2:Q4_0",
+	"library/model:v1%2E0",
+	"",
+	"ns/",
+	"a/b/c/d",
+}
+
+// rootRepositoryPaths are references to repositories at the root of their
+// registry, recorded as parsed with RootRepositories under a "root:" key.
+var rootRepositoryPaths = []string{
+	"myregistry.com/model",
+	"localhost:5000/llama3:v1",
+	"http://myhost:5000/model",
+	"example.com/repo@sha256:456402914e838a953e0cf80caa6adbe75383d9e63584a964f504a7bbb8f7aad9",
+}
+
+// goldenModelPath is a parse result as recorded in testdata, along with the
+// name it prints as.
+type goldenModelPath struct {
+	ModelPath
+	Name string
+}
+
+func newGoldenModelPath(mp ModelPath) goldenModelPath {
+	return goldenModelPath{ModelPath: mp, Name: mp.String()}
+}
+
+func TestParseModelPathGolden(t *testing.T) {
+	golden := filepath.Join("testdata", "modelpaths.json")
+
+	got := make(map[string]goldenModelPath, len(legacyModelPaths)+len(rootRepositoryPaths))
+	for _, name := range legacyModelPaths {
+		got[name] = newGoldenModelPath(ParseModelPath(name))
+	}
+
+	for _, name := range rootRepositoryPaths {
+		mp, err := ParseModelPathWithOptions(name, ParseOptions{RootRepositories: true})
+		if err != nil {
+			t.Fatalf("%q: %v", name, err)
+		}
+
+		got["root:"+name] = newGoldenModelPath(mp)
+	}
+
+	if *updateGolden {
+		b, err := json.MarshalIndent(got, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(golden, append(b, '\n'), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want map[string]goldenModelPath
+	if err := json.Unmarshal(b, &want); err != nil {
+		t.Fatal(err)
+	}
+
+	for name := range got {
+		w, ok := want[name]
+		if !ok {
+			t.Errorf("%q: missing from %s, run with -update", name, golden)
+			continue
+		}
+
+		if got[name] != w {
+			t.Errorf("%q: got %+v, want %+v", name, got[name], w)
+		}
+	}
+}
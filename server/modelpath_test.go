@@ -1,11 +1,21 @@
 package server
 
 import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/ollama/ollama/server/envconfig"
+	"github.com/ollama/ollama/types/model"
 )
 
 func TestGetBlobsPath(t *testing.T) {
@@ -141,6 +151,106 @@ func TestParseModelPath(t *testing.T) {
 				Tag:            DefaultTag,
 			},
 		},
+		{
+			"digest",
+			"ns/repo@sha256:456402914e838a953e0cf80caa6adbe75383d9e63584a964f504a7bbb8f7aad9",
+			ModelPath{
+				ProtocolScheme: "https",
+				Registry:       DefaultRegistry,
+				Namespace:      "ns",
+				Repository:     "repo",
+				Digest:         "sha256:456402914e838a953e0cf80caa6adbe75383d9e63584a964f504a7bbb8f7aad9",
+			},
+		},
+		{
+			"tag and digest",
+			"ns/repo:tag@sha256:456402914e838a953e0cf80caa6adbe75383d9e63584a964f504a7bbb8f7aad9",
+			ModelPath{
+				ProtocolScheme: "https",
+				Registry:       DefaultRegistry,
+				Namespace:      "ns",
+				Repository:     "repo",
+				Tag:            "tag",
+				Digest:         "sha256:456402914e838a953e0cf80caa6adbe75383d9e63584a964f504a7bbb8f7aad9",
+			},
+		},
+		{
+			"host and port without namespace",
+			"localhost:5000/llama3",
+			ModelPath{
+				ProtocolScheme: "https",
+				Registry:       "localhost:5000",
+				Namespace:      "",
+				Repository:     "llama3",
+				Tag:            DefaultTag,
+			},
+		},
+		{
+			"host and port without namespace with tag",
+			"localhost:5000/llama3:v1",
+			ModelPath{
+				ProtocolScheme: "https",
+				Registry:       "localhost:5000",
+				Namespace:      "",
+				Repository:     "llama3",
+				Tag:            "v1",
+			},
+		},
+		{
+			"localhost without namespace",
+			"http://localhost/llama3:v1",
+			ModelPath{
+				ProtocolScheme: "http",
+				Registry:       "localhost",
+				Namespace:      "",
+				Repository:     "llama3",
+				Tag:            "v1",
+			},
+		},
+		{
+			"registry alias",
+			"ollama.ai/library/repo:tag",
+			ModelPath{
+				ProtocolScheme: "https",
+				Registry:       DefaultRegistry,
+				Namespace:      DefaultNamespace,
+				Repository:     "repo",
+				Tag:            "tag",
+			},
+		},
+		{
+			"canonical registry",
+			"registry.ollama.ai/library/repo:tag",
+			ModelPath{
+				ProtocolScheme: "https",
+				Registry:       DefaultRegistry,
+				Namespace:      DefaultNamespace,
+				Repository:     "repo",
+				Tag:            "tag",
+			},
+		},
+		{
+			"nested namespace",
+			"ghcr.io/org/team/model:tag",
+			ModelPath{
+				ProtocolScheme: "https",
+				Registry:       "ghcr.io",
+				Namespace:      "org/team",
+				Repository:     "model",
+				Tag:            "tag",
+			},
+		},
+		{
+			"deeply nested namespace",
+			"https://ghcr.io/org/team/sub/model",
+			ModelPath{
+				ProtocolScheme: "https",
+				Registry:       "ghcr.io",
+				Namespace:      "org/team/sub",
+				Repository:     "model",
+				Tag:            DefaultTag,
+			},
+		},
 	}
 
 	for _, tc := range tests {
@@ -153,3 +263,1461 @@ func TestParseModelPath(t *testing.T) {
 		})
 	}
 }
+
+func TestGetManifestPathNested(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", dir)
+
+	mp := ParseModelPath("ghcr.io/org/team/model:tag")
+	got, err := mp.GetManifestPath()
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "manifests", "ghcr.io", "org", "team", "model", "tag"), got)
+}
+
+func TestDigestsEqual(t *testing.T) {
+	const digest = "sha256:456402914e838a953e0cf80caa6adbe75383d9e63584a964f504a7bbb8f7aad9"
+
+	tests := []struct {
+		name string
+		a, b string
+		want bool
+	}{
+		{"identical", digest, digest, true},
+		{"colon and dash", digest, "sha256-456402914e838a953e0cf80caa6adbe75383d9e63584a964f504a7bbb8f7aad9", true},
+		{"case difference", digest, "sha256:456402914E838A953E0CF80CAA6ADBE75383D9E63584A964F504A7BBB8F7AAD9", true},
+		{"mismatch", digest, "sha256:0000000000000000000000000000000000000000000000000000000000000000", false},
+		{"truncated", digest, digest[:20], false},
+		{"empty", "", "", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, DigestsEqual(tc.a, tc.b))
+			assert.Equal(t, tc.want, DigestsEqual(tc.b, tc.a))
+		})
+	}
+}
+
+func TestTagnames(t *testing.T) {
+	tests := []struct {
+		name  string
+		mp    ModelPath
+		full  string
+		short string
+	}{
+		{
+			"default registry and namespace",
+			ParseModelPath("llama3"),
+			"registry.ollama.ai/library/llama3:latest",
+			"llama3:latest",
+		},
+		{
+			"custom namespace",
+			ParseModelPath("jmorganca/llama3:8b"),
+			"registry.ollama.ai/jmorganca/llama3:8b",
+			"jmorganca/llama3:8b",
+		},
+		{
+			"custom registry",
+			ParseModelPath("example.com/ns/repo:tag"),
+			"example.com/ns/repo:tag",
+			"example.com/ns/repo:tag",
+		},
+		{
+			"root repository",
+			ModelPath{Registry: "example.com", Repository: "repo", Tag: "tag"},
+			"example.com/repo:tag",
+			"example.com/repo:tag",
+		},
+		{
+			"empty repository",
+			ModelPath{Registry: DefaultRegistry, Namespace: DefaultNamespace, Tag: DefaultTag},
+			"",
+			"",
+		},
+		{
+			"empty repository custom registry",
+			ParseModelPath("example.com/ns/"),
+			"",
+			"",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.full, tc.mp.GetFullTagname())
+			assert.Equal(t, tc.short, tc.mp.GetShortTagname())
+		})
+	}
+
+	root := ModelPath{Registry: "Example.com:443", Repository: "Repo", Digest: "sha256:" + strings.Repeat("a", 64)}
+	assert.Equal(t, "example.com/repo:latest@sha256:"+strings.Repeat("a", 64), root.CacheKey())
+}
+
+func TestRepositoryPath(t *testing.T) {
+	tests := []struct {
+		name string
+		mp   ModelPath
+		want string
+	}{
+		{"default namespace", ParseModelPath("llama3"), "library/llama3"},
+		{"custom namespace", ParseModelPath("jmorganca/llama3"), "jmorganca/llama3"},
+		{"nested namespace", ParseModelPath("ghcr.io/org/team/model:tag"), "org/team/model"},
+		{"reserved characters", ModelPath{Namespace: "a%b", Repository: "c?d"}, "a%25b/c%3Fd"},
+		{"slash in repository", ModelPath{Namespace: "library", Repository: "../v2/other"}, "library/..%2Fv2%2Fother"},
+		{"percent", ModelPath{Namespace: "lib%2Frary", Repository: "llama3"}, "lib%252Frary/llama3"},
+		{"query and fragment", ModelPath{Namespace: "library", Repository: "llama3?x=1#y"}, "library/llama3%3Fx=1%23y"},
+		{"space", ModelPath{Namespace: "my ns", Repository: "llama3"}, "my%20ns/llama3"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := tc.mp.RepositoryPath()
+			assert.Equal(t, tc.want, got)
+
+			u, err := ParseModelPath("").BaseURL()
+			assert.Nil(t, err)
+			u = u.JoinPath("v2", got, "manifests", "latest")
+			assert.Equal(t, "https://"+DefaultRegistry+"/v2/"+tc.want+"/manifests/latest", u.String())
+		})
+	}
+
+	t.Run("join path", func(t *testing.T) {
+		mp := ParseModelPath("ghcr.io/org/team/model:tag")
+		u, err := mp.BaseURL()
+		assert.Nil(t, err)
+		u = u.JoinPath("v2", mp.RepositoryPath(), "manifests", mp.Tag)
+		assert.Equal(t, "https://ghcr.io/v2/org/team/model/manifests/tag", u.String())
+	})
+}
+
+func TestRepositoryName(t *testing.T) {
+	tests := []struct {
+		mp   ModelPath
+		want string
+	}{
+		{ModelPath{Namespace: "library", Repository: "llama3"}, "from=library%2Fllama3"},
+		{ModelPath{Namespace: "org/team", Repository: "model"}, "from=org%2Fteam%2Fmodel"},
+		{ModelPath{Repository: "model"}, "from=model"},
+		// escaped only once, by the query
+		{ModelPath{Namespace: "my ns", Repository: "llama3"}, "from=my+ns%2Fllama3"},
+		{ModelPath{Namespace: "lib%2Frary", Repository: "llama3"}, "from=lib%252Frary%2Fllama3"},
+	}
+
+	for _, tc := range tests {
+		values := url.Values{}
+		values.Add("from", tc.mp.repositoryName())
+		assert.Equal(t, tc.want, values.Encode(), tc.mp.repositoryName())
+	}
+}
+
+func TestRegistryAliasShortTagname(t *testing.T) {
+	for _, name := range []string{"ollama.ai/library/llama3", "OLLAMA.AI/library/llama3", "ollama.com/library/llama3"} {
+		assert.Equal(t, "llama3:latest", ParseModelPath(name).GetShortTagname(), name)
+	}
+}
+
+func TestBlobURL(t *testing.T) {
+	const digest = "sha256:456402914e838a953e0cf80caa6adbe75383d9e63584a964f504a7bbb8f7aad9"
+
+	tests := []struct {
+		name   string
+		model  string
+		digest string
+		want   string
+		err    error
+	}{
+		{
+			"default registry",
+			"llama3",
+			digest,
+			"https://registry.ollama.ai/v2/library/llama3/blobs/" + digest,
+			nil,
+		},
+		{
+			"custom registry",
+			"http://localhost:5000/ns/repo:tag",
+			digest,
+			"http://localhost:5000/v2/ns/repo/blobs/" + digest,
+			nil,
+		},
+		{
+			"dash separator",
+			"llama3",
+			"sha256-456402914e838a953e0cf80caa6adbe75383d9e63584a964f504a7bbb8f7aad9",
+			"https://registry.ollama.ai/v2/library/llama3/blobs/" + digest,
+			nil,
+		},
+		{
+			"invalid digest",
+			"llama3",
+			"sha256:../../manifests",
+			"",
+			ErrInvalidDigestFormat,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseModelPath(tc.model).BlobURL(tc.digest)
+			assert.ErrorIs(t, err, tc.err)
+			if tc.err == nil {
+				assert.Equal(t, tc.want, got.String())
+			}
+		})
+	}
+}
+
+func TestManifestURL(t *testing.T) {
+	const digest = "sha256:456402914e838a953e0cf80caa6adbe75383d9e63584a964f504a7bbb8f7aad9"
+
+	tests := []struct {
+		name  string
+		model string
+		want  string
+		err   error
+	}{
+		{
+			"tag",
+			"llama3:8b",
+			"https://registry.ollama.ai/v2/library/llama3/manifests/8b",
+			nil,
+		},
+		{
+			"default tag",
+			"example.com/ns/repo",
+			"https://example.com/v2/ns/repo/manifests/latest",
+			nil,
+		},
+		{
+			"digest",
+			"llama3@" + digest,
+			"https://registry.ollama.ai/v2/library/llama3/manifests/" + digest,
+			nil,
+		},
+		{
+			"digest preferred over tag",
+			"llama3:8b@" + digest,
+			"https://registry.ollama.ai/v2/library/llama3/manifests/" + digest,
+			nil,
+		},
+		{
+			"escaped tag",
+			"llama3:a%b",
+			"https://registry.ollama.ai/v2/library/llama3/manifests/a%25b",
+			nil,
+		},
+		{
+			"invalid digest",
+			"llama3@sha256:1234",
+			"",
+			ErrInvalidDigestFormat,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseModelPath(tc.model).ManifestURL()
+			assert.ErrorIs(t, err, tc.err)
+			if tc.err == nil {
+				assert.Equal(t, tc.want, got.String())
+			}
+		})
+	}
+
+	t.Run("implicit tag", func(t *testing.T) {
+		got, err := ModelPath{ProtocolScheme: "https", Registry: DefaultRegistry, Namespace: DefaultNamespace, Repository: "llama3"}.ManifestURL()
+		assert.Nil(t, err)
+		assert.Equal(t, "https://registry.ollama.ai/v2/library/llama3/manifests/latest", got.String())
+	})
+}
+
+func TestParseModelPathWithOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		arg  string
+		opts ParseOptions
+		err  error
+	}{
+		{"https", "https://example.com/ns/repo:tag", ParseOptions{RequireTLS: true}, nil},
+		{"http public host", "http://example.com/ns/repo:tag", ParseOptions{RequireTLS: true}, ErrInsecureProtocol},
+		{"http localhost", "http://localhost:5000/ns/repo:tag", ParseOptions{RequireTLS: true}, nil},
+		{"http loopback ip", "http://127.0.0.1:5000/ns/repo:tag", ParseOptions{RequireTLS: true}, nil},
+		{"http without tls required", "http://example.com/ns/repo:tag", ParseOptions{}, nil},
+		{"no scheme", "example.com/ns/repo:tag", ParseOptions{RequireTLS: true}, nil},
+		{"unknown scheme", "ftp://example.com/ns/repo:tag", ParseOptions{}, ErrInvalidProtocol},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mp, err := ParseModelPathWithOptions(tc.arg, tc.opts)
+			assert.ErrorIs(t, err, tc.err)
+			if tc.err == nil {
+				assert.Equal(t, ParseModelPath(tc.arg), mp)
+			}
+		})
+	}
+
+	t.Run("env", func(t *testing.T) {
+		t.Cleanup(envconfig.LoadConfig)
+		t.Setenv("OLLAMA_REQUIRE_TLS", "1")
+		envconfig.LoadConfig()
+
+		_, err := ParseModelPathWithOptions("http://example.com/ns/repo:tag", ParseOptions{})
+		assert.ErrorIs(t, err, ErrInsecureProtocol)
+	})
+}
+
+func TestParseDefaultNamespaces(t *testing.T) {
+	dir := t.TempDir()
+	t.Cleanup(envconfig.LoadConfig)
+	t.Setenv("OLLAMA_MODELS", dir)
+	t.Setenv("OLLAMA_DEFAULT_NAMESPACES", "corp.example.com=team-a, localhost:5000=dev, bogus")
+	envconfig.LoadConfig()
+
+	assert.Equal(t, map[string]string{"corp.example.com": "team-a", "localhost:5000": "dev"}, envconfig.DefaultNamespaces)
+
+	opts := ParseOptions{RootRepositories: true}
+	tests := []struct {
+		arg                             string
+		registry, namespace, repository string
+	}{
+		// configured registries
+		{"corp.example.com/model", "corp.example.com", "team-a", "model"},
+		{"https://CORP.example.com:443/model:v1", "CORP.example.com:443", "team-a", "model"},
+		{"localhost:5000/model", "localhost:5000", "dev", "model"},
+		// unconfigured registries
+		{"llama3", DefaultRegistry, DefaultNamespace, "llama3"},
+		{"ollama.com/llama3", DefaultRegistry, DefaultNamespace, "llama3"},
+		{"other.example.com/model", "other.example.com", "", "model"},
+		// explicit namespaces
+		{"corp.example.com/team-b/model", "corp.example.com", "team-b", "model"},
+		{"jmorganca/llama3", DefaultRegistry, "jmorganca", "llama3"},
+	}
+
+	for _, tc := range tests {
+		mp, err := ParseModelPathWithOptions(tc.arg, opts)
+		assert.Nil(t, err, tc.arg)
+		assert.Equal(t, tc.registry, mp.Registry, tc.arg)
+		assert.Equal(t, tc.namespace, mp.Namespace, tc.arg)
+		assert.Equal(t, tc.repository, mp.Repository, tc.arg)
+	}
+
+	assert.Equal(t, "dev", ParseModelPath("localhost:5000/model").Namespace)
+
+	mp, err := NewRef().Registry("corp.example.com").Repository("model").Build()
+	assert.Nil(t, err)
+	assert.Equal(t, "team-a", mp.Namespace)
+
+	// the default registry can be configured too
+	t.Setenv("OLLAMA_DEFAULT_NAMESPACES", "ollama.com=team-c")
+	envconfig.LoadConfig()
+	assert.Equal(t, "team-c", ParseModelPath("llama3").Namespace)
+	assert.Equal(t, "jmorganca", ParseModelPath("jmorganca/llama3").Namespace)
+
+	// root repositories already on disk keep listing as such
+	t.Setenv("OLLAMA_DEFAULT_NAMESPACES", "")
+	envconfig.LoadConfig()
+	mp, err = ParseModelPathWithOptions("corp.example.com/model", opts)
+	assert.Nil(t, err)
+	assert.Nil(t, mp.writeManifest([]byte(`{"schemaVersion":2,"layers":[]}`)))
+
+	t.Setenv("OLLAMA_DEFAULT_NAMESPACES", "corp.example.com=team-a")
+	envconfig.LoadConfig()
+	mps, err := ListModelPaths()
+	assert.Nil(t, err)
+	if assert.Len(t, mps, 1) {
+		assert.Equal(t, "", mps[0].Namespace)
+	}
+}
+
+func TestParsePlusInTags(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", dir)
+
+	for _, name := range []string{"llama3:v1.0+cuda12", "myregistry.com/ns/model:1.2.3+build.5", "llama3:v1.0%2Bcuda12"} {
+		// strict, like Docker
+		_, err := ParseModelPathWithOptions(name, ParseOptions{})
+		assert.ErrorIs(t, err, errModelPathInvalid, name)
+
+		// permissive
+		mp, err := ParseModelPathWithOptions(name, ParseOptions{AllowPlusInTags: true})
+		assert.Nil(t, err, name)
+		assert.Contains(t, mp.Tag, "+", name)
+		assert.Nil(t, mp.ValidateWithOptions(ParseOptions{AllowPlusInTags: true}), name)
+
+		// Validate is strict too, so a plain parse can't sneak the tag past it
+		assert.ErrorIs(t, mp.Validate(), errModelPathInvalid, name)
+		assert.ErrorIs(t, ParseModelPath(name).Validate(), errModelPathInvalid, name)
+
+		// still flagged for registries following the OCI spec
+		ok, warnings := mp.IsPortable()
+		assert.False(t, ok, name)
+		assert.Len(t, warnings, 1, name)
+	}
+
+	mp, err := ParseModelPathWithOptions("llama3:v1.0+cuda12", ParseOptions{AllowPlusInTags: true})
+	assert.Nil(t, err)
+	assert.Equal(t, "v1.0+cuda12", mp.Tag)
+	assert.Equal(t, "llama3", mp.Repository)
+
+	// strict parsing elsewhere reports the tag
+	_, errs := ParseModelPaths(strings.NewReader("llama3:v1.0+cuda12\n"))
+	assert.Len(t, errs, 1)
+
+	// models stored with such a tag are still listed
+	assert.Nil(t, mp.writeManifest([]byte(`{"schemaVersion":2,"layers":[]}`)))
+	mps, err := ListModelPaths()
+	assert.Nil(t, err)
+	if assert.Len(t, mps, 1) {
+		assert.Equal(t, "v1.0+cuda12", mps[0].Tag)
+	}
+}
+
+func TestParseRootRepositories(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", dir)
+
+	opts := ParseOptions{RootRepositories: true}
+	tests := []struct {
+		arg                             string
+		registry, namespace, repository string
+	}{
+		{"myregistry.com/model", "myregistry.com", "", "model"},
+		{"https://myregistry.com/model:v1", "myregistry.com", "", "model"},
+		{"localhost:5000/model", "localhost:5000", "", "model"},
+		{"ollama.ai/llama3", DefaultRegistry, DefaultNamespace, "llama3"},
+		{"registry.ollama.ai:443/llama3", "registry.ollama.ai:443", DefaultNamespace, "llama3"},
+		{"http://myregistry.com:80/model", "myregistry.com:80", "", "model"},
+		{"jmorganca/llama3", DefaultRegistry, "jmorganca", "llama3"},
+		{"myregistry.com/ns/model", "myregistry.com", "ns", "model"},
+	}
+
+	for _, tc := range tests {
+		mp, err := ParseModelPathWithOptions(tc.arg, opts)
+		assert.Nil(t, err, tc.arg)
+		assert.Equal(t, tc.registry, mp.Registry, tc.arg)
+		assert.Equal(t, tc.namespace, mp.Namespace, tc.arg)
+		assert.Equal(t, tc.repository, mp.Repository, tc.arg)
+		assert.Nil(t, mp.Validate(), tc.arg)
+	}
+
+	// without the option the first component remains a namespace
+	assert.Equal(t, "myregistry.com", ParseModelPath("myregistry.com/model").Namespace)
+
+	mp, err := ParseModelPathWithOptions("myregistry.com/model", opts)
+	assert.Nil(t, err)
+
+	p, err := mp.GetManifestPath()
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "manifests", "myregistry.com", "model", "latest"), p)
+
+	assert.Nil(t, mp.writeManifest([]byte(`{"schemaVersion":2,"layers":[]}`)))
+	mps, err := ListModelPaths()
+	assert.Nil(t, err)
+	assert.Equal(t, []ModelPath{mp}, mps)
+}
+
+func TestParseModelPathDefaultNamespace(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	// library only applies on the default registry
+	tests := []struct {
+		arg                             string
+		registry, namespace, repository string
+	}{
+		{"llama3", DefaultRegistry, DefaultNamespace, "llama3"},
+		{"jmorganca/llama3", DefaultRegistry, "jmorganca", "llama3"},
+		{"registry.ollama.ai:443/llama3", "registry.ollama.ai:443", DefaultNamespace, "llama3"},
+		{"localhost:5000/model", "localhost:5000", "", "model"},
+		{"http://myregistry.com:80/model", "myregistry.com:80", "", "model"},
+		{"myregistry.com/ns/model", "myregistry.com", "ns", "model"},
+		{"myregistry.com:5000/library/model", "myregistry.com:5000", DefaultNamespace, "model"},
+	}
+
+	for _, tc := range tests {
+		mp := ParseModelPath(tc.arg)
+		assert.Equal(t, tc.registry, mp.Registry, tc.arg)
+		assert.Equal(t, tc.namespace, mp.Namespace, tc.arg)
+		assert.Equal(t, tc.repository, mp.Repository, tc.arg)
+		assert.Nil(t, mp.Validate(), tc.arg)
+	}
+
+	// models stored in library by earlier versions are still found
+	legacy := ParseModelPath("localhost:5000/library/model")
+	assert.Nil(t, legacy.writeManifest([]byte(`{"schemaVersion":2,"layers":[]}`)))
+	digest, err := ParseModelPath("localhost:5000/model").LocalManifestDigest()
+	assert.Nil(t, err)
+	want, err := legacy.LocalManifestDigest()
+	assert.Nil(t, err)
+	assert.Equal(t, want, digest)
+
+	// and the old default can be restored per registry
+	t.Cleanup(envconfig.LoadConfig)
+	t.Setenv("OLLAMA_DEFAULT_NAMESPACES", "localhost:5000=library")
+	envconfig.LoadConfig()
+	assert.Equal(t, DefaultNamespace, ParseModelPath("localhost:5000/model").Namespace)
+}
+
+func TestGetManifestPathCase(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", dir)
+
+	upper, err := ParseModelPath("Example.com/Library/Llama3:Q4_0").GetManifestPath()
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "manifests", "example.com", "library", "llama3", "Q4_0"), upper)
+
+	lower, err := ParseModelPath("example.com/library/llama3:Q4_0").GetManifestPath()
+	assert.Nil(t, err)
+	assert.Equal(t, lower, upper)
+
+	// like model.Name.Filepath, the tag keeps its case
+	n := model.ParseName("Example.com/Library/Llama3:Q4_0")
+	assert.Equal(t, filepath.Join(dir, "manifests", n.Filepath()), upper)
+
+	// a mixed case manifest written before names were lowercased is still read
+	legacy := filepath.Join(dir, "manifests", DefaultRegistry, "Jmorganca", "Mistral", "latest")
+	assert.Nil(t, os.MkdirAll(filepath.Dir(legacy), 0o755))
+	assert.Nil(t, os.WriteFile(legacy, []byte(`{"schemaVersion":2,"layers":[]}`), 0o644))
+
+	p, err := ParseModelPath("Jmorganca/Mistral").manifestReadPath()
+	assert.Nil(t, err)
+	_, err = os.Stat(p)
+	assert.Nil(t, err)
+}
+
+func TestStorageTag(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", dir)
+
+	implicit := ModelPath{Registry: DefaultRegistry, Namespace: DefaultNamespace, Repository: "llama3"}
+	explicit := ParseModelPath("llama3:latest")
+
+	assert.Equal(t, DefaultTag, implicit.StorageTag())
+	assert.Equal(t, DefaultTag, explicit.StorageTag())
+	assert.Equal(t, "8b", ParseModelPath("llama3:8b").StorageTag())
+
+	implicitPath, err := implicit.GetManifestPath()
+	assert.Nil(t, err)
+	explicitPath, err := explicit.GetManifestPath()
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "manifests", DefaultRegistry, DefaultNamespace, "llama3", DefaultTag), implicitPath)
+	assert.Equal(t, explicitPath, implicitPath)
+
+	assert.True(t, implicit.Equal(explicit))
+	assert.Equal(t, explicit.CacheKey(), implicit.CacheKey())
+
+	assert.False(t, explicit.Equal(ParseModelPath("llama3:8b")))
+	assert.NotEqual(t, explicit.CacheKey(), ParseModelPath("llama3:8b").CacheKey())
+}
+
+func TestModelPathString(t *testing.T) {
+	const digest = "sha256:456402914e838a953e0cf80caa6adbe75383d9e63584a964f504a7bbb8f7aad9"
+
+	assert.Equal(t, "registry.ollama.ai/library/llama3:latest", ParseModelPath("llama3").String())
+	assert.Equal(t, "example.com/ns/repo:tag", ParseModelPath("https://example.com/ns/repo:tag").String())
+	assert.Equal(t, "registry.ollama.ai/library/llama3:latest@"+digest, ParseModelPath("llama3@"+digest).String())
+	assert.Equal(t, "", ModelPath{}.String())
+}
+
+func TestParseModelPathPercentEncoded(t *testing.T) {
+	tests := []struct {
+		name string
+		arg  string
+		want ModelPath
+		err  error
+	}{
+		{
+			"encoded tag",
+			"library/model:v1%2E0",
+			ModelPath{ProtocolScheme: "https", Registry: DefaultRegistry, Namespace: DefaultNamespace, Repository: "model", Tag: "v1.0"},
+			nil,
+		},
+		{
+			"encoded repository",
+			"library/my%2Dmodel",
+			ModelPath{ProtocolScheme: "https", Registry: DefaultRegistry, Namespace: DefaultNamespace, Repository: "my-model", Tag: DefaultTag},
+			nil,
+		},
+		{
+			"invalid encoding kept literally",
+			"library/model:100%",
+			ModelPath{ProtocolScheme: "https", Registry: DefaultRegistry, Namespace: DefaultNamespace, Repository: "model", Tag: "100%"},
+			nil,
+		},
+		{"encoded slash in tag", "library/model:v1%2F0", ModelPath{}, errModelPathInvalid},
+		{"encoded slash in repository", "library/my%2Fmodel", ModelPath{}, errModelPathInvalid},
+		{"encoded colon in tag", "library/model:v1%3A0", ModelPath{}, errModelPathInvalid},
+		{
+			"encoded nested namespace",
+			"example.com/my%2Dorg/team/model",
+			ModelPath{ProtocolScheme: "https", Registry: "example.com", Namespace: "my-org/team", Repository: "model", Tag: DefaultTag},
+			nil,
+		},
+		{"encoded slash in namespace", "a%2Fb/model", ModelPath{}, errModelPathInvalid},
+		{"encoded lowercase slash in namespace", "example.com/org/a%2fb/model", ModelPath{}, errModelPathInvalid},
+		{"encoded traversal", "..%2F..%2F..%2Fescape/model", ModelPath{}, errModelPathInvalid},
+		{"encoded dots in namespace", "example.com/org/%2E%2E/%2e%2e/model", ModelPath{}, errModelPathInvalid},
+		{"encoded dots in repository", "library/%2E%2E", ModelPath{}, errModelPathInvalid},
+		{"encoded dots in tag", "library/model:%2E%2E", ModelPath{}, errModelPathInvalid},
+		{"encoded backslash in namespace", "example.com/..%5C..%5Cescape/model", ModelPath{}, errModelPathInvalid},
+	}
+
+	dir := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", dir)
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := ParseModelPath(tc.arg)
+			err := got.Validate()
+			assert.ErrorIs(t, err, tc.err)
+			if tc.err == nil {
+				assert.Equal(t, tc.want, got)
+				return
+			}
+
+			// nor can the manifest path be built outside the store
+			if p, err := got.GetManifestPath(); err == nil {
+				assert.True(t, strings.HasPrefix(p, filepath.Join(dir, "manifests")+string(filepath.Separator)), p)
+			}
+		})
+	}
+}
+
+func TestRefBuilder(t *testing.T) {
+	t.Run("minimal", func(t *testing.T) {
+		mp, err := NewRef().Repository("llama3").Build()
+		assert.Nil(t, err)
+		assert.Equal(t, ParseModelPath("llama3"), mp)
+	})
+
+	t.Run("full", func(t *testing.T) {
+		mp, err := NewRef().Registry("example.com").Namespace("ns").Repository("repo").Tag("tag").Build()
+		assert.Nil(t, err)
+		assert.Equal(t, ParseModelPath("example.com/ns/repo:tag"), mp)
+	})
+
+	t.Run("reusable", func(t *testing.T) {
+		b := NewRef().Repository("llama3")
+		first, err := b.Build()
+		assert.Nil(t, err)
+
+		second, err := b.Tag("8b").Build()
+		assert.Nil(t, err)
+
+		assert.Equal(t, DefaultTag, first.Tag)
+		assert.Equal(t, "8b", second.Tag)
+	})
+
+	t.Run("registry namespace", func(t *testing.T) {
+		for _, tc := range []struct {
+			registry, namespace string
+		}{
+			{"", DefaultNamespace},
+			{DefaultRegistry, DefaultNamespace},
+			{"Registry.Ollama.AI:443", DefaultNamespace},
+			{"ollama.com", DefaultNamespace},
+			{"myregistry.com", ""},
+			{"localhost:5000", ""},
+		} {
+			mp, err := NewRef().Registry(tc.registry).Repository("model").Build()
+			assert.Nil(t, err, tc.registry)
+			assert.Equal(t, tc.namespace, mp.Namespace, tc.registry)
+		}
+
+		mp, err := NewRef().Registry("myregistry.com").Namespace("team").Repository("model").Build()
+		assert.Nil(t, err)
+		assert.Equal(t, "team", mp.Namespace)
+	})
+
+	t.Run("missing repository", func(t *testing.T) {
+		_, err := NewRef().Namespace("ns").Build()
+		assert.ErrorIs(t, err, errModelPathInvalid)
+	})
+
+	t.Run("invalid tag", func(t *testing.T) {
+		_, err := NewRef().Repository("llama3").Tag("a:b").Build()
+		assert.ErrorIs(t, err, errModelPathInvalid)
+	})
+}
+
+func TestValidateControlCharacters(t *testing.T) {
+	tests := []struct {
+		name string
+		mp   ModelPath
+	}{
+		{"newline in tag", ParseModelPath("llama3:latest\nINJECTED")},
+		{"carriage return in repository", ParseModelPath("llama\r3")},
+		{"nul in namespace", ParseModelPath("li\x00brary/llama3")},
+		{"escape in registry", ModelPath{Registry: "example.com\x1b[2J", Namespace: "ns", Repository: "repo", Tag: "tag"}},
+		{"encoded newline", ParseModelPath("llama3:v1%0A")},
+		{"invalid utf-8 in tag", ParseModelPath("llama3:\xff\xfe")},
+		{"invalid utf-8 in repository", ParseModelPath("llama\xc33")},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.ErrorIs(t, tc.mp.Validate(), errModelPathInvalid)
+		})
+	}
+
+	assert.Nil(t, ParseModelPath("llama3:v1.0-überfast").Validate())
+}
+
+func TestValidatePathComponents(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", dir)
+
+	for _, name := range []string{
+		"example.com/../../../x/model",
+		"example.com/org/../model",
+		"example.com/org/./model",
+		"example.com/org//team/model",
+		"../ns/model",
+		"library/..",
+		"library/model:..",
+		"library/model:.",
+		"example.com/o:rg/team/model",
+		`example.com/org\..\..\team/model`,
+	} {
+		mp := ParseModelPath(name)
+		assert.ErrorIs(t, mp.Validate(), errModelPathInvalid, name)
+
+		_, err := mp.GetManifestPath()
+		assert.ErrorIs(t, err, errModelPathInvalid, name)
+	}
+
+	for _, mp := range []ModelPath{
+		{Registry: DefaultRegistry, Namespace: "a/../../b", Repository: "model", Tag: DefaultTag},
+		{Registry: "a/..", Namespace: "ns", Repository: "model", Tag: DefaultTag},
+		{Registry: DefaultRegistry, Namespace: "ns", Repository: `..\model`, Tag: DefaultTag},
+	} {
+		assert.ErrorIs(t, mp.Validate(), errModelPathInvalid, mp.Namespace)
+	}
+
+	// dots within names are fine
+	for _, name := range []string{"ghcr.io/org.name/team/model:v1.0", "library/..model", "library/model:v1..2"} {
+		mp := ParseModelPath(name)
+		assert.Nil(t, mp.Validate(), name)
+
+		p, err := mp.GetManifestPath()
+		assert.Nil(t, err, name)
+		assert.True(t, strings.HasPrefix(p, filepath.Join(dir, "manifests")+string(filepath.Separator)), p)
+	}
+}
+
+func TestCanonicalizeRef(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("ab", 32)
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"llama3", "llama3:latest"},
+		{"llama3:", "llama3:latest"},
+		{"library/llama3:8b", "llama3:8b"},
+		{"Registry.Ollama.AI/library/llama3", "llama3:latest"},
+		{"https://ollama.com/library/llama3", "llama3:latest"},
+		{"jmorganca/llama3", "jmorganca/llama3:latest"},
+		{"Example.COM/ns/repo:tag", "example.com/ns/repo:tag"},
+		{"llama3@sha256-" + strings.Repeat("AB", 32), "llama3:latest@" + digest},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := CanonicalizeRef(tc.name)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+
+	for _, name := range []string{
+		"",
+		"library/",
+		"llama3:a:b",
+		"llama3@sha256:1234",
+		"ftp://example.com/ns/repo",
+		"llama3:v1\n",
+	} {
+		t.Run("invalid "+name, func(t *testing.T) {
+			_, err := CanonicalizeRef(name)
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestPathsDoNotCreateDirectories(t *testing.T) {
+	models := filepath.Join(t.TempDir(), "models")
+	t.Setenv("OLLAMA_MODELS", models)
+
+	digest := "sha256:" + strings.Repeat("ab", 32)
+
+	for _, sharding := range []string{"false", "true"} {
+		t.Run("sharding "+sharding, func(t *testing.T) {
+			t.Cleanup(envconfig.LoadConfig)
+			t.Setenv("OLLAMA_BLOB_SHARDING", sharding)
+			envconfig.LoadConfig()
+
+			blobs, err := BlobsPath("")
+			assert.Nil(t, err)
+			assert.Equal(t, filepath.Join(models, "blobs"), blobs)
+
+			blob, err := BlobsPath(digest)
+			assert.Nil(t, err)
+			if envconfig.BlobSharding {
+				assert.Equal(t, filepath.Join(blobs, "ab", "sha256-"+strings.Repeat("ab", 32)), blob)
+			} else {
+				assert.Equal(t, filepath.Join(blobs, "sha256-"+strings.Repeat("ab", 32)), blob)
+			}
+
+			blob, err = BlobsPath("sha512:" + strings.Repeat("cd", 64))
+			assert.Nil(t, err)
+			if envconfig.BlobSharding {
+				assert.Equal(t, filepath.Join(blobs, "cd", "sha512-"+strings.Repeat("cd", 64)), blob)
+			} else {
+				assert.Equal(t, filepath.Join(blobs, "sha512-"+strings.Repeat("cd", 64)), blob)
+			}
+
+			manifests, err := ManifestsPath()
+			assert.Nil(t, err)
+			assert.Equal(t, filepath.Join(models, "manifests"), manifests)
+
+			_, err = ParseModelPath("llama3").GetManifestPath()
+			assert.Nil(t, err)
+
+			_, err = BlobsPath("sha256:1234")
+			assert.ErrorIs(t, err, ErrInvalidDigestFormat)
+
+			_, err = BlobsPath("sha512:" + strings.Repeat("ab", 32))
+			assert.ErrorIs(t, err, ErrInvalidDigestFormat)
+
+			_, err = os.Stat(models)
+			assert.ErrorIs(t, err, os.ErrNotExist)
+		})
+	}
+}
+
+func TestBlobAlgorithm(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", dir)
+
+	for algorithm, size := range map[string]int{"sha256": 32, "sha512": 64} {
+		hex := strings.Repeat("ab", size)
+		for _, digest := range []string{algorithm + ":" + hex, algorithm + "-" + hex} {
+			p, err := GetBlobsPath(digest)
+			assert.Nil(t, err, digest)
+			assert.Equal(t, filepath.Join(dir, "blobs", algorithm+"-"+hex), p, digest)
+
+			got, err := BlobAlgorithm(p)
+			assert.Nil(t, err, p)
+			assert.Equal(t, algorithm, got, p)
+
+			// the digest is recovered from the name too
+			assert.Equal(t, algorithm+":"+hex, strings.Replace(filepath.Base(p), "-", ":", 1), p)
+		}
+	}
+
+	for _, digest := range []string{
+		"sha512:" + strings.Repeat("ab", 32),
+		"sha256:" + strings.Repeat("ab", 64),
+		"md5:" + strings.Repeat("ab", 16),
+	} {
+		_, err := GetBlobsPath(digest)
+		assert.ErrorIs(t, err, ErrInvalidDigestFormat, digest)
+	}
+
+	for _, p := range []string{
+		filepath.Join(dir, "blobs", "sha256:"+strings.Repeat("ab", 32)),
+		filepath.Join(dir, "blobs", "sha512-"+strings.Repeat("ab", 32)),
+		filepath.Join(dir, "blobs", "sha256-"+strings.Repeat("ab", 32)+"-partial"),
+		filepath.Join(dir, "blobs", "locks"),
+		"",
+	} {
+		_, err := BlobAlgorithm(p)
+		assert.ErrorIs(t, err, ErrInvalidDigestFormat, p)
+	}
+}
+
+func TestParseBlobRef(t *testing.T) {
+	hex := strings.Repeat("ab", 32)
+
+	for _, s := range []string{"sha256:" + hex, "sha256-" + hex, "sha256:" + strings.ToUpper(hex)} {
+		digest, err := ParseBlobRef(s)
+		assert.Nil(t, err)
+		assert.Equal(t, "sha256:"+hex, digest)
+	}
+
+	for _, s := range []string{
+		"",
+		"sha256:" + hex[:63],
+		"sha256:" + hex + "a",
+		"sha512:" + hex,
+		hex,
+		"llama3",
+		"llama3@sha256:" + hex,
+		"library/llama3:sha256-" + hex,
+	} {
+		_, err := ParseBlobRef(s)
+		assert.ErrorIs(t, err, ErrInvalidDigestFormat, s)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	models := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", models)
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	host := strings.TrimPrefix(srv.URL, "https://")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	assert.Nil(t, os.MkdirAll(filepath.Join(models, "certs", host), 0o755))
+	assert.Nil(t, os.WriteFile(filepath.Join(models, "certs", host, "ca.crt"), ca, 0o644))
+
+	t.Run("custom CA", func(t *testing.T) {
+		cfg, err := ParseModelPath(host + "/ns/repo").TLSConfig()
+		assert.Nil(t, err)
+		assert.NotNil(t, cfg)
+
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+		resp, err := client.Get(srv.URL)
+		assert.Nil(t, err)
+		resp.Body.Close()
+
+		u, err := url.Parse(srv.URL)
+		assert.Nil(t, err)
+
+		resp, err = makeRequest(context.Background(), http.MethodGet, u, nil, nil, nil)
+		assert.Nil(t, err)
+		resp.Body.Close()
+	})
+
+	t.Run("default", func(t *testing.T) {
+		cfg, err := ParseModelPath("llama3").TLSConfig()
+		assert.Nil(t, err)
+		assert.Nil(t, cfg)
+	})
+
+	t.Run("invalid CA", func(t *testing.T) {
+		assert.Nil(t, os.MkdirAll(filepath.Join(models, "certs", "bad.example.com"), 0o755))
+		assert.Nil(t, os.WriteFile(filepath.Join(models, "certs", "bad.example.com", "ca.crt"), []byte("not a certificate"), 0o644))
+
+		_, err := ParseModelPath("bad.example.com/ns/repo").TLSConfig()
+		assert.NotNil(t, err)
+	})
+
+	t.Run("invalid host", func(t *testing.T) {
+		_, err := ModelPath{Registry: ".."}.TLSConfig()
+		assert.ErrorIs(t, err, errModelPathInvalid)
+	})
+}
+
+func TestIsFullyQualified(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("ab", 32)
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"llama3", false},
+		{"llama3:8b", false},
+		{"library/llama3:8b", false},
+		{"localhost:5000/llama3:8b", false},
+		{"registry.ollama.ai/library/llama3", false},
+		{"registry.ollama.ai/library/llama3:", false},
+		{"registry.ollama.ai/library/llama3:8b", true},
+		{"https://registry.ollama.ai/library/llama3:8b", true},
+		{"ghcr.io/org/team/model:v1", true},
+		{"registry.ollama.ai/library/llama3@" + digest, true},
+		{"a/b/c/d:v1", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, ParseModelPath(tc.name).IsFullyQualified(tc.name))
+		})
+	}
+
+	assert.False(t, ParseModelPath("llama3:8b").IsFullyQualified("registry.ollama.ai/library/mistral:8b"))
+}
+
+func TestEqualIgnoringRegistry(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"llama3", "mirror.example.com/library/llama3:latest", true},
+		{"library/llama3:8b", "localhost:5000/library/llama3:8b", true},
+		{"llama3:8b", "mirror.example.com/library/llama3:70b", false},
+		{"llama3", "mirror.example.com/jmorganca/llama3", false},
+		{"llama3", "mirror.example.com/library/llama2", false},
+		{"Library/Llama3", "mirror.example.com/library/llama3", true},
+		{"llama3:Q4", "mirror.example.com/library/llama3:q4", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.a+" "+tc.b, func(t *testing.T) {
+			a, b := ParseModelPath(tc.a), ParseModelPath(tc.b)
+			assert.Equal(t, tc.want, a.EqualIgnoringRegistry(b))
+			assert.Equal(t, tc.want, b.EqualIgnoringRegistry(a))
+		})
+	}
+
+	assert.True(t, ModelPath{Namespace: "library", Repository: "llama3"}.EqualIgnoringRegistry(ParseModelPath("llama3")))
+}
+
+func TestValidateReservedTags(t *testing.T) {
+	for _, tag := range []string{"blobs", "manifests", "quarantine", "certs", "Blobs", ".", "..", ".ollamaignore", ".latest-12345", "sha256-" + strings.Repeat("ab", 32)} {
+		t.Run(tag, func(t *testing.T) {
+			mp := ParseModelPath("llama3")
+			mp.Tag = tag
+			assert.ErrorIs(t, mp.Validate(), errModelPathInvalid)
+		})
+	}
+
+	for _, tag := range []string{"latest", "8b", "blobs-v2", "my.quarantine", "sha256"} {
+		t.Run(tag, func(t *testing.T) {
+			mp := ParseModelPath("llama3")
+			mp.Tag = tag
+			assert.Nil(t, mp.Validate())
+		})
+	}
+}
+
+func TestOfflineMode(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	SetOffline(true)
+	t.Cleanup(func() { SetOffline(false) })
+
+	mp := ParseModelPath("llama3")
+	digest := "sha256:" + strings.Repeat("ab", 32)
+
+	_, err := mp.BaseURL()
+	assert.ErrorIs(t, err, ErrOfflineMode)
+
+	_, err = mp.BlobURL(digest)
+	assert.ErrorIs(t, err, ErrOfflineMode)
+
+	_, err = mp.ManifestURL()
+	assert.ErrorIs(t, err, ErrOfflineMode)
+
+	_, err = mp.GetManifestPath()
+	assert.Nil(t, err)
+
+	_, err = GetBlobsPath(digest)
+	assert.Nil(t, err)
+
+	SetOffline(false)
+
+	u, err := mp.ManifestURL()
+	assert.Nil(t, err)
+	assert.Equal(t, "https://"+DefaultRegistry+"/v2/library/llama3/manifests/latest", u.String())
+}
+
+func TestParseDigestAlias(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("ab", 32)
+
+	mp, err := ParseModelPathWithOptions("repo@"+digest, ParseOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, digest, mp.Digest)
+	assert.Nil(t, mp.Validate())
+
+	for _, name := range []string{"repo@latest", "ns/repo:v1@latest", "repo@sha256:1234"} {
+		_, err := ParseModelPathWithOptions(name, ParseOptions{})
+		assert.ErrorIs(t, err, ErrInvalidDigestFormat, name)
+		assert.ErrorContains(t, err, strings.SplitN(name, "@", 2)[1])
+
+		assert.ErrorIs(t, ParseModelPath(name).Validate(), ErrInvalidDigestFormat, name)
+	}
+}
+
+func TestRelBlobPath(t *testing.T) {
+	models := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", models)
+
+	hex := strings.Repeat("ab", 32)
+	for _, sharding := range []string{"false", "true"} {
+		t.Run("sharding "+sharding, func(t *testing.T) {
+			t.Cleanup(envconfig.LoadConfig)
+			t.Setenv("OLLAMA_BLOB_SHARDING", sharding)
+			envconfig.LoadConfig()
+
+			rel, err := RelBlobPath("sha256:" + hex)
+			assert.Nil(t, err)
+
+			if envconfig.BlobSharding {
+				assert.Equal(t, "blobs/ab/sha256-"+hex, rel)
+			} else {
+				assert.Equal(t, "blobs/sha256-"+hex, rel)
+			}
+
+			blob, err := GetBlobsPath("sha256:" + hex)
+			assert.Nil(t, err)
+			assert.Equal(t, blob, filepath.Join(models, rel))
+		})
+	}
+
+	_, err := RelBlobPath("")
+	assert.ErrorIs(t, err, ErrInvalidDigestFormat)
+
+	_, err = RelBlobPath("sha256:1234")
+	assert.ErrorIs(t, err, ErrInvalidDigestFormat)
+}
+
+func TestIsStoreBlobPath(t *testing.T) {
+	models := t.TempDir()
+	other := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", models+string(filepath.ListSeparator)+other)
+
+	hex := strings.Repeat("ab", 32)
+	hex512 := strings.Repeat("cd", 64)
+	tests := []struct {
+		path string
+		ok   bool
+	}{
+		{filepath.Join(models, "blobs", "sha256-"+hex), true},
+		{filepath.Join(models, "blobs", "ab", "sha256-"+hex), true},
+		{filepath.Join(other, "blobs", "sha256-"+hex), true},
+		{filepath.Join(models, "blobs", "ab", "..", "sha256-"+hex), true},
+		{filepath.Join(models, "blobs", "sha512-"+hex512), true},
+		{filepath.Join(models, "blobs", "cd", "sha512-"+hex512), true},
+		{filepath.Join(models, "blobs", "ab", "sha512-"+hex512), false},
+		{filepath.Join(models, "blobs", "sha512-"+hex), false},
+		{filepath.Join(models, "blobs", "sha256:"+hex), false},
+		{filepath.Join(models, "blobs", "cd", "sha256-"+hex), false},
+		{filepath.Join(models, "blobs", "ab", "ab", "sha256-"+hex), false},
+		{filepath.Join(models, "blobs", "sha256-1234"), false},
+		{filepath.Join(models, "blobs", "sha256-"+hex+"-partial"), false},
+		{filepath.Join(models, "manifests", "sha256-"+hex), false},
+		{filepath.Join(models, "blobs", "..", "sha256-"+hex), false},
+		{filepath.Join(t.TempDir(), "blobs", "sha256-"+hex), false},
+	}
+
+	for _, tc := range tests {
+		digest, ok := IsStoreBlobPath(tc.path)
+		assert.Equal(t, tc.ok, ok, tc.path)
+		if tc.ok {
+			assert.Equal(t, strings.Replace(filepath.Base(tc.path), "-", ":", 1), digest, tc.path)
+		}
+	}
+}
+
+func TestRequiresNamespace(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		err      error
+	}{
+		{"jmorganca/llama3", "jmorganca", nil},
+		{"JMorganca/llama3", "jmorganca", nil},
+		{"jmorganca/llama3", "", nil},
+		{"llama3", "jmorganca", errNamespaceMismatch},
+		{"someone/llama3", "jmorganca", errNamespaceMismatch},
+		{"example.com/someone/llama3", "jmorganca", nil},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.ErrorIs(t, ParseModelPath(tc.name).RequiresNamespace(tc.username), tc.err)
+		})
+	}
+
+	err := ParseModelPath("llama3:8b").RequiresNamespace("jmorganca")
+	assert.ErrorContains(t, err, "jmorganca/llama3:8b")
+}
+
+func TestDigestDerivedTag(t *testing.T) {
+	digest := "sha256:456402914e838a953e0cf80caa6adbe75383d9e63584a964f504a7bbb8f7aad9"
+
+	mp, err := ParseModelPath("jmorganca/llama3:latest").DigestDerivedTag(digest)
+	assert.Nil(t, err)
+	assert.Equal(t, "sha-456402914e83", mp.Tag)
+	assert.Equal(t, "jmorganca/llama3:sha-456402914e83", mp.GetShortTagname())
+
+	upper, err := ParseModelPath("llama3").DigestDerivedTag(strings.Replace(strings.ToUpper(digest), "SHA256:", "sha256-", 1))
+	assert.Nil(t, err)
+	assert.Equal(t, "sha-456402914e83", upper.Tag)
+
+	_, err = ParseModelPath("llama3").DigestDerivedTag("sha256:1234")
+	assert.ErrorIs(t, err, ErrInvalidDigestFormat)
+
+	_, err = ModelPath{}.DigestDerivedTag(digest)
+	assert.ErrorIs(t, err, errModelPathInvalid)
+}
+
+func TestDefaultPortRegistry(t *testing.T) {
+	tests := []struct {
+		name, short string
+	}{
+		{"registry.ollama.ai:443/library/llama3", "llama3:latest"},
+		{"https://registry.ollama.ai:443/jmorganca/llama3:8b", "jmorganca/llama3:8b"},
+		{"http://registry.ollama.ai:80/library/llama3", "llama3:latest"},
+		{"http://registry.ollama.ai:443/library/llama3", "registry.ollama.ai:443/library/llama3:latest"},
+		{"registry.ollama.ai:8443/library/llama3", "registry.ollama.ai:8443/library/llama3:latest"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.short, ParseModelPath(tc.name).GetShortTagname())
+		})
+	}
+
+	assert.True(t, ParseModelPath("registry.ollama.ai:443/library/llama3").Equal(ParseModelPath("llama3")))
+	assert.Equal(t, ParseModelPath("llama3").CacheKey(), ParseModelPath("registry.ollama.ai:443/library/llama3").CacheKey())
+	assert.Equal(t, ParseModelPath("example.com/ns/repo").CacheKey(), ParseModelPath("example.com:443/ns/repo").CacheKey())
+	assert.NotEqual(t, ParseModelPath("example.com/ns/repo").CacheKey(), ParseModelPath("example.com:5000/ns/repo").CacheKey())
+	assert.ErrorIs(t, ParseModelPath("registry.ollama.ai:443/library/llama3").RequiresNamespace("jmorganca"), errNamespaceMismatch)
+}
+
+func TestValidateFromReference(t *testing.T) {
+	valid := []struct {
+		line string
+		want string
+	}{
+		{"FROM llama3", "llama3:latest"},
+		{"from llama3:8b", "llama3:8b"},
+		{"  FROM\tjmorganca/llama3:v1  ", "jmorganca/llama3:v1"},
+		{"FROM example.com/ns/repo:tag", "example.com/ns/repo:tag"},
+		{"llama3", "llama3:latest"},
+	}
+
+	for _, tc := range valid {
+		t.Run(tc.line, func(t *testing.T) {
+			mp, err := ValidateFromReference(tc.line)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.want, mp.GetShortTagname())
+		})
+	}
+
+	invalid := []string{
+		"FROM",
+		"FROM ",
+		"FROM llama3 extra",
+		"FROM llama3:a:b",
+		"FROM ftp://example.com/ns/repo",
+		"FROM ./model.gguf",
+		"FROM /models/model.gguf",
+		"FROM llama3@latest",
+	}
+
+	for _, line := range invalid {
+		t.Run(line, func(t *testing.T) {
+			_, err := ValidateFromReference(line)
+			assert.NotNil(t, err)
+			assert.ErrorContains(t, err, fmt.Sprintf("%q", line))
+		})
+	}
+}
+
+func TestDefaultAuthParams(t *testing.T) {
+	for _, name := range []string{"llama3", "registry.ollama.ai/jmorganca/llama3", "ollama.com/library/llama3", "registry.ollama.ai:443/library/llama3"} {
+		realm, service, ok := ParseModelPath(name).DefaultAuthParams()
+		assert.True(t, ok, name)
+		assert.Equal(t, "https://ollama.com/token", realm, name)
+		assert.Equal(t, "ollama.com", service, name)
+	}
+
+	for _, name := range []string{"ghcr.io/org/model", "localhost:5000/model", "registry.ollama.ai:5000/library/llama3"} {
+		realm, service, ok := ParseModelPath(name).DefaultAuthParams()
+		assert.False(t, ok, name)
+		assert.Empty(t, realm, name)
+		assert.Empty(t, service, name)
+	}
+}
+
+func TestNormalizeSeparators(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	tests := []struct {
+		arg, want string
+	}{
+		{`library\llama3:v1.0`, "library/llama3:v1.0"},
+		{`registry.ollama.ai\library\llama3`, "registry.ollama.ai/library/llama3"},
+		{`localhost:5000\ns\model:v1`, "localhost:5000/ns/model:v1"},
+		{`localhost:5000\model`, "localhost:5000/model"},
+		{`llama3:v1\x`, `llama3:v1\x`},
+		{`ns\repo:v1\x`, `ns/repo:v1\x`},
+		{`ns\repo@` + digest, "ns/repo@" + digest},
+		{`ns\repo:tag@` + digest, "ns/repo:tag@" + digest},
+	}
+
+	for _, tc := range tests {
+		assert.Equal(t, tc.want, normalizeSeparators(tc.arg, '\\'), tc.arg)
+		assert.Equal(t, tc.arg, normalizeSeparators(tc.arg, '/'), tc.arg)
+	}
+}
+
+func TestValidateFilesystemSafe(t *testing.T) {
+	tests := []struct {
+		name        string
+		unix, win   bool
+		errContains string
+	}{
+		{"llama3:8b-q4_0", true, true, ""},
+		{"example.com/org/team/model:v1.0", true, true, ""},
+		{"localhost:5000/model", true, false, "registry"},
+		{"library/llama3:con", true, false, "reserved device name"},
+		{"library/aux.txt:latest", true, false, "reserved device name"},
+		{"library/llama3:v1.", true, false, "end with"},
+		{"library/llama3:a*b", true, false, "not allowed"},
+		{`library/llama3:a"b`, true, false, "not allowed"},
+		{"library/llama3:" + strings.Repeat("a", 256), false, false, "255 bytes"},
+		{"library/llama3:a%00b", false, false, "NUL"},
+	}
+
+	for _, tc := range tests {
+		mp := ParseModelPath(tc.name)
+		for _, goos := range []string{"linux", "windows"} {
+			ok := tc.unix
+			if goos == "windows" {
+				ok = tc.win
+			}
+
+			err := mp.validateFilesystemSafe(goos)
+			if ok {
+				assert.Nil(t, err, tc.name, goos)
+				continue
+			}
+
+			assert.ErrorIs(t, err, errModelPathInvalid, tc.name, goos)
+			assert.ErrorContains(t, err, tc.errContains, tc.name, goos)
+		}
+	}
+}
+
+func TestParseModelPaths(t *testing.T) {
+	list := `# models for the build farm
+llama3:8b
+
+  jmorganca/mistral  
+ghcr.io/org/team/model:v1
+repo@latest
+# disabled: phi3
+ftp://example.com/ns/repo
+library/llama3:v1:v2
+`
+
+	mps, errs := ParseModelPaths(strings.NewReader(list))
+
+	var names []string
+	for _, mp := range mps {
+		names = append(names, mp.GetShortTagname())
+	}
+
+	assert.Equal(t, []string{"llama3:8b", "jmorganca/mistral:latest", "ghcr.io/org/team/model:v1"}, names)
+
+	assert.Len(t, errs, 3)
+	if len(errs) == 3 {
+		assert.ErrorIs(t, errs[0], ErrInvalidDigestFormat)
+		assert.ErrorContains(t, errs[0], "line 6")
+		assert.ErrorIs(t, errs[1], ErrInvalidProtocol)
+		assert.ErrorContains(t, errs[1], "line 8")
+		assert.ErrorIs(t, errs[2], errModelPathInvalid)
+		assert.ErrorContains(t, errs[2], "line 9")
+	}
+}
+
+func TestBlobLockPath(t *testing.T) {
+	models := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", models)
+
+	hex := strings.Repeat("ab", 32)
+	want := filepath.Join(models, "blobs", "locks", "sha256-"+hex+".lock")
+	for _, digest := range []string{"sha256:" + hex, "sha256-" + hex, "sha256:" + strings.ToUpper(hex)} {
+		p, err := BlobLockPath(digest)
+		assert.Nil(t, err, digest)
+		assert.Equal(t, want, p, digest)
+	}
+
+	fi, err := os.Stat(filepath.Dir(want))
+	assert.Nil(t, err)
+	assert.True(t, fi.IsDir())
+
+	for _, digest := range []string{"", "sha256:1234", "../sha256-" + hex} {
+		_, err := BlobLockPath(digest)
+		assert.ErrorIs(t, err, ErrInvalidDigestFormat, digest)
+	}
+}
+
+func TestRegistryOnly(t *testing.T) {
+	for _, name := range []string{"registry.ollama.ai/", "ollama.com/", "example.com/", "localhost:5000/", "https://ghcr.io/", "ghcr.io/org/"} {
+		err := ParseModelPath(name).Validate()
+		assert.ErrorIs(t, err, ErrRegistryOnly, name)
+		assert.ErrorIs(t, err, errModelPathInvalid, name)
+	}
+
+	for _, name := range []string{"localhost:5000", "127.0.0.1:11434", "http://localhost:5000", "myregistry.com:5000", "https://ghcr.io:443", "10.0.0.2:5000"} {
+		_, err := ParseModelPathWithOptions(name, ParseOptions{})
+		assert.ErrorIs(t, err, ErrRegistryOnly, name)
+
+		err = ParseModelPath(name).Validate()
+		assert.ErrorIs(t, err, ErrRegistryOnly, name)
+		assert.ErrorIs(t, err, errModelPathInvalid, name)
+	}
+
+	// an empty repository without a registry keeps the generic error
+	for _, name := range []string{"", "ns/", "a/b/c/d"} {
+		err := ParseModelPath(name).Validate()
+		assert.ErrorIs(t, err, errModelPathInvalid, name)
+		assert.NotErrorIs(t, err, ErrRegistryOnly, name)
+	}
+
+	for _, name := range []string{"llama3:8b", "llama3.1:8b", "llama3.1:8", "qwen2.5:7", "localhost:5000/llama3", "myregistry.com:5000/ns/model", "localhost"} {
+		mp, err := ParseModelPathWithOptions(name, ParseOptions{})
+		assert.Nil(t, err, name)
+		assert.Nil(t, mp.Validate(), name)
+	}
+}
+
+func TestDisplayName(t *testing.T) {
+	hex := "abc123def456" + strings.Repeat("0", 52)
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"llama3", "llama3:latest"},
+		{"jmorganca/llama3:8b", "jmorganca/llama3:8b"},
+		{"ghcr.io/org/model:v1", "ghcr.io/org/model:v1"},
+		{"llama3@sha256:" + hex, "llama3@sha256:abc123def456…"},
+		{"llama3:8b@sha256-" + strings.ToUpper(hex), "llama3@sha256:abc123def456…"},
+		{"ghcr.io/org/model@sha256:" + hex, "ghcr.io/org/model@sha256:abc123def456…"},
+		{"", ""},
+	}
+
+	for _, tc := range tests {
+		assert.Equal(t, tc.want, ParseModelPath(tc.name).DisplayName(), tc.name)
+	}
+
+	mp := ParseModelPath("llama3@sha256:" + hex)
+	mp.Tag = ""
+	assert.Equal(t, "llama3@sha256:abc123def456…", mp.DisplayName())
+}
+
+func TestIsPortable(t *testing.T) {
+	for _, name := range []string{"llama3", "llama3:8b-instruct-q4_0", "jmorganca/llama3.1:v1.0", "ghcr.io/org/team/my_model__v2:Latest", "localhost:5000/ns/a--b"} {
+		ok, warnings := ParseModelPath(name).IsPortable()
+		assert.True(t, ok, name)
+		assert.Empty(t, warnings, name)
+	}
+
+	tests := []struct {
+		name     string
+		warnings []string
+	}{
+		{"Library/Llama3", []string{`namespace "Library" contains uppercase letters`, `repository "Llama3" contains uppercase letters`}},
+		{"Example.com/ns/repo", []string{`registry "Example.com" contains uppercase letters`}},
+		{"ns/modèle", []string{`repository "modèle" contains non-ASCII characters`}},
+		{"ns/my..model", []string{`repository "my..model" must be lowercase letters and digits separated by '.', '_', '__' or '-'`}},
+		{"ns/-model", []string{`repository "-model" must be lowercase letters and digits separated by '.', '_', '__' or '-'`}},
+		{"ns/model:" + strings.Repeat("a", 129), []string{`tag "` + strings.Repeat("a", 129) + `" is longer than 128 characters`}},
+		{"ns/model:-v1", []string{`tag "-v1" must be letters, digits, '_', '.' and '-' and not start with '.' or '-'`}},
+		{"ns/model:v1+build", []string{`tag "v1+build" must be letters, digits, '_', '.' and '-' and not start with '.' or '-'`}},
+		{"ns/" + strings.Repeat("a", 253), []string{`name "ns/` + strings.Repeat("a", 253) + `" is longer than 255 characters`}},
+	}
+
+	for _, tc := range tests {
+		ok, warnings := ParseModelPath(tc.name).IsPortable()
+		assert.False(t, ok, tc.name)
+		assert.Equal(t, tc.warnings, warnings, tc.name)
+	}
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseModelPathBackslashWindows(t *testing.T) {
+	tests := []struct {
+		arg                             string
+		registry, namespace, repository string
+		tag                             string
+	}{
+		{`library\llama3:v1.0`, DefaultRegistry, "library", "llama3", "v1.0"},
+		{`jmorganca\llama3`, DefaultRegistry, "jmorganca", "llama3", DefaultTag},
+		{`example.com\ns\model:8b`, "example.com", "ns", "model", "8b"},
+		{`localhost:5000\model`, "localhost:5000", "", "model", DefaultTag},
+		{`llama3:v1\x`, DefaultRegistry, DefaultNamespace, "llama3", `v1\x`},
+	}
+
+	for _, tc := range tests {
+		mp := ParseModelPath(tc.arg)
+		assert.Equal(t, tc.registry, mp.Registry, tc.arg)
+		assert.Equal(t, tc.namespace, mp.Namespace, tc.arg)
+		assert.Equal(t, tc.repository, mp.Repository, tc.arg)
+		assert.Equal(t, tc.tag, mp.Tag, tc.arg)
+	}
+
+	assert.ErrorIs(t, ParseModelPath(`llama3:v1\x`).Validate(), errModelPathInvalid)
+}
+
+func TestValidateFilesystemSafeWindows(t *testing.T) {
+	assert.Nil(t, ParseModelPath("library/llama3:8b").ValidateFilesystemSafe())
+	assert.ErrorIs(t, ParseModelPath("library/llama3:con").ValidateFilesystemSafe(), errModelPathInvalid)
+	assert.ErrorIs(t, ParseModelPath("localhost:5000/model").ValidateFilesystemSafe(), errModelPathInvalid)
+}
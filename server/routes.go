@@ -717,15 +717,44 @@ func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
 }
 
 func (s *Server) ListModelsHandler(c *gin.Context) {
-	manifests, err := GetManifestPath()
+	if _, err := GetManifestPath(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	manifestsPaths, err := manifestsDirs()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
 	var models []api.ModelResponse
-	if err := filepath.Walk(manifests, func(path string, info os.FileInfo, _ error) error {
-		if !info.IsDir() {
+	if _, ok := activeStore().(FileStore); ok {
+		seen := make(map[string]bool)
+		for _, manifests := range manifestsPaths {
+			if err := listModels(manifests, seen, &models); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+	} else if models, err = listStoreModels(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	slices.SortStableFunc(models, func(i, j api.ModelResponse) int {
+		// most recently modified first
+		return cmp.Compare(j.ModifiedAt.Unix(), i.ModifiedAt.Unix())
+	})
+
+	c.JSON(http.StatusOK, api.ListResponse{Models: models})
+}
+
+// listModels appends the models in the manifests directory manifests to
+// models, skipping those already seen in an earlier models directory.
+func listModels(manifests string, seen map[string]bool, models *[]api.ModelResponse) error {
+	return filepath.Walk(manifests, func(path string, info os.FileInfo, _ error) error {
+		if info != nil && !info.IsDir() {
 			rel, err := filepath.Rel(manifests, path)
 			if err != nil {
 				return err
@@ -733,9 +762,10 @@ func (s *Server) ListModelsHandler(c *gin.Context) {
 
 			if hidden, err := filepath.Match(".*", filepath.Base(rel)); err != nil {
 				return err
-			} else if hidden {
+			} else if hidden || seen[rel] {
 				return nil
 			}
+			seen[rel] = true
 
 			n := model.ParseNameFromFilepath(rel)
 			if !n.IsValid() {
@@ -763,7 +793,7 @@ func (s *Server) ListModelsHandler(c *gin.Context) {
 			}
 
 			// tag should never be masked
-			models = append(models, api.ModelResponse{
+			*models = append(*models, api.ModelResponse{
 				Model:      n.DisplayShortest(),
 				Name:       n.DisplayShortest(),
 				Size:       m.Size(),
@@ -780,17 +810,69 @@ func (s *Server) ListModelsHandler(c *gin.Context) {
 		}
 
 		return nil
-	}); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	})
+}
+
+// listStoreModels returns the models in a Store installed with SetStore. Such
+// a store doesn't record when manifests were modified, so ModifiedAt is left
+// unset.
+func listStoreModels() ([]api.ModelResponse, error) {
+	mps, err := ListModelPaths()
+	if err != nil {
+		return nil, err
 	}
 
-	slices.SortStableFunc(models, func(i, j api.ModelResponse) int {
-		// most recently modified first
-		return cmp.Compare(j.ModifiedAt.Unix(), i.ModifiedAt.Unix())
-	})
+	var models []api.ModelResponse
+	for _, mp := range mps {
+		m, digest, err := GetManifest(mp)
+		if err != nil {
+			slog.Warn("bad manifest", "name", mp, "error", err)
+			continue
+		}
 
-	c.JSON(http.StatusOK, api.ListResponse{Models: models})
+		c, err := readStoreConfig(m.Config)
+		if err != nil {
+			slog.Warn("bad manifest config", "name", mp, "error", err)
+			continue
+		}
+
+		n := model.ParseName(mp.GetFullTagname())
+		models = append(models, api.ModelResponse{
+			Model:  n.DisplayShortest(),
+			Name:   n.DisplayShortest(),
+			Size:   (&Manifest{ManifestV2: *m}).Size(),
+			Digest: digest,
+			Details: api.ModelDetails{
+				Format:            c.ModelFormat,
+				Family:            c.ModelFamily,
+				Families:          c.ModelFamilies,
+				ParameterSize:     c.ModelType,
+				QuantizationLevel: c.FileType,
+			},
+		})
+	}
+
+	return models, nil
+}
+
+// readStoreConfig decodes the config blob of a manifest from the active store.
+func readStoreConfig(config *Layer) (*ConfigV2, error) {
+	if config == nil {
+		return nil, errors.New("manifest has no config")
+	}
+
+	r, err := activeStore().OpenBlob(config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var c ConfigV2
+	if err := json.NewDecoder(r).Decode(&c); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
 }
 
 func (s *Server) CopyModelHandler(c *gin.Context) {
@@ -823,7 +905,7 @@ func (s *Server) CopyModelHandler(c *gin.Context) {
 }
 
 func (s *Server) HeadBlobHandler(c *gin.Context) {
-	path, err := GetBlobsPath(c.Param("digest"))
+	path, err := readBlobPath(c.Param("digest"))
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -862,7 +944,7 @@ func (s *Server) CreateBlobHandler(c *gin.Context) {
 		return
 	}
 
-	if layer.Digest != c.Param("digest") {
+	if !DigestsEqual(layer.Digest, c.Param("digest")) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("digest mismatch, expected %q, got %q", c.Param("digest"), layer.Digest)})
 		return
 	}
@@ -1026,6 +1108,21 @@ func Serve(ln net.Listener) error {
 		return err
 	}
 
+	// fixBlobs, run on every start above, is the only migration so far, from
+	// the unversioned layout, so all that's left is recording the version
+	from, to, needed, err := StoreNeedsMigration()
+	if err != nil {
+		return err
+	}
+
+	if needed {
+		slog.Info("recorded store layout version", "from", from, "to", to)
+	}
+
+	if err := recordLayoutVersion(); err != nil {
+		return err
+	}
+
 	if !envconfig.NoPrune {
 		// clean up unused layers and manifests
 		if err := PruneLayers(); err != nil {
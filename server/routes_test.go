@@ -3,6 +3,7 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
@@ -207,6 +208,17 @@ func Test_Routes(t *testing.T) {
 				assert.Equal(t, expectedParams, params)
 			},
 		},
+		{
+			Name:   "Create Blob Handler (dash digest)",
+			Method: http.MethodPost,
+			Path:   fmt.Sprintf("/api/blobs/sha256-%x", sha256.Sum256([]byte("blob"))),
+			Setup: func(t *testing.T, req *http.Request) {
+				req.Body = io.NopCloser(strings.NewReader("blob"))
+			},
+			Expected: func(t *testing.T, resp *http.Response) {
+				assert.Equal(t, http.StatusCreated, resp.StatusCode)
+			},
+		},
 	}
 
 	s := &Server{}
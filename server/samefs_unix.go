@@ -0,0 +1,34 @@
+//go:build linux || darwin
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+// sameFilesystem reports whether a and b are on the same device, so files can
+// be renamed between them.
+func sameFilesystem(a, b string) (bool, error) {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+
+	fb, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+
+	sa, ok := fa.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false, nil
+	}
+
+	sb, ok := fb.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false, nil
+	}
+
+	return sa.Dev == sb.Dev, nil
+}
@@ -0,0 +1,22 @@
+package server
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// sameFilesystem reports whether a and b are on the same volume, so files can
+// be renamed between them.
+func sameFilesystem(a, b string) (bool, error) {
+	a, err := filepath.Abs(a)
+	if err != nil {
+		return false, err
+	}
+
+	b, err = filepath.Abs(b)
+	if err != nil {
+		return false, err
+	}
+
+	return strings.EqualFold(filepath.VolumeName(a), filepath.VolumeName(b)), nil
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// Store is the storage backend behind the model path accessors: GetManifest,
+// LocalManifestDigest, RetagFrom, WriteManifestIfChanged, CopyModel,
+// ListModelPaths and DeleteModel read, write, list and remove manifests
+// through it, and SaveTar, LoadTar and CopyBlobTo move blobs through it. The
+// default store keeps them in the models directories on the local filesystem;
+// embedders may install their own with SetStore, e.g. to keep archives in
+// object storage.
+//
+// Pulling downloads blobs into the models directories and then writes them to
+// the store along with the manifest. Pull records, pushing, creating models
+// and loading them to run still use the models directories directly, and
+// DeleteModel only removes unused blobs from a FileStore since Store has no
+// way to remove them.
+type Store interface {
+	// OpenBlob returns a reader for the blob with the given digest. It
+	// returns an error wrapping os.ErrNotExist if the blob is missing.
+	OpenBlob(digest string) (io.ReadCloser, error)
+
+	// WriteBlob stores the contents of r as the blob with the given digest,
+	// failing if the contents don't match it, and returns the bytes written.
+	WriteBlob(digest string, r io.Reader) (int64, error)
+
+	// HasBlob reports whether the blob with the given digest is stored.
+	HasBlob(digest string) (bool, error)
+
+	// ReadManifest returns the raw bytes of the model's manifest. It returns
+	// an error wrapping os.ErrNotExist if the model is missing.
+	ReadManifest(mp ModelPath) ([]byte, error)
+
+	// WriteManifest stores the raw bytes of the model's manifest, replacing
+	// any previous contents.
+	WriteManifest(mp ModelPath, manifest []byte) error
+
+	// ListManifests returns the model paths of every stored manifest, sorted
+	// by their String form.
+	ListManifests() ([]ModelPath, error)
+
+	// DeleteManifest removes the model's manifest. It returns an error
+	// wrapping os.ErrNotExist if the model is missing.
+	DeleteManifest(mp ModelPath) error
+}
+
+// FileStore is the default Store, which keeps blobs and manifests in the
+// models directories configured with OLLAMA_MODELS.
+type FileStore struct{}
+
+func (FileStore) OpenBlob(digest string) (io.ReadCloser, error) {
+	blob, err := readBlobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(blob)
+}
+
+func (FileStore) WriteBlob(digest string, r io.Reader) (int64, error) {
+	return WriteBlob(digest, r)
+}
+
+func (FileStore) HasBlob(digest string) (bool, error) {
+	blob, err := readBlobPath(digest)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := os.Stat(blob); errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (FileStore) ReadManifest(mp ModelPath) ([]byte, error) {
+	p, err := mp.manifestReadPath()
+	if err != nil {
+		return nil, err
+	}
+
+	return os.ReadFile(p)
+}
+
+func (FileStore) WriteManifest(mp ModelPath, manifest []byte) error {
+	p, err := mp.GetManifestPath()
+	if err != nil {
+		return err
+	}
+
+	return writeManifestFile(p, manifest)
+}
+
+func (FileStore) ListManifests() ([]ModelPath, error) {
+	return listModelPaths(true)
+}
+
+func (FileStore) DeleteManifest(mp ModelPath) error {
+	p, err := mp.manifestReadPath()
+	if err != nil {
+		return err
+	}
+
+	return removeManifestFile(p)
+}
+
+type storeHolder struct{ Store }
+
+var store atomic.Value
+
+// SetStore replaces the store used by the model path accessors listed on
+// Store. Passing nil restores the default FileStore.
+func SetStore(s Store) {
+	if s == nil {
+		s = FileStore{}
+	}
+
+	store.Store(storeHolder{s})
+}
+
+// activeStore returns the store installed with SetStore, or a FileStore if
+// none was.
+func activeStore() Store {
+	if h, ok := store.Load().(storeHolder); ok {
+		return h.Store
+	}
+
+	return FileStore{}
+}
+
+// storeBlobs writes the blobs with the given digests from the models
+// directories to the active store, unless that is a FileStore which already
+// has them.
+func storeBlobs(digests []string) error {
+	s := activeStore()
+	if _, ok := s.(FileStore); ok {
+		return nil
+	}
+
+	for _, digest := range digests {
+		if err := storeBlob(s, digest); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func storeBlob(s Store, digest string) error {
+	blob, err := readBlobPath(digest)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(blob)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = s.WriteBlob(digest, f)
+	return err
+}
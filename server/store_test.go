@@ -0,0 +1,271 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+)
+
+// memStore is an in-memory Store keyed by digest and full tag name.
+type memStore struct {
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string][]byte
+}
+
+func newMemStore() *memStore {
+	return &memStore{blobs: make(map[string][]byte), manifests: make(map[string][]byte)}
+}
+
+func (s *memStore) OpenBlob(digest string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.blobs[digest]
+	if !ok {
+		return nil, fmt.Errorf("blob %s: %w", digest, os.ErrNotExist)
+	}
+
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (s *memStore) WriteBlob(digest string, r io.Reader) (int64, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	if got := fmt.Sprintf("sha256:%x", sha256.Sum256(b)); got != digest {
+		return 0, fmt.Errorf("%w: want %s, got %s", errDigestMismatch, digest, got)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[digest] = b
+	return int64(len(b)), nil
+}
+
+func (s *memStore) HasBlob(digest string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.blobs[digest]
+	return ok, nil
+}
+
+func (s *memStore) ReadManifest(mp ModelPath) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.manifests[mp.GetFullTagname()]
+	if !ok {
+		return nil, fmt.Errorf("manifest %s: %w", mp, os.ErrNotExist)
+	}
+
+	return b, nil
+}
+
+func (s *memStore) WriteManifest(mp ModelPath, manifest []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.manifests[mp.GetFullTagname()] = bytes.Clone(manifest)
+	return nil
+}
+
+func (s *memStore) ListManifests() ([]ModelPath, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var mps []ModelPath
+	for name := range s.manifests {
+		mps = append(mps, ParseModelPath(name))
+	}
+
+	sort.Slice(mps, func(i, j int) bool { return mps[i].String() < mps[j].String() })
+	return mps, nil
+}
+
+func (s *memStore) DeleteManifest(mp ModelPath) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.manifests[mp.GetFullTagname()]; !ok {
+		return fmt.Errorf("manifest %s: %w", mp, os.ErrNotExist)
+	}
+
+	delete(s.manifests, mp.GetFullTagname())
+	return nil
+}
+
+func TestMemStore(t *testing.T) {
+	models := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", models)
+
+	s := newMemStore()
+	SetStore(s)
+	t.Cleanup(func() { SetStore(nil) })
+
+	var layers []string
+	for _, c := range []string{`{"model_format":"gguf"}`, "weights"} {
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(c)))
+		if _, err := activeStore().WriteBlob(digest, strings.NewReader(c)); err != nil {
+			t.Fatal(err)
+		}
+
+		layers = append(layers, fmt.Sprintf(`{"digest":%q,"size":%d}`, digest, len(c)))
+	}
+
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"config":%s,"layers":[%s]}`, layers[0], layers[1])
+	src := ParseModelPath("llama3")
+	if err := src.writeManifest([]byte(manifest)); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("manifest", func(t *testing.T) {
+		m, _, err := GetManifest(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(m.Layers) != 1 || m.Config == nil {
+			t.Errorf("unexpected manifest %+v", m)
+		}
+
+		if _, _, err := GetManifest(ParseModelPath("missing")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected os.ErrNotExist, got %v", err)
+		}
+	})
+
+	t.Run("tar", func(t *testing.T) {
+		var b bytes.Buffer
+		if err := src.SaveTar(&b); err != nil {
+			t.Fatal(err)
+		}
+
+		dst := ParseModelPath("copy:v1")
+		if err := LoadTar(&b, dst); err != nil {
+			t.Fatal(err)
+		}
+
+		mps, err := ListModelPaths()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(mps) != 2 {
+			t.Errorf("expected 2 manifests, got %v", mps)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		models, err := listStoreModels()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, m := range models {
+			names = append(names, m.Name)
+		}
+
+		if want := []string{"copy:v1", "llama3:latest"}; !slices.Equal(names, want) {
+			t.Errorf("got %v, want %v", names, want)
+		}
+
+		if models[1].Details.Format != "gguf" {
+			t.Errorf("expected the config to be read from the store, got %+v", models[1].Details)
+		}
+
+		if mps, err := MatchLocal("copy"); err != nil {
+			t.Fatal(err)
+		} else if len(mps) != 0 {
+			t.Errorf("expected copy:latest not to match, got %v", mps)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if err := DeleteModel("copy:v1"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := GetManifest(ParseModelPath("copy:v1")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected os.ErrNotExist, got %v", err)
+		}
+
+		if mps, err := ListModelPaths(); err != nil {
+			t.Fatal(err)
+		} else if len(mps) != 1 {
+			t.Errorf("expected only llama3 to be left, got %v", mps)
+		}
+	})
+
+	t.Run("copy blob", func(t *testing.T) {
+		var b strings.Builder
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("weights")))
+		if _, err := CopyBlobTo(digest, &b); err != nil {
+			t.Fatal(err)
+		} else if b.String() != "weights" {
+			t.Errorf("got %q, want %q", b.String(), "weights")
+		}
+
+		missing := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("missing")))
+		if _, err := CopyBlobTo(missing, &b); !errors.Is(err, ErrBlobNotFound) {
+			t.Errorf("expected ErrBlobNotFound, got %v", err)
+		}
+	})
+
+	if entries, err := os.ReadDir(models); err != nil {
+		t.Fatal(err)
+	} else if len(entries) > 0 {
+		t.Errorf("expected nothing to be written to the models directory, got %v", entries)
+	}
+}
+
+func TestMemStorePull(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	// already downloaded, so only the manifest is fetched
+	config, layer := writeTestBlob(t, "config"), writeTestBlob(t, "model")
+	manifest, err := json.Marshal(ManifestV2{SchemaVersion: 2, Config: config, Layers: []*Layer{layer}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/ns/model/manifests/latest" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Write(manifest)
+	}))
+	t.Cleanup(srv.Close)
+
+	s := newMemStore()
+	SetStore(s)
+	t.Cleanup(func() { SetStore(nil) })
+
+	name := "http://" + srv.Listener.Addr().String() + "/ns/model"
+	if err := PullModel(context.Background(), name, &registryOptions{Insecure: true}, func(api.ProgressResponse) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := GetManifest(ParseModelPath(name)); err != nil {
+		t.Errorf("expected the manifest in the store: %v", err)
+	}
+
+	for _, digest := range []string{config.Digest, layer.Digest} {
+		if ok, err := s.HasBlob(digest); err != nil || !ok {
+			t.Errorf("expected blob %s in the store, got %t, %v", digest, ok, err)
+		}
+	}
+}
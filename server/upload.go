@@ -49,7 +49,7 @@ const (
 )
 
 func (b *blobUpload) Prepare(ctx context.Context, requestURL *url.URL, opts *registryOptions) error {
-	p, err := GetBlobsPath(b.Digest)
+	p, err := readBlobPath(b.Digest)
 	if err != nil {
 		return err
 	}
@@ -57,7 +57,8 @@ func (b *blobUpload) Prepare(ctx context.Context, requestURL *url.URL, opts *reg
 	if b.From != "" {
 		values := requestURL.Query()
 		values.Add("mount", b.Digest)
-		values.Add("from", ParseModelPath(b.From).GetNamespaceRepository())
+		// Encode escapes the repository, so it mustn't be escaped already
+		values.Add("from", ParseModelPath(b.From).repositoryName())
 		requestURL.RawQuery = values.Encode()
 	}
 
@@ -124,7 +125,7 @@ func (b *blobUpload) Run(ctx context.Context, opts *registryOptions) {
 	defer blobUploadManager.Delete(b.Digest)
 	ctx, b.CancelFunc = context.WithCancel(ctx)
 
-	p, err := GetBlobsPath(b.Digest)
+	p, err := readBlobPath(b.Digest)
 	if err != nil {
 		b.err = err
 		return
@@ -361,8 +362,10 @@ func (p *progressWriter) Rollback() {
 }
 
 func uploadBlob(ctx context.Context, mp ModelPath, layer *Layer, opts *registryOptions, fn func(api.ProgressResponse)) error {
-	requestURL := mp.BaseURL()
-	requestURL = requestURL.JoinPath("v2", mp.GetNamespaceRepository(), "blobs", layer.Digest)
+	requestURL, err := mp.BlobURL(layer.Digest)
+	if err != nil {
+		return err
+	}
 
 	resp, err := makeRequestWithRetry(ctx, http.MethodHead, requestURL, nil, nil, opts)
 	switch {
@@ -384,8 +387,13 @@ func uploadBlob(ctx context.Context, mp ModelPath, layer *Layer, opts *registryO
 	data, ok := blobUploadManager.LoadOrStore(layer.Digest, &blobUpload{Layer: layer})
 	upload := data.(*blobUpload)
 	if !ok {
-		requestURL := mp.BaseURL()
-		requestURL = requestURL.JoinPath("v2", mp.GetNamespaceRepository(), "blobs/uploads/")
+		requestURL, err := mp.BaseURL()
+		if err != nil {
+			blobUploadManager.Delete(layer.Digest)
+			return err
+		}
+
+		requestURL = requestURL.JoinPath("v2", mp.RepositoryPath(), "blobs/uploads/")
 		if err := upload.Prepare(ctx, requestURL, opts); err != nil {
 			blobUploadManager.Delete(layer.Digest)
 			return err